@@ -0,0 +1,257 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// API keys look like ucx_<prefix>_<secret>. The prefix identifies the key and can be shown or logged,
+// the secret is only known to the holder of the key; just its SHA-256 hash is stored.
+const (
+	apiKeyScheme    = "ucx_"
+	apiKeyPrefixLen = 8
+	apiKeySecretLen = 32
+
+	// apiKeyTouchEvery is how stale the last-used time of a key may get before it is persisted again.
+	apiKeyTouchEvery = time.Minute
+)
+
+// APIKey is a machine identity acting on behalf of its owner, with at most the permissions in its scope.
+type APIKey struct {
+	id       uuid.UUID
+	prefix   string
+	name     string
+	owner    uuid.UUID
+	scopes   Permission
+	hash     [32]byte
+	created  time.Time
+	expires  time.Time
+	lastUsed time.Time
+}
+
+func (k *APIKey) ID() uuid.UUID {
+	return k.id
+}
+
+// Prefix returns the public part of the key, which identifies it.
+func (k *APIKey) Prefix() string {
+	return k.prefix
+}
+
+func (k *APIKey) Name() string {
+	return k.name
+}
+
+// Owner returns the ID of the user the key acts for.
+func (k *APIKey) Owner() uuid.UUID {
+	return k.owner
+}
+
+// Scopes returns the permissions the key is limited to.
+func (k *APIKey) Scopes() Permission {
+	return k.scopes
+}
+
+func (k *APIKey) Created() time.Time {
+	return k.created
+}
+
+// Expires returns when the key stops being valid, or the zero time if it never does.
+func (k *APIKey) Expires() time.Time {
+	return k.expires
+}
+
+func (k *APIKey) LastUsed() time.Time {
+	return k.lastUsed
+}
+
+func (k *APIKey) Expired() bool {
+	return !k.expires.IsZero() && time.Now().After(k.expires)
+}
+
+// CreateAPIKey creates a key for a user, limited to scopes and valid for expiry (zero for no expiry).
+// The returned secret is the only way to use the key and can't be retrieved again.
+func (a *Auth) CreateAPIKey(usernameOrId, name string, scopes Permission, expiry time.Duration) (string, *APIKey, error) {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return "", nil, ErrUserNotFound
+	}
+
+	random := make([]byte, apiKeyPrefixLen/2+apiKeySecretLen)
+	if _, err := rand.Read(random); err != nil {
+		return "", nil, err
+	}
+	prefix := hex.EncodeToString(random[:apiKeyPrefixLen/2])
+	secret := hex.EncodeToString(random[apiKeyPrefixLen/2:])
+
+	k := &APIKey{
+		id:      uuid.New(),
+		prefix:  prefix,
+		name:    name,
+		owner:   u.id,
+		scopes:  scopes,
+		hash:    sha256.Sum256([]byte(secret)),
+		created: time.Now(),
+	}
+	if expiry > 0 {
+		k.expires = k.created.Add(expiry)
+	}
+
+	a.lock.Lock()
+	if _, exists := a.apiKeys[prefix]; exists {
+		a.lock.Unlock()
+		return a.CreateAPIKey(usernameOrId, name, scopes, expiry)
+	}
+	a.apiKeys[prefix] = k
+	a.lock.Unlock()
+
+	if err := a.persistAPIKey(k); err != nil {
+		return "", nil, err
+	}
+	a.publish(ChangeEvent{Kind: APIKeyAdded, User: u.id, APIKey: k.id})
+	e := AuditEvent{Action: AuditCreateAPIKey, Subject: u.username, Permission: scopes, Detail: apiKeyDetail(k)}
+	if err := a.audit(e); err != nil {
+		return "", nil, err
+	}
+	return apiKeyScheme + prefix + "_" + secret, k, nil
+}
+
+// GetAPIKey returns a key by its ID or prefix.
+func (a *Auth) GetAPIKey(prefixOrId string) (*APIKey, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if k, ok := a.apiKeys[prefixOrId]; ok {
+		return k, true
+	}
+	if _, err := uuid.Parse(prefixOrId); err == nil {
+		for _, k := range a.apiKeys {
+			if k.id.String() == prefixOrId {
+				return k, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// APIKeys returns the keys of a user.
+func (a *Auth) APIKeys(usernameOrId string) []*APIKey {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return nil
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var list []*APIKey
+	for _, k := range a.apiKeys {
+		if k.owner == u.id {
+			list = append(list, k)
+		}
+	}
+	return list
+}
+
+// VerifyAPIKey returns the key a secret belongs to and its owner, and records the key as used.
+func (a *Auth) VerifyAPIKey(secret string) (*APIKey, *User, error) {
+	rest, ok := strings.CutPrefix(secret, apiKeyScheme)
+	if !ok {
+		return nil, nil, ErrInvalidAPIKey
+	}
+	prefix, secret, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, nil, ErrInvalidAPIKey
+	}
+
+	a.lock.RLock()
+	k, ok := a.apiKeys[prefix]
+	a.lock.RUnlock()
+	if !ok {
+		return nil, nil, ErrInvalidAPIKey
+	}
+	hash := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(hash[:], k.hash[:]) != 1 {
+		return nil, nil, ErrInvalidAPIKey
+	}
+	if k.Expired() {
+		return nil, nil, ErrAPIKeyExpired
+	}
+	u, ok := a.GetUser(k.owner.String())
+	if !ok {
+		return nil, nil, ErrUserNotFound
+	}
+	if err := a.active(u); err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	a.lock.Lock()
+	touched := now.Sub(k.lastUsed) < apiKeyTouchEvery
+	k.lastUsed = now
+	a.lock.Unlock()
+	if touched {
+		return k, u, nil
+	}
+	return k, u, a.persistAPIKey(k)
+}
+
+// RevokeAPIKey deletes a key by its ID or prefix.
+func (a *Auth) RevokeAPIKey(prefixOrId string) error {
+	k, ok := a.GetAPIKey(prefixOrId)
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+
+	a.lock.Lock()
+	delete(a.apiKeys, k.prefix)
+	a.lock.Unlock()
+
+	if err := a.persist(recordDeleteAPIKey, k.id[:]); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: APIKeyRevoked, User: k.owner, APIKey: k.id})
+	e := AuditEvent{Action: AuditRevokeAPIKey, Permission: k.scopes, Detail: apiKeyDetail(k)}
+	if u, ok := a.GetUser(k.owner.String()); ok {
+		e.Subject = u.username
+	}
+	return a.audit(e)
+}
+
+// apiKeyDetail describes a key in the audit log.
+func apiKeyDetail(k *APIKey) string {
+	return fmt.Sprintf("key %s (%s)", k.prefix, k.name)
+}
+
+// apiKeyPermission returns the permissions of a key in acl: those of its owner, limited to its scope.
+func (a *Auth) apiKeyPermission(acl *ACL, k *APIKey) (Permission, bool) {
+	if k.Expired() {
+		return Permission(0), false
+	}
+	owner, ok := a.GetUser(k.owner.String())
+	if !ok {
+		return Permission(0), false
+	}
+	p, ok := a.userPermission(acl, owner)
+	if !ok {
+		return Permission(0), false
+	}
+	p &= k.scopes
+	return p, p != 0
+}
+
+// deleteAPIKeysOf deletes the keys owned by a user. a.lock must be held.
+func (a *Auth) deleteAPIKeysOf(owner uuid.UUID) {
+	for prefix, k := range a.apiKeys {
+		if k.owner == owner {
+			delete(a.apiKeys, prefix)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/another-d-mention/unicomplex/crypt/hashing"
+	"github.com/another-d-mention/unicomplex/filesystem"
+)
+
+// AuditAction is the kind of an audit event.
+type AuditAction string
+
+const (
+	AuditAddUser         AuditAction = "user.add"
+	AuditDeleteUser      AuditAction = "user.delete"
+	AuditDisableUser     AuditAction = "user.disable"
+	AuditEnableUser      AuditAction = "user.enable"
+	AuditUserExpiry      AuditAction = "user.expiry"
+	AuditSetPassword     AuditAction = "user.password"
+	AuditAddGroup        AuditAction = "group.add"
+	AuditDeleteGroup     AuditAction = "group.delete"
+	AuditJoinGroup       AuditAction = "group.join"
+	AuditLeaveGroup      AuditAction = "group.leave"
+	AuditACLGrantUser    AuditAction = "acl.user.grant"
+	AuditACLRevokeUser   AuditAction = "acl.user.revoke"
+	AuditACLDenyUser     AuditAction = "acl.user.deny"
+	AuditACLGrantGroup   AuditAction = "acl.group.grant"
+	AuditACLRevokeGroup  AuditAction = "acl.group.revoke"
+	AuditACLDenyGroup    AuditAction = "acl.group.deny"
+	AuditACLResolution   AuditAction = "acl.resolution"
+	AuditAddRole         AuditAction = "role.add"
+	AuditDeleteRole      AuditAction = "role.delete"
+	AuditRolePermissions AuditAction = "role.permissions"
+	AuditRoleInherit     AuditAction = "role.inherit"
+	AuditRoleDisinherit  AuditAction = "role.disinherit"
+	AuditAssignRole      AuditAction = "role.assign"
+	AuditUnassignRole    AuditAction = "role.unassign"
+	AuditCreateAPIKey    AuditAction = "apikey.create"
+	AuditRevokeAPIKey    AuditAction = "apikey.revoke"
+	AuditLoginSuccess    AuditAction = "login.success"
+	AuditLoginFailure    AuditAction = "login.failure"
+	// AuditLoginPassword is a login whose password was right, pending a second factor.
+	AuditLoginPassword    AuditAction = "login.password"
+	AuditTOTPSuccess      AuditAction = "totp.success"
+	AuditTOTPFailure      AuditAction = "totp.failure"
+	AuditPermissionDenied AuditAction = "permission.denied"
+)
+
+// AuditEvent is an entry of the audit log.
+type AuditEvent struct {
+	// Seq numbers the events of a log from 1. It is set by the sink.
+	Seq    uint64
+	Time   time.Time
+	Action AuditAction
+	// Actor is who made the change, as set by WithActor, empty if unknown.
+	Actor string
+	// Subject is the user, group, role or API key the event is about. For group.join and group.leave,
+	// it is the user or group joining or leaving the group in Detail; likewise for role inheritance.
+	Subject string
+	// Resource is the resource of the ACL or role assignment concerned, or "acl:<id>" for an ACL not attached to one.
+	Resource   string
+	Permission Permission
+	Role       string
+	IP         string
+	Detail     string
+	// Prev is the hash of the previous event, in hex, empty for the first one. It is set by the sink.
+	Prev string
+}
+
+// auditRecord is the JSON form of an AuditEvent. The permission is kept as a number, so that logs stay
+// readable whatever the names registered; the names are written alongside for humans.
+type auditRecord struct {
+	Seq        uint64      `json:"seq"`
+	Time       time.Time   `json:"time"`
+	Action     AuditAction `json:"action"`
+	Actor      string      `json:"actor,omitempty"`
+	Subject    string      `json:"subject,omitempty"`
+	Resource   string      `json:"resource,omitempty"`
+	Permission uint64      `json:"permission,omitempty"`
+	Names      string      `json:"permission_names,omitempty"`
+	Role       string      `json:"role,omitempty"`
+	IP         string      `json:"ip,omitempty"`
+	Detail     string      `json:"detail,omitempty"`
+	Prev       string      `json:"prev,omitempty"`
+}
+
+func (e AuditEvent) record() auditRecord {
+	r := auditRecord{
+		Seq:        e.Seq,
+		Time:       e.Time,
+		Action:     e.Action,
+		Actor:      e.Actor,
+		Subject:    e.Subject,
+		Resource:   e.Resource,
+		Permission: uint64(e.Permission),
+		Role:       e.Role,
+		IP:         e.IP,
+		Detail:     e.Detail,
+		Prev:       e.Prev,
+	}
+	if e.Permission != 0 {
+		r.Names = e.Permission.String()
+	}
+	return r
+}
+
+func auditEventFromRecord(r auditRecord) AuditEvent {
+	return AuditEvent{
+		Seq:        r.Seq,
+		Time:       r.Time,
+		Action:     r.Action,
+		Actor:      r.Actor,
+		Subject:    r.Subject,
+		Resource:   r.Resource,
+		Permission: Permission(r.Permission),
+		Role:       r.Role,
+		IP:         r.IP,
+		Detail:     r.Detail,
+		Prev:       r.Prev,
+	}
+}
+
+// AuditSink stores audit events.
+type AuditSink interface {
+	// Append durably adds an event to the log.
+	Append(e AuditEvent) error
+}
+
+// FileAuditSink is an AuditSink writing the events to an append-only file of a filesystem.FileSystem.
+// Each line holds the SHA-256 hash of an event, in hex, then the event in JSON. The hash covers the
+// JSON and the hash of the previous event, so changing, removing or reordering events breaks the
+// chain, which VerifyAuditLog detects.
+type FileAuditSink struct {
+	lock sync.Mutex
+	fs   filesystem.FileSystem
+	path string
+	seq  uint64
+	last []byte
+}
+
+// NewFileAuditSink opens the audit log at path, creating it if needed. An existing log is verified
+// first, so that new events extend a valid chain.
+func NewFileAuditSink(fs filesystem.FileSystem, path string) (*FileAuditSink, error) {
+	s := &FileAuditSink{fs: fs, path: path}
+	if !fs.Exists(path) {
+		return s, nil
+	}
+	events, last, err := verifyAuditLog(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	s.seq, s.last = uint64(len(events)), last
+	return s, nil
+}
+
+func (s *FileAuditSink) Append(e AuditEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e.Seq = s.seq + 1
+	e.Prev = hex.EncodeToString(s.last)
+	data, err := json.Marshal(e.record())
+	if err != nil {
+		return err
+	}
+	sum := chainHash(s.last, data)
+
+	line := make([]byte, 0, 2*len(sum)+len(data)+2)
+	line = hex.AppendEncode(line, sum)
+	line = append(line, ' ')
+	line = append(line, data...)
+	line = append(line, '\n')
+	if err = writeSynced(s.fs, s.path, line, os.O_CREATE|os.O_WRONLY); err != nil {
+		return err
+	}
+
+	s.seq, s.last = e.Seq, sum
+	return nil
+}
+
+func chainHash(prev, data []byte) []byte {
+	return hashing.NewSHA256Hasher().Bytes(append(append([]byte(nil), prev...), data...))
+}
+
+// VerifyAuditLog reads the audit log written by a FileAuditSink at path and checks its hash chain.
+// It returns the events read; if the log was tampered with, the error wraps ErrAuditTampered and the
+// events are those before the first invalid one.
+func VerifyAuditLog(fs filesystem.FileSystem, path string) ([]AuditEvent, error) {
+	events, _, err := verifyAuditLog(fs, path)
+	return events, err
+}
+
+func verifyAuditLog(fs filesystem.FileSystem, path string) ([]AuditEvent, []byte, error) {
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var events []AuditEvent
+	var last []byte
+	if len(data) == 0 {
+		return events, last, nil
+	}
+	for n, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+		tampered := func(reason string) error {
+			return fmt.Errorf("%w: line %d: %s", ErrAuditTampered, n+1, reason)
+		}
+
+		sumHex, payload, ok := bytes.Cut(line, []byte(" "))
+		if !ok {
+			return events, last, tampered("malformed line")
+		}
+		sum, err := hex.DecodeString(string(sumHex))
+		if err != nil || !bytes.Equal(sum, chainHash(last, payload)) {
+			return events, last, tampered("hash mismatch")
+		}
+
+		var r auditRecord
+		if err = json.Unmarshal(payload, &r); err != nil {
+			return events, last, tampered(err.Error())
+		}
+		e := auditEventFromRecord(r)
+		if e.Seq != uint64(len(events))+1 || e.Prev != hex.EncodeToString(last) {
+			return events, last, tampered("broken chain")
+		}
+
+		events = append(events, e)
+		last = sum
+	}
+	return events, last, nil
+}
+
+// SetAuditSink sets where audit events are recorded: users and groups being added, deleted, disabled or
+// changing membership, changes to ACLs, roles, role assignments and API keys, logins, second factor
+// checks and the requests denied by Authorize. A nil sink disables auditing.
+// Once a change is persisted, a failure to record it is returned by the method making it.
+func (a *Auth) SetAuditSink(sink AuditSink) {
+	a.lock.Lock()
+	a.auditSink = sink
+	a.lock.Unlock()
+}
+
+// audit records an event if there is an audit sink.
+func (a *Auth) audit(e AuditEvent) error {
+	a.lock.RLock()
+	sink := a.auditSink
+	a.lock.RUnlock()
+	if sink == nil {
+		return nil
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Actor == "" {
+		e.Actor = a.actor
+	}
+	return sink.Append(e)
+}
+
+// WithActor returns a view of a whose changes are recorded in the audit log as made by actor, such
+// as the name of the administrator or service making them. The view shares everything else with a.
+func (a *Auth) WithActor(actor string) *Auth {
+	return &Auth{authState: a.authState, actor: actor}
+}
+
+// auditACL records a change of acl.
+func (a *Auth) auditACL(action AuditAction, acl *ACL, subject string, permission Permission) error {
+	return a.audit(AuditEvent{Action: action, Subject: subject, Resource: a.aclResource(acl), Permission: permission})
+}
+
+// aclResource returns how an ACL is named in the audit log: the resource it is attached to if any.
+func (a *Auth) aclResource(acl *ACL) string {
+	if acl == a.acl {
+		return "/"
+	}
+	if p, _, ok := a.resourceOf(acl); ok {
+		return p
+	}
+	return "acl:" + acl.ID().String()
+}
+
+// auditRole records a change of role assignment.
+func (a *Auth) auditRole(action AuditAction, ra RoleAssignment) error {
+	e := AuditEvent{Action: action, Resource: ra.Resource}
+	if ra.Group {
+		if g, ok := a.GetGroup(ra.Subject.String()); ok {
+			e.Subject = g.name
+		}
+	} else if u, ok := a.GetUser(ra.Subject.String()); ok {
+		e.Subject = u.username
+	}
+	if r, ok := a.GetRole(ra.Role.String()); ok {
+		e.Role, e.Permission = r.name, r.permissions
+	}
+	return a.audit(e)
+}
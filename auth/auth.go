@@ -1,26 +1,156 @@
 package auth
 
 import (
-	"encoding/binary"
+	"bytes"
 	"io"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/another-d-mention/unicomplex/concurency/broadcast"
+	"github.com/another-d-mention/unicomplex/crypt/box"
+	"github.com/another-d-mention/unicomplex/encoding/msgpack"
 	"github.com/google/uuid"
 )
 
 type Auth struct {
-	lock   sync.RWMutex
-	users  map[string]*User
-	groups map[string]*Group
-	acl    *ACL
+	*authState
+	// actor is who makes the changes, as recorded in the audit log
+	actor string
+}
+
+// authState is the data of an Auth, shared with the views returned by WithActor.
+type authState struct {
+	lock    sync.RWMutex
+	users   map[string]*User
+	emails  map[string]*User // by lower case email
+	groups  map[string]*Group
+	apiKeys map[string]*APIKey // by prefix
+	acl     *ACL
+	// resources holds the nodes of the resource tree that have an ACL or block inheritance, by path
+	resources   map[string]*resource
+	roles       map[string]*Role // by name
+	assignments map[RoleAssignment]struct{}
+	policy      *PasswordPolicy
+	authz       *Policy
+	params      HashParams
+	lockout     LockoutPolicy
+	secret      box.Key
+	// secretSet tells whether secret was set by SetSecretKey rather than generated by New
+	secretSet bool
+	// dummy is the hash checked by Authenticate for unknown usernames
+	dummy passwordHash
+
+	throttle throttle
+	sessions SessionStore
+	// ownSessions is the store created by sessionStore, which Close stops
+	ownSessions *MemorySessionStore
+	auditSink   AuditSink
+	changes     *broadcast.Broadcaster[ChangeEvent]
+
+	storeLock   sync.Mutex
+	store       Store
+	journalSize int
 }
 
 func New() *Auth {
-	return &Auth{
-		users:  make(map[string]*User),
-		groups: make(map[string]*Group),
-		acl:    NewACL(),
+	secret, _ := box.GenerateKey()
+	a := &Auth{authState: &authState{
+		users:       make(map[string]*User),
+		emails:      make(map[string]*User),
+		groups:      make(map[string]*Group),
+		apiKeys:     make(map[string]*APIKey),
+		acl:         NewACL(),
+		resources:   make(map[string]*resource),
+		roles:       make(map[string]*Role),
+		assignments: make(map[RoleAssignment]struct{}),
+		params:      DefaultHashParams,
+		lockout:     DefaultLockoutPolicy,
+		secret:      secret,
+		changes:     broadcast.New[ChangeEvent](),
+	}}
+	a.changes.SetOverflow(ChangeEvent{Kind: StateReplaced})
+	return a
+}
+
+// Open returns an Auth restored from the store. Every later change is persisted to it automatically.
+func Open(store Store) (*Auth, error) {
+	a := New()
+	snapshot, journal, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	if snapshot != nil {
+		if err = a.UnmarshalBinary(bytes.NewReader(snapshot)); err != nil {
+			return nil, err
+		}
+	}
+	for _, record := range journal {
+		if err = a.replay(record); err != nil {
+			return nil, err
+		}
+	}
+	if err = a.load(); err != nil {
+		return nil, err
+	}
+
+	a.store = store
+	a.journalSize = len(journal)
+	return a, nil
+}
+
+// Save writes a full snapshot to the store, which also compacts its journal.
+func (a *Auth) Save() error {
+	a.storeLock.Lock()
+	defer a.storeLock.Unlock()
+	return a.save()
+}
+
+func (a *Auth) save() error {
+	if a.store == nil {
+		return ErrNoStore
+	}
+	var buf bytes.Buffer
+	if err := a.MarshalBinary(&buf); err != nil {
+		return err
+	}
+	if err := a.store.Save(buf.Bytes()); err != nil {
+		return err
 	}
+	a.journalSize = 0
+	return nil
+}
+
+// SetPasswordPolicy sets the policy enforced for new passwords. A nil policy accepts any password.
+func (a *Auth) SetPasswordPolicy(policy *PasswordPolicy) {
+	a.lock.Lock()
+	a.policy = policy
+	a.lock.Unlock()
+}
+
+func (a *Auth) PasswordPolicy() *PasswordPolicy {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.policy
+}
+
+// SetHashParams sets the argon2id parameters for new password hashes. Existing hashes made with weaker
+// parameters are upgraded the next time VerifyPassword succeeds for their user.
+func (a *Auth) SetHashParams(params HashParams) error {
+	if !params.valid() {
+		return ErrInvalidHashParams
+	}
+	a.lock.Lock()
+	a.params = params
+	a.lock.Unlock()
+	return nil
+}
+
+func (a *Auth) HashParams() HashParams {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.params
 }
 
 // ---------------- USERS ---------------
@@ -40,8 +170,11 @@ func (a *Auth) AddUser(username, password string) error {
 	if _, ok := a.GetUser(username); ok {
 		return ErrUserAlreadyExists
 	}
+	if err := a.PasswordPolicy().Validate(password); err != nil {
+		return err
+	}
 
-	u, err := newUser(username, password)
+	u, err := newUser(username, password, a.HashParams())
 	if err != nil {
 		return err
 	}
@@ -50,7 +183,11 @@ func (a *Auth) AddUser(username, password string) error {
 	a.users[u.username] = u
 	a.lock.Unlock()
 
-	return nil
+	if err := a.persistUser(u); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: UserAdded, User: u.id})
+	return a.audit(AuditEvent{Action: AuditAddUser, Subject: u.username})
 }
 
 func (a *Auth) GetUser(usernameOrId string) (*User, bool) {
@@ -74,13 +211,129 @@ func (a *Auth) GetUser(usernameOrId string) (*User, bool) {
 	return nil, false
 }
 
+// ImportUser adds a user with an existing password hash, either a bcrypt hash or an argon2id one
+// in the PHC string format ($argon2id$v=19$m=...,t=...,p=...$salt$hash). The hash is replaced by
+// one using the current parameters on the first successful VerifyPassword.
+func (a *Auth) ImportUser(username, hash string) error {
+	if _, ok := a.GetUser(username); ok {
+		return ErrUserAlreadyExists
+	}
+	h, err := parsePasswordHash(hash)
+	if err != nil {
+		return err
+	}
+	u := newUserWithHash(username, h)
+
+	a.lock.Lock()
+	a.users[u.username] = u
+	a.lock.Unlock()
+
+	if err := a.persistUser(u); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: UserAdded, User: u.id})
+	return a.audit(AuditEvent{Action: AuditAddUser, Subject: u.username})
+}
+
+// VerifyPassword checks the password of a user like User.VerifyPassword, and also rehashes it if
+// the stored hash is weaker than the current parameters allow.
+func (a *Auth) VerifyPassword(usernameOrId, password string) (bool, error) {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return false, ErrUserNotFound
+	}
+	ok, err := a.checkPassword(u, password)
+	if !ok || err != nil {
+		return ok, err
+	}
+	return true, a.persistUser(u)
+}
+
+// checkPassword is VerifyPassword without persisting the changes made to u.
+func (a *Auth) checkPassword(u *User, password string) (bool, error) {
+	if !u.VerifyPassword(password) {
+		return false, nil
+	}
+
+	params := a.HashParams()
+	if u.password.needsRehash(params) {
+		hash, err := newPasswordHash(password, params)
+		if err != nil {
+			return true, err
+		}
+		a.lock.Lock()
+		u.password = hash
+		a.lock.Unlock()
+	}
+	return true, nil
+}
+
+// ChangePassword sets a new password for a user after checking the old one and the password policy.
+func (a *Auth) ChangePassword(usernameOrId, oldPassword, newPassword string) error {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return ErrUserNotFound
+	}
+	if !u.matchPassword(oldPassword) {
+		return ErrInvalidPassword
+	}
+	return a.setPassword(u, newPassword)
+}
+
+func (a *Auth) setPassword(u *User, password string) error {
+	policy := a.PasswordPolicy()
+	if err := policy.Validate(password); err != nil {
+		return err
+	}
+
+	var keep int
+	if policy != nil {
+		keep = policy.History
+		if u.usedPassword(password, keep) {
+			return ErrPasswordReused
+		}
+	}
+	hash, err := newPasswordHash(password, a.HashParams())
+	if err != nil {
+		return err
+	}
+	return a.replacePassword(u, hash, keep)
+}
+
+// replacePassword makes hash the password of u, keeping at most keep previous ones in the history.
+// Whoever sets a password knows it, so the failed logins of the user are forgotten, and the sessions
+// opened with the previous one end.
+func (a *Auth) replacePassword(u *User, hash passwordHash, keep int) error {
+	a.lock.Lock()
+	u.setPassword(hash, keep)
+	u.failedAttempts, u.lastFailure, u.lockedUntil = 0, time.Time{}, time.Time{}
+	a.lock.Unlock()
+
+	if err := a.persistUser(u); err != nil {
+		return err
+	}
+	if err := a.revokeUserSessions(u); err != nil {
+		return err
+	}
+	return a.audit(AuditEvent{Action: AuditSetPassword, Subject: u.username})
+}
+
+// PasswordExpired reports whether the password of a user is older than the policy allows.
+func (a *Auth) PasswordExpired(usernameOrId string) (bool, error) {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return false, ErrUserNotFound
+	}
+	return a.PasswordPolicy().Expired(u), nil
+}
+
 func (a *Auth) DeleteUser(usernameOrId string) error {
 	u, ok := a.GetUser(usernameOrId)
 	if !ok {
 		return ErrUserNotFound
 	}
 
-	for _, g := range u.groupNames {
+	for _, g := range u.GroupNames() {
 		if err := a.RemoveUserFromGroup(u.username, g); err != nil {
 			return err
 		}
@@ -88,9 +341,23 @@ func (a *Auth) DeleteUser(usernameOrId string) error {
 
 	a.lock.Lock()
 	delete(a.users, u.username)
+	delete(a.emails, strings.ToLower(u.email))
+	a.deleteAPIKeysOf(u.id)
+	a.deleteAssignments(func(ra RoleAssignment) bool { return ra.Subject == u.id })
+	sessions := a.sessions
 	a.lock.Unlock()
 
-	return nil
+	if sessions != nil {
+		if err := sessions.DeleteUser(u.id); err != nil {
+			return err
+		}
+	}
+
+	if err := a.persist(recordDeleteUser, u.id[:]); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: UserDeleted, User: u.id})
+	return a.audit(AuditEvent{Action: AuditDeleteUser, Subject: u.username})
 }
 
 // ---------------- GROUPS ---------------
@@ -116,7 +383,12 @@ func (a *Auth) AddGroup(name string) error {
 	a.lock.Lock()
 	a.groups[g.name] = g
 	a.lock.Unlock()
-	return nil
+
+	if err := a.persistGroup(g); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: GroupAdded, Group: g.id})
+	return a.audit(AuditEvent{Action: AuditAddGroup, Subject: g.name})
 }
 
 func (a *Auth) GetGroup(nameOrId string) (*Group, bool) {
@@ -150,11 +422,143 @@ func (a *Auth) DeleteGroup(name string) error {
 		}
 	}
 
+	// detach the groups nested in it
+	for _, child := range a.Groups() {
+		if child.hasParent(g.id) {
+			if err := a.RemoveGroupFromGroup(child.name, g.name); err != nil {
+				return err
+			}
+		}
+	}
+
 	a.lock.Lock()
-	delete(a.groups, name)
+	delete(a.groups, g.name)
+	a.deleteAssignments(func(ra RoleAssignment) bool { return ra.Subject == g.id })
 	a.lock.Unlock()
-	return nil
 
+	if err := a.persist(recordDeleteGroup, g.id[:]); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: GroupDeleted, Group: g.id})
+	return a.audit(AuditEvent{Action: AuditDeleteGroup, Subject: g.name})
+}
+
+// AddGroupToGroup makes a group a member of another one, so that the members of child are also members
+// of parent. It fails with ErrGroupCycle if parent is already a member of child, directly or not.
+func (a *Auth) AddGroupToGroup(child, parent string) error {
+	c, ok := a.GetGroup(child)
+	if !ok {
+		return ErrGroupNotFound
+	}
+	p, ok := a.GetGroup(parent)
+	if !ok {
+		return ErrGroupNotFound
+	}
+
+	a.lock.Lock()
+	if c.hasParent(p.id) {
+		a.lock.Unlock()
+		return nil
+	}
+	if c.id == p.id || a.ancestors([]uuid.UUID{p.id})[c.id] {
+		a.lock.Unlock()
+		return ErrGroupCycle
+	}
+	c.parents = append(c.parents, p.id)
+	c.parentNames = append(c.parentNames, p.name)
+	a.lock.Unlock()
+
+	if err := a.persistGroup(c); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: GroupNestingChanged, Group: c.id, Parent: p.id})
+	return a.audit(AuditEvent{Action: AuditJoinGroup, Subject: "group " + c.name, Detail: p.name})
+}
+
+func (a *Auth) RemoveGroupFromGroup(child, parent string) error {
+	c, ok := a.GetGroup(child)
+	if !ok {
+		return ErrGroupNotFound
+	}
+	p, ok := a.GetGroup(parent)
+	if !ok {
+		return ErrGroupNotFound
+	}
+
+	a.lock.Lock()
+	removed := false
+	for i, id := range c.parents {
+		if id == p.id {
+			c.parents = append(c.parents[:i:i], c.parents[i+1:]...)
+			c.parentNames = append(c.parentNames[:i:i], c.parentNames[i+1:]...)
+			removed = true
+			break
+		}
+	}
+	a.lock.Unlock()
+
+	if !removed {
+		return nil
+	}
+	if err := a.persistGroup(c); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: GroupNestingChanged, Group: c.id, Parent: p.id})
+	return a.audit(AuditEvent{Action: AuditLeaveGroup, Subject: "group " + c.name, Detail: p.name})
+}
+
+// EffectiveGroups returns the groups a user is a member of, directly or through nested groups.
+func (a *Auth) EffectiveGroups(usernameOrId string) ([]*Group, error) {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	ids := a.ancestors(u.groups)
+	list := make([]*Group, 0, len(ids))
+	for _, g := range a.groups {
+		if ids[g.id] {
+			list = append(list, g)
+		}
+	}
+	return list, nil
+}
+
+// sortedIDs returns the ids of a set in a stable order.
+func sortedIDs(set map[uuid.UUID]bool) []uuid.UUID {
+	list := make([]uuid.UUID, 0, len(set))
+	for id := range set {
+		list = append(list, id)
+	}
+	slices.SortFunc(list, func(a, b uuid.UUID) int {
+		return bytes.Compare(a[:], b[:])
+	})
+	return list
+}
+
+// ancestors returns the given groups and all the groups they are nested in. a.lock must be held.
+func (a *Auth) ancestors(groups []uuid.UUID) map[uuid.UUID]bool {
+	byID := make(map[uuid.UUID]*Group, len(a.groups))
+	for _, g := range a.groups {
+		byID[g.id] = g
+	}
+
+	seen := make(map[uuid.UUID]bool, len(groups))
+	queue := append([]uuid.UUID(nil), groups...)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		g, ok := byID[id]
+		if !ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		queue = append(queue, g.parents...)
+	}
+	return seen
 }
 
 func (a *Auth) AddUserToGroup(username, groupName string) error {
@@ -177,7 +581,12 @@ func (a *Auth) AddUserToGroup(username, groupName string) error {
 
 	u.groups = append(u.groups, g.id)
 	u.groupNames = append(u.groupNames, g.name)
-	return nil
+
+	if err := a.persistUser(u); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: MembershipChanged, User: u.id, Group: g.id})
+	return a.audit(AuditEvent{Action: AuditJoinGroup, Subject: u.username, Detail: g.name})
 }
 
 func (a *Auth) RemoveUserFromGroup(username, groupName string) error {
@@ -211,7 +620,11 @@ func (a *Auth) RemoveUserFromGroup(username, groupName string) error {
 		}
 	}
 
-	return nil
+	if err := a.persistUser(u); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: MembershipChanged, User: u.id, Group: g.id})
+	return a.audit(AuditEvent{Action: AuditLeaveGroup, Subject: u.username, Detail: g.name})
 }
 
 // ---------------- ACL ---------------
@@ -246,7 +659,12 @@ func (a *Auth) AddUserToACL(acl *ACL, usernameOrId string, permission Permission
 	acl.lock.Lock()
 	acl.users[u.id] = permission
 	acl.lock.Unlock()
-	return nil
+
+	if err := a.persistACL(acl); err != nil {
+		return err
+	}
+	a.publishACL(acl, u.id, uuid.Nil)
+	return a.auditACL(AuditACLGrantUser, acl, u.username, permission)
 }
 
 func (a *Auth) RemoveUserFromACL(acl *ACL, usernameOrId string) error {
@@ -263,7 +681,11 @@ func (a *Auth) RemoveUserFromACL(acl *ACL, usernameOrId string) error {
 	delete(acl.users, u.id)
 	acl.lock.Unlock()
 
-	return nil
+	if err := a.persistACL(acl); err != nil {
+		return err
+	}
+	a.publishACL(acl, u.id, uuid.Nil)
+	return a.auditACL(AuditACLRevokeUser, acl, u.username, 0)
 }
 
 func (a *Auth) ACLGroups(acl *ACL) map[string]Permission {
@@ -284,46 +706,180 @@ func (a *Auth) ACLGroups(acl *ACL) map[string]Permission {
 	return list
 }
 
+// GetPermission returns the permissions in acl (nil for the root ACL) of a user, a group or an API key.
+// Users and groups get their entries combined with those of the groups they are members of, as set
+// by the Resolution of the ACL. API keys get the permissions of their owner, limited to their scope.
 func (a *Auth) GetPermission(acl *ACL, nameOrId string) (Permission, bool) {
 	if acl == nil {
 		acl = a.acl
 	}
 
+	if user, ok := a.GetUser(nameOrId); ok { // it's a user id or name
+		return a.userPermission(acl, user)
+	}
+
+	if group, ok := a.GetGroup(nameOrId); ok { // it's a group id or name
+		return a.groupPermission(acl, group)
+	}
+
+	if key, ok := a.GetAPIKey(nameOrId); ok { // it's an API key id or prefix
+		return a.apiKeyPermission(acl, key)
+	}
+
+	return Permission(0), false
+}
+
+func (a *Auth) userPermission(acl *ACL, user *User) (Permission, bool) {
+	e, ok := a.explainUser(acl, user)
+	return e.Permission, ok
+}
+
+func (a *Auth) groupPermission(acl *ACL, group *Group) (Permission, bool) {
+	e, ok := a.explainGroup(acl, group)
+	return e.Permission, ok
+}
+
+// explainUser resolves the permission of a user in acl. Disabled and expired users have none.
+func (a *Auth) explainUser(acl *ACL, user *User) (Explanation, bool) {
+	a.lock.RLock()
+	inactive := user.active() != nil
+	groups := a.ancestors(user.GroupIDs())
+	a.lock.RUnlock()
+	if inactive {
+		return Explanation{}, false
+	}
+	return acl.resolve(user.id, false, sortedIDs(groups))
+}
+
+func (a *Auth) explainGroup(acl *ACL, group *Group) (Explanation, bool) {
 	a.lock.RLock()
-	defer a.lock.RUnlock()
+	groups := a.ancestors(group.ParentIDs())
+	a.lock.RUnlock()
+	return acl.resolve(group.id, true, sortedIDs(groups))
+}
 
-	if user, ok := a.GetUser(nameOrId); ok { // it's a user id or name
-		userPermission, k := acl.users[user.id] // we have ACL permissions for this user
-		if k {
-			return userPermission, true
-		}
-
-		// we look in the groups the user belongs to and check their permissions
-		groups := user.GroupIDs()
-		maximum := Permission(0)
-		for _, id := range groups {
-			if groupPermission, k := acl.groups[id]; k {
-				if groupPermission > maximum {
-					maximum = groupPermission
-				}
+// ExplainPermission returns how the permission of a user, group or API key in acl is resolved:
+// which grants and denies were considered and which bits each of them produced.
+func (a *Auth) ExplainPermission(acl *ACL, nameOrId string) (Explanation, error) {
+	if acl == nil {
+		acl = a.acl
+	}
+
+	e, _, err := a.explain(acl, nameOrId)
+	if err != nil {
+		return Explanation{}, err
+	}
+
+	for i := range e.Entries {
+		entry := &e.Entries[i]
+		if entry.Name != "" {
+			continue
+		}
+		if entry.Group {
+			if g, ok := a.GetGroup(entry.ID.String()); ok {
+				entry.Name = g.name
 			}
+		} else if u, ok := a.GetUser(entry.ID.String()); ok {
+			entry.Name = u.username
 		}
+	}
+	return e, nil
+}
 
-		if maximum == 0 {
-			return Permission(0), false
+// explain resolves the permission of a user, group or API key in acl, without naming the entries.
+func (a *Auth) explain(acl *ACL, nameOrId string) (Explanation, bool, error) {
+	if user, ok := a.GetUser(nameOrId); ok {
+		e, found := a.explainUser(acl, user)
+		return e, found, nil
+	}
+	if group, ok := a.GetGroup(nameOrId); ok {
+		e, found := a.explainGroup(acl, group)
+		return e, found, nil
+	}
+	if key, ok := a.GetAPIKey(nameOrId); ok {
+		if key.Expired() {
+			return Explanation{}, false, ErrAPIKeyExpired
+		}
+		owner, ok := a.GetUser(key.owner.String())
+		if !ok {
+			return Explanation{}, false, ErrUserNotFound
 		}
+		e, found := a.explainUser(acl, owner)
+		scope := ACLEntry{Kind: EntryScope, ID: key.id, Name: key.name, Mask: key.scopes, Effect: e.Permission &^ key.scopes}
+		e.Entries = append(e.Entries, scope)
+		e.Permission &= key.scopes
+		return e, found, nil
+	}
+	return Explanation{}, false, ErrUserNotFound
+}
 
-		return maximum, true
+// SetACLResolution sets how acl combines the entries of users and their groups.
+func (a *Auth) SetACLResolution(acl *ACL, resolution Resolution) error {
+	if acl == nil {
+		acl = a.acl
 	}
 
-	if group, ok := a.GetGroup(nameOrId); ok { // it's a group id or name
-		groupPermission, k := acl.groups[group.id] // we have ACL permissions for this group
-		if k {
-			return groupPermission, true
-		}
+	acl.lock.Lock()
+	acl.resolution = resolution
+	acl.lock.Unlock()
+
+	if err := a.persistACL(acl); err != nil {
+		return err
 	}
+	a.publishACL(acl, uuid.Nil, uuid.Nil)
+	return a.audit(AuditEvent{Action: AuditACLResolution, Resource: a.aclResource(acl), Detail: resolution.String()})
+}
 
-	return Permission(0), false
+// DenyUserInACL sets the permissions a user is denied in acl, whatever its grants. An empty mask removes the deny.
+func (a *Auth) DenyUserInACL(acl *ACL, usernameOrId string, deny Permission) error {
+	if acl == nil {
+		acl = a.acl
+	}
+
+	u, ok := a.GetUser(usernameOrId) // validate user
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	acl.lock.Lock()
+	if deny == 0 {
+		delete(acl.userDenies, u.id)
+	} else {
+		acl.userDenies[u.id] = deny
+	}
+	acl.lock.Unlock()
+
+	if err := a.persistACL(acl); err != nil {
+		return err
+	}
+	a.publishACL(acl, u.id, uuid.Nil)
+	return a.auditACL(AuditACLDenyUser, acl, u.username, deny)
+}
+
+// DenyGroupInACL sets the permissions the members of a group are denied in acl. An empty mask removes the deny.
+func (a *Auth) DenyGroupInACL(acl *ACL, groupOrId string, deny Permission) error {
+	if acl == nil {
+		acl = a.acl
+	}
+
+	g, ok := a.GetGroup(groupOrId) // validate group
+	if !ok {
+		return ErrGroupNotFound
+	}
+
+	acl.lock.Lock()
+	if deny == 0 {
+		delete(acl.groupDenies, g.id)
+	} else {
+		acl.groupDenies[g.id] = deny
+	}
+	acl.lock.Unlock()
+
+	if err := a.persistACL(acl); err != nil {
+		return err
+	}
+	a.publishACL(acl, uuid.Nil, g.id)
+	return a.auditACL(AuditACLDenyGroup, acl, g.name, deny)
 }
 
 func (a *Auth) AddGroupToACL(acl *ACL, groupOrId string, permission Permission) error {
@@ -340,7 +896,11 @@ func (a *Auth) AddGroupToACL(acl *ACL, groupOrId string, permission Permission)
 	acl.groups[g.id] = permission
 	acl.lock.Unlock()
 
-	return nil
+	if err := a.persistACL(acl); err != nil {
+		return err
+	}
+	a.publishACL(acl, uuid.Nil, g.id)
+	return a.auditACL(AuditACLGrantGroup, acl, g.name, permission)
 }
 
 func (a *Auth) RemoveGroupFromACL(acl *ACL, groupOrId string) error {
@@ -357,85 +917,389 @@ func (a *Auth) RemoveGroupFromACL(acl *ACL, groupOrId string) error {
 	delete(acl.groups, g.id)
 	acl.lock.Unlock()
 
-	return nil
+	if err := a.persistACL(acl); err != nil {
+		return err
+	}
+	a.publishACL(acl, uuid.Nil, g.id)
+	return a.auditACL(AuditACLRevokeGroup, acl, g.name, 0)
 }
 
 // ---------------- MISC ---------------
 
+// MarshalBinary writes a snapshot of the users, groups, roles, root ACL and resource ACLs in the versioned format
+// described in format.go.
 func (a *Auth) MarshalBinary(w io.Writer) error {
 	a.lock.RLock()
-	defer a.lock.RUnlock()
-
-	_ = binary.Write(w, binary.BigEndian, uint64(len(a.users)))
+	snap := snapshotRecord{
+		Users:  make([]userRecord, 0, len(a.users)),
+		Groups: make([]groupRecord, 0, len(a.groups)),
+		ACL:    a.acl.record(),
+	}
 	for _, u := range a.users {
-		u.marshalBinary(w)
+		snap.Users = append(snap.Users, u.record())
 	}
-	_ = binary.Write(w, binary.BigEndian, uint64(len(a.groups)))
 	for _, g := range a.groups {
-		g.marshalBinary(w)
+		snap.Groups = append(snap.Groups, g.record())
+	}
+	for _, k := range a.apiKeys {
+		snap.APIKeys = append(snap.APIKeys, k.record())
+	}
+	for p, r := range a.resources {
+		snap.Resources = append(snap.Resources, r.record(p))
 	}
+	for _, r := range a.roles {
+		snap.Roles = append(snap.Roles, r.record())
+	}
+	for ra := range a.assignments {
+		snap.Assignments = append(snap.Assignments, assignmentRecord(ra))
+	}
+	a.lock.RUnlock()
 
-	return a.acl.MarshalBinary(w)
+	return writeContainer(w, snap)
 }
 
+// UnmarshalBinary replaces the state with a snapshot written by MarshalBinary. Snapshots in the
+// original unversioned format are imported as well.
 func (a *Auth) UnmarshalBinary(r io.Reader) error {
-	var numUsers, numGroups uint64
-	err := binary.Read(r, binary.BigEndian, &numUsers)
+	var snap snapshotRecord
+	versioned, legacy, err := readContainer(r, &snap)
 	if err != nil {
 		return err
 	}
-	users := make(map[string]*User, numUsers)
-	for i := 0; i < int(numUsers); i++ {
-		u := new(User)
-		if err = u.unmarshalBinary(r); err != nil {
+	if !versioned {
+		return a.unmarshalLegacy(legacy)
+	}
+
+	users := make(map[string]*User, len(snap.Users))
+	for _, rec := range snap.Users {
+		u, err := userFromRecord(rec)
+		if err != nil {
 			return err
 		}
 		users[u.username] = u
 	}
-
-	err = binary.Read(r, binary.BigEndian, &numGroups)
-	if err != nil {
-		return err
+	groups := make(map[string]*Group, len(snap.Groups))
+	for _, rec := range snap.Groups {
+		g := groupFromRecord(rec)
+		groups[g.name] = g
 	}
 
-	groups := make(map[string]*Group, numGroups)
-	for i := 0; i < int(numGroups); i++ {
-		g := new(Group)
-		if err = g.unmarshalBinary(r); err != nil {
+	apiKeys := make(map[string]*APIKey, len(snap.APIKeys))
+	for _, rec := range snap.APIKeys {
+		k, err := apiKeyFromRecord(rec)
+		if err != nil {
 			return err
 		}
-		groups[g.name] = g
+		apiKeys[k.prefix] = k
+	}
+
+	resources := make(map[string]*resource, len(snap.Resources))
+	for _, rec := range snap.Resources {
+		p, r := resourceFromRecord(rec)
+		resources[p] = r
+	}
+
+	roles := make(map[string]*Role, len(snap.Roles))
+	for _, rec := range snap.Roles {
+		r := roleFromRecord(rec)
+		roles[r.name] = r
+	}
+	assignments := make(map[RoleAssignment]struct{}, len(snap.Assignments))
+	for _, rec := range snap.Assignments {
+		assignments[RoleAssignment(rec)] = struct{}{}
 	}
 
 	a.lock.Lock()
 	a.users = users
 	a.groups = groups
+	a.apiKeys = apiKeys
+	a.resources = resources
+	a.roles = roles
+	a.assignments = assignments
 	a.lock.Unlock()
+	a.acl.setRecord(snap.ACL)
 
-	if err = a.acl.UnmarshalBinary(r); err != nil {
+	if err := a.load(); err != nil {
 		return err
 	}
-
-	return a.load()
+	a.publish(ChangeEvent{Kind: StateReplaced})
+	return nil
 }
 
+// load rebuilds the membership lists and the email index that are derived from the user records.
 func (a *Auth) load() error {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 
+	a.emails = make(map[string]*User)
 	for _, u := range a.users {
-		for _, id := range u.groups {
-			g, ok := a.GetGroup(id.String())
-			if !ok {
+		if u.email != "" {
+			a.emails[strings.ToLower(u.email)] = u
+		}
+	}
+
+	groups := make(map[uuid.UUID]*Group, len(a.groups))
+	for _, g := range a.groups {
+		g.userIds, g.userNames = nil, nil
+		groups[g.id] = g
+	}
+
+	for _, u := range a.users {
+		ids := u.groups
+		u.groups, u.groupNames = make([]uuid.UUID, 0, len(ids)), nil
+		for _, id := range ids {
+			g, ok := groups[id]
+			if !ok { // the group was deleted
 				continue
 			}
 
 			g.userIds = append(g.userIds, u.id)
 			g.userNames = append(g.userNames, u.username)
 
+			u.groups = append(u.groups, g.id)
 			u.groupNames = append(u.groupNames, g.name)
 		}
 	}
 
+	for _, g := range a.groups {
+		ids := g.parents
+		g.parents, g.parentNames = nil, nil
+		for _, id := range ids {
+			if p, ok := groups[id]; ok {
+				g.parents = append(g.parents, p.id)
+				g.parentNames = append(g.parentNames, p.name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ---------------- JOURNAL ---------------
+
+func (a *Auth) persistUser(u *User) error {
+	if a.store == nil {
+		return nil
+	}
+	a.lock.RLock()
+	r := u.record()
+	a.lock.RUnlock()
+	data, err := msgpack.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return a.persist(recordUser, data)
+}
+
+func (a *Auth) persistGroup(g *Group) error {
+	if a.store == nil {
+		return nil
+	}
+	data, err := msgpack.Marshal(g.record())
+	if err != nil {
+		return err
+	}
+	return a.persist(recordGroup, data)
+}
+
+// persistACL journals acl if it is the root ACL or the ACL of a resource; other ACLs aren't part of the snapshot.
+func (a *Auth) persistACL(acl *ACL) error {
+	if a.store == nil {
+		return nil
+	}
+	if acl != a.acl {
+		if resourcePath, r, ok := a.resourceOf(acl); ok {
+			return a.persistResource(resourcePath, r)
+		}
+		return nil
+	}
+	data, err := msgpack.Marshal(acl.record())
+	if err != nil {
+		return err
+	}
+	return a.persist(recordACL, data)
+}
+
+func (a *Auth) persistAPIKey(k *APIKey) error {
+	if a.store == nil {
+		return nil
+	}
+	a.lock.RLock()
+	r := k.record()
+	a.lock.RUnlock()
+	data, err := msgpack.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return a.persist(recordAPIKey, data)
+}
+
+// persist appends a record to the store's journal, saving a new snapshot once the journal grows too long.
+func (a *Auth) persist(kind byte, payload []byte) error {
+	if a.store == nil {
+		return nil
+	}
+
+	a.storeLock.Lock()
+	defer a.storeLock.Unlock()
+
+	if err := a.store.Append(append([]byte{kind}, payload...)); err != nil {
+		return err
+	}
+	a.journalSize++
+	if a.journalSize >= compactAfter {
+		return a.save()
+	}
+	return nil
+}
+
+// replay applies a journal record. Records hold the full state of what they describe, so replaying
+// one that is already reflected in the snapshot changes nothing.
+func (a *Auth) replay(record []byte) error {
+	if len(record) == 0 {
+		return ErrInvalidRecord
+	}
+	r := bytes.NewReader(record[1:])
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	switch record[0] {
+	case recordUser, recordLegacyUser:
+		var u *User
+		if record[0] == recordLegacyUser {
+			u = new(User)
+			if err := u.unmarshalLegacy(r); err != nil {
+				return err
+			}
+		} else {
+			var rec userRecord
+			if err := msgpack.Unmarshal(record[1:], &rec); err != nil {
+				return err
+			}
+			var err error
+			if u, err = userFromRecord(rec); err != nil {
+				return err
+			}
+		}
+		for name, existing := range a.users {
+			if existing.id == u.id {
+				delete(a.users, name)
+			}
+		}
+		a.users[u.username] = u
+	case recordGroup, recordLegacyGroup:
+		var g *Group
+		if record[0] == recordLegacyGroup {
+			g = new(Group)
+			if err := g.unmarshalLegacy(r); err != nil {
+				return err
+			}
+		} else {
+			var rec groupRecord
+			if err := msgpack.Unmarshal(record[1:], &rec); err != nil {
+				return err
+			}
+			g = groupFromRecord(rec)
+		}
+		for name, existing := range a.groups {
+			if existing.id == g.id {
+				delete(a.groups, name)
+			}
+		}
+		a.groups[g.name] = g
+	case recordDeleteUser, recordDeleteGroup:
+		id, err := uuid.FromBytes(record[1:])
+		if err != nil {
+			return err
+		}
+		if record[0] == recordDeleteUser {
+			for name, u := range a.users {
+				if u.id == id {
+					delete(a.users, name)
+				}
+			}
+			a.deleteAPIKeysOf(id)
+		} else {
+			for name, g := range a.groups {
+				if g.id == id {
+					delete(a.groups, name)
+				}
+			}
+		}
+		a.deleteAssignments(func(ra RoleAssignment) bool { return ra.Subject == id })
+	case recordACL:
+		var rec aclRecord
+		if err := msgpack.Unmarshal(record[1:], &rec); err != nil {
+			return err
+		}
+		a.acl.setRecord(rec)
+	case recordLegacyACL:
+		return a.acl.unmarshalLegacy(r)
+	case recordAPIKey:
+		var rec apiKeyRecord
+		if err := msgpack.Unmarshal(record[1:], &rec); err != nil {
+			return err
+		}
+		k, err := apiKeyFromRecord(rec)
+		if err != nil {
+			return err
+		}
+		a.apiKeys[k.prefix] = k
+	case recordResource:
+		var rec resourceRecord
+		if err := msgpack.Unmarshal(record[1:], &rec); err != nil {
+			return err
+		}
+		p, r := resourceFromRecord(rec)
+		a.resources[p] = r
+	case recordDeleteResource:
+		delete(a.resources, string(record[1:]))
+	case recordRole:
+		var rec roleRecord
+		if err := msgpack.Unmarshal(record[1:], &rec); err != nil {
+			return err
+		}
+		r := roleFromRecord(rec)
+		for name, existing := range a.roles {
+			if existing.id == r.id {
+				delete(a.roles, name)
+			}
+		}
+		a.roles[r.name] = r
+	case recordDeleteRole:
+		id, err := uuid.FromBytes(record[1:])
+		if err != nil {
+			return err
+		}
+		for name, r := range a.roles {
+			if r.id == id {
+				delete(a.roles, name)
+			}
+		}
+		a.deleteAssignments(func(ra RoleAssignment) bool { return ra.Role == id })
+	case recordAssignRole, recordUnassignRole:
+		var rec assignmentRecord
+		if err := msgpack.Unmarshal(record[1:], &rec); err != nil {
+			return err
+		}
+		if record[0] == recordAssignRole {
+			a.assignments[RoleAssignment(rec)] = struct{}{}
+		} else {
+			delete(a.assignments, RoleAssignment(rec))
+		}
+	case recordDeleteAPIKey:
+		id, err := uuid.FromBytes(record[1:])
+		if err != nil {
+			return err
+		}
+		for prefix, k := range a.apiKeys {
+			if k.id == id {
+				delete(a.apiKeys, prefix)
+			}
+		}
+	default:
+		return ErrInvalidRecord
+	}
 	return nil
 }
@@ -0,0 +1,617 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/another-d-mention/unicomplex/network"
+	"github.com/another-d-mention/unicomplex/validation"
+)
+
+// A Policy refines the decisions of the ACLs and roles with conditions on the subject and the request.
+// It is written one rule per line, empty lines and lines starting with # being ignored:
+//
+//	allow|deny|require <actions> [on <resource>] [when <condition>]
+//
+// Actions are permission names, separated by commas, or * for any action. A rule applies to a resource
+// and the resources below it, or to the resources matching it if it has wildcards (see path.Match);
+// without a resource it applies everywhere. Conditions combine the following with and, or, not and
+// parentheses:
+//
+//	user <name>                    the subject is the user
+//	group <name>                   the subject is a member of the group, directly or not
+//	attr <key> = <value>           an attribute of the subject equals the value (!= for the opposite)
+//	ip in <range>,...              the client IP matches an address, a CIDR block, * or a range such as
+//	                               10.0.0.1-50 or 10.0.0.1-10.0.3.255
+//	time in <hh:mm>-<hh:mm>        the time of the request is in the window, which may span midnight
+//	weekday in <day>[-<day>],...   the request is made on one of the days (mon, tue, ...)
+//
+// Authorize denies a request matched by a deny rule, or by a require rule whose condition doesn't hold.
+// Otherwise it allows it if the subject has the permission, or if it is matched by an allow rule.
+type Policy struct {
+	rules []policyRule
+}
+
+type policyEffect uint8
+
+const (
+	policyAllow policyEffect = iota
+	policyDeny
+	policyRequire
+)
+
+type policyRule struct {
+	line     int
+	effect   policyEffect
+	actions  []string
+	resource string
+	when     condition
+}
+
+// condition is a node of the condition of a rule.
+type condition func(env *policyEnv) bool
+
+// policyEnv is what conditions are evaluated against.
+type policyEnv struct {
+	username string
+	groups   map[string]bool
+	attrs    map[string]string
+	ip       string
+	time     time.Time
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParsePolicy reads a policy. Errors wrap ErrInvalidPolicy and tell the line at fault.
+func ParsePolicy(text string) (*Policy, error) {
+	return LoadPolicy(strings.NewReader(text))
+}
+
+// LoadPolicy reads a policy from r.
+func LoadPolicy(r io.Reader) (*Policy, error) {
+	p := &Policy{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		rule, err := parseRule(tokenize(line))
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", ErrInvalidPolicy, n, err)
+		}
+		rule.line = n
+		p.rules = append(p.rules, rule)
+	}
+	return p, scanner.Err()
+}
+
+func tokenize(line string) []string {
+	line = strings.NewReplacer("(", " ( ", ")", " ) ", "!=", " != ", "=", " = ").Replace(line)
+	fields := strings.Fields(line)
+	// glue "a, b" lists back together
+	for i := 0; i < len(fields)-1; i++ {
+		if strings.HasSuffix(fields[i], ",") || strings.HasPrefix(fields[i+1], ",") {
+			fields[i] += fields[i+1]
+			fields = slices.Delete(fields, i+1, i+2)
+			i--
+		}
+	}
+	return fields
+}
+
+func parseRule(tokens []string) (policyRule, error) {
+	var rule policyRule
+	if len(tokens) < 2 {
+		return rule, fmt.Errorf("expected an effect and actions")
+	}
+	switch strings.ToLower(tokens[0]) {
+	case "allow":
+		rule.effect = policyAllow
+	case "deny":
+		rule.effect = policyDeny
+	case "require":
+		rule.effect = policyRequire
+	default:
+		return rule, fmt.Errorf("unknown effect %q", tokens[0])
+	}
+	rule.actions = strings.Split(tokens[1], ",")
+	tokens = tokens[2:]
+
+	if len(tokens) > 0 && strings.EqualFold(tokens[0], "on") {
+		if len(tokens) < 2 {
+			return rule, fmt.Errorf("expected a resource")
+		}
+		rule.resource = cleanResource(tokens[1])
+		if _, err := path.Match(rule.resource, "/"); err != nil {
+			return rule, fmt.Errorf("invalid resource %q", tokens[1])
+		}
+		tokens = tokens[2:]
+	}
+
+	rule.when = func(*policyEnv) bool { return true }
+	if len(tokens) > 0 && strings.EqualFold(tokens[0], "when") {
+		p := &condParser{tokens: tokens[1:]}
+		when, err := p.or()
+		if err != nil {
+			return rule, err
+		}
+		rule.when = when
+		tokens = p.tokens
+	}
+	if len(tokens) > 0 {
+		return rule, fmt.Errorf("unexpected %q", tokens[0])
+	}
+	return rule, nil
+}
+
+// condParser is a recursive descent parser of conditions.
+type condParser struct {
+	tokens []string
+}
+
+func (p *condParser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	return strings.ToLower(p.tokens[0])
+}
+
+func (p *condParser) next() (string, error) {
+	if len(p.tokens) == 0 {
+		return "", fmt.Errorf("unexpected end of condition")
+	}
+	t := p.tokens[0]
+	p.tokens = p.tokens[1:]
+	return t, nil
+}
+
+func (p *condParser) expect(want string) error {
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(t, want) {
+		return fmt.Errorf("expected %q, got %q", want, t)
+	}
+	return nil
+}
+
+func (p *condParser) or() (condition, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.tokens = p.tokens[1:]
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(env *policyEnv) bool { return l(env) || right(env) }
+	}
+	return left, nil
+}
+
+func (p *condParser) and() (condition, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.tokens = p.tokens[1:]
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(env *policyEnv) bool { return l(env) && right(env) }
+	}
+	return left, nil
+}
+
+func (p *condParser) unary() (condition, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(t) {
+	case "not":
+		c, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *policyEnv) bool { return !c(env) }, nil
+	case "(":
+		c, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return c, p.expect(")")
+	case "user":
+		name, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *policyEnv) bool { return env.username == name }, nil
+	case "group":
+		name, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		return func(env *policyEnv) bool { return env.groups[name] }, nil
+	case "attr":
+		return p.attr()
+	case "ip":
+		return p.ip()
+	case "time":
+		return p.timeWindow()
+	case "weekday":
+		return p.weekday()
+	}
+	return nil, fmt.Errorf("unknown condition %q", t)
+}
+
+func (p *condParser) attr() (condition, error) {
+	key, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "=":
+		return func(env *policyEnv) bool { v, ok := env.attrs[key]; return ok && v == value }, nil
+	case "!=":
+		return func(env *policyEnv) bool { return env.attrs[key] != value }, nil
+	}
+	return nil, fmt.Errorf("expected = or !=, got %q", op)
+}
+
+func (p *condParser) ip() (condition, error) {
+	if err := p.expect("in"); err != nil {
+		return nil, err
+	}
+	list, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	ranges := strings.Split(list, ",")
+	for _, r := range ranges {
+		if !validIPRange(r) {
+			return nil, fmt.Errorf("invalid IP range %q", r)
+		}
+	}
+	return func(env *policyEnv) bool {
+		ip := net.ParseIP(env.ip)
+		if ip == nil {
+			return false
+		}
+		for _, r := range ranges {
+			// network.IPInRange only compares the last octet of ranges, whatever the network
+			if start, end, ok := parseIPRange(r); ok {
+				if bytes.Compare(ip.To16(), start) >= 0 && bytes.Compare(ip.To16(), end) <= 0 {
+					return true
+				}
+			} else if network.IPInRange(ip.String(), []string{r}) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func validIPRange(r string) bool {
+	switch {
+	case r == "*":
+		return true
+	case strings.Contains(r, "/"):
+		_, _, err := net.ParseCIDR(r)
+		return err == nil
+	case strings.Contains(r, "-"):
+		_, _, ok := parseIPRange(r)
+		return ok
+	}
+	return net.ParseIP(r) != nil
+}
+
+// parseIPRange parses a range of addresses, start-end, where end is either an address or the last
+// octet of an IPv4 one in the network of start. The bounds are returned in their 16-byte form.
+func parseIPRange(r string) (start, end net.IP, ok bool) {
+	from, to, ok := strings.Cut(r, "-")
+	if !ok {
+		return nil, nil, false
+	}
+	start = net.ParseIP(from)
+	if start == nil {
+		return nil, nil, false
+	}
+	end = net.ParseIP(to)
+	if end == nil {
+		last, err := strconv.ParseUint(to, 10, 8)
+		start4 := start.To4()
+		if err != nil || start4 == nil {
+			return nil, nil, false
+		}
+		end = net.IPv4(start4[0], start4[1], start4[2], byte(last))
+	}
+	if (start.To4() == nil) != (end.To4() == nil) {
+		return nil, nil, false
+	}
+	start, end = start.To16(), end.To16()
+	return start, end, bytes.Compare(start, end) <= 0
+}
+
+func (p *condParser) timeWindow() (condition, error) {
+	if err := p.expect("in"); err != nil {
+		return nil, err
+	}
+	window, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	from, to, ok := strings.Cut(window, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid time window %q", window)
+	}
+	start, err := time.Parse("15:04", from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time window %q", window)
+	}
+	end, err := time.Parse("15:04", to)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time window %q", window)
+	}
+
+	return func(env *policyEnv) bool {
+		t := env.time
+		day := func(clock time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), clock.Hour(), clock.Minute(), 0, 0, t.Location())
+		}
+		if !end.Before(start) {
+			return validation.TimeInRange(t, day(start), day(end))
+		}
+		// the window spans midnight
+		return validation.TimeInRange(t, day(start), time.Time{}) || validation.TimeInRange(t, time.Time{}, day(end))
+	}, nil
+}
+
+func (p *condParser) weekday() (condition, error) {
+	if err := p.expect("in"); err != nil {
+		return nil, err
+	}
+	list, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	var days [7]bool
+	for _, item := range strings.Split(strings.ToLower(list), ",") {
+		from, to, isRange := strings.Cut(item, "-")
+		if !isRange {
+			to = from
+		}
+		start, ok := weekdays[from]
+		if !ok {
+			return nil, fmt.Errorf("invalid weekday %q", from)
+		}
+		end, ok := weekdays[to]
+		if !ok {
+			return nil, fmt.Errorf("invalid weekday %q", to)
+		}
+		for d := start; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == end {
+				break
+			}
+		}
+	}
+	return func(env *policyEnv) bool { return days[env.time.Weekday()] }, nil
+}
+
+// matches tells whether the rule applies to an action on a resource.
+func (r *policyRule) matches(resourcePath, action string) bool {
+	if !slices.Contains(r.actions, "*") && !slices.Contains(r.actions, action) {
+		return false
+	}
+	switch {
+	case r.resource == "":
+		return true
+	case strings.ContainsAny(r.resource, "*?["):
+		ok, _ := path.Match(r.resource, resourcePath)
+		return ok
+	}
+	return r.resource == "/" || resourcePath == r.resource || strings.HasPrefix(resourcePath, r.resource+"/")
+}
+
+// ---------------- REQUESTS ---------------
+
+type contextKey int
+
+const (
+	clientIPKey contextKey = iota
+	requestTimeKey
+	attributesKey
+)
+
+// WithClientIP returns a context telling Authorize the IP address of the client.
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey, ip)
+}
+
+// WithRequestTime returns a context telling Authorize the time of the request, instead of the current time.
+func WithRequestTime(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, requestTimeKey, t)
+}
+
+// WithAttributes returns a context adding attributes of the subject for Authorize, like the claims of a token.
+func WithAttributes(ctx context.Context, attrs map[string]string) context.Context {
+	return context.WithValue(ctx, attributesKey, attrs)
+}
+
+// SetPolicy sets the policy applied by Authorize. A nil policy leaves the decisions to the ACLs and roles.
+func (a *Auth) SetPolicy(policy *Policy) {
+	a.lock.Lock()
+	a.authz = policy
+	a.lock.Unlock()
+}
+
+func (a *Auth) Policy() *Policy {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.authz
+}
+
+// Authorize decides whether a user, a group or an API key may perform an action on a resource. The action
+// is a permission name of DefaultPermissions, checked with Check, then the policy is applied. It returns
+// nil if the request is allowed, or an error wrapping ErrAccessDenied.
+// Denials are recorded in the audit log.
+func (a *Auth) Authorize(ctx context.Context, subject, resourcePath, action string) error {
+	err := a.authorize(ctx, subject, resourcePath, action)
+	if !errors.Is(err, ErrAccessDenied) {
+		return err
+	}
+
+	e := AuditEvent{Action: AuditPermissionDenied, Subject: subject, Resource: cleanResource(resourcePath), Detail: err.Error()}
+	e.Permission, _ = DefaultPermissions.Lookup(action)
+	if ip, ok := ctx.Value(clientIPKey).(string); ok {
+		e.IP = ip
+	}
+	if auditErr := a.audit(e); auditErr != nil {
+		return auditErr
+	}
+	return err
+}
+
+func (a *Auth) authorize(ctx context.Context, subject, resourcePath, action string) error {
+	if u, ok := a.subjectUser(subject); ok {
+		if err := a.active(u); err != nil {
+			return fmt.Errorf("%w: %w", ErrAccessDenied, err)
+		}
+	}
+	env, err := a.policyEnv(ctx, subject)
+	if err != nil {
+		return err
+	}
+	resourcePath = cleanResource(resourcePath)
+
+	perm, known := DefaultPermissions.Lookup(action)
+	policy := a.Policy()
+	allowed := false
+	if policy != nil {
+		for i := range policy.rules {
+			rule := &policy.rules[i]
+			if !rule.matches(resourcePath, action) {
+				continue
+			}
+			holds := rule.when(env)
+			switch {
+			case rule.effect == policyDeny && holds:
+				return fmt.Errorf("%w: denied by policy line %d", ErrAccessDenied, rule.line)
+			case rule.effect == policyRequire && !holds:
+				return fmt.Errorf("%w: policy line %d not satisfied", ErrAccessDenied, rule.line)
+			case rule.effect == policyAllow && holds:
+				allowed = true
+			}
+		}
+	}
+	if allowed {
+		// an allow rule stands for the ACLs, but an API key is still limited to its scope
+		k, ok := a.apiKeySubject(subject)
+		if !ok {
+			return nil
+		}
+		if known && perm&^k.scopes == 0 {
+			return nil
+		}
+		return fmt.Errorf("%w: %s is out of the scope of the API key", ErrAccessDenied, action)
+	}
+
+	if !known {
+		return fmt.Errorf("%w: %w: %q", ErrAccessDenied, ErrUnknownPermission, action)
+	}
+	if !a.Check(subject, resourcePath, perm) {
+		return fmt.Errorf("%w: no %s permission on %s", ErrAccessDenied, action, resourcePath)
+	}
+	return nil
+}
+
+// subjectUser returns the user a subject is, or the owner of the API key it is.
+func (a *Auth) subjectUser(subject string) (*User, bool) {
+	if u, ok := a.GetUser(subject); ok {
+		return u, true
+	}
+	if _, ok := a.GetGroup(subject); ok {
+		return nil, false
+	}
+	if k, ok := a.GetAPIKey(subject); ok {
+		return a.GetUser(k.owner.String())
+	}
+	return nil, false
+}
+
+// apiKeySubject returns the API key a subject names, if it isn't a user or a group, as subjectIDs resolves it.
+func (a *Auth) apiKeySubject(subject string) (*APIKey, bool) {
+	if _, ok := a.GetUser(subject); ok {
+		return nil, false
+	}
+	if _, ok := a.GetGroup(subject); ok {
+		return nil, false
+	}
+	return a.GetAPIKey(subject)
+}
+
+func (a *Auth) policyEnv(ctx context.Context, subject string) (*policyEnv, error) {
+	env := &policyEnv{groups: make(map[string]bool), attrs: make(map[string]string), time: time.Now()}
+	if ip, ok := ctx.Value(clientIPKey).(string); ok {
+		env.ip = ip
+	}
+	if t, ok := ctx.Value(requestTimeKey).(time.Time); ok {
+		env.time = t
+	}
+
+	ids, ok := a.subjectIDs(subject)
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	for _, u := range a.users {
+		if ids[u.id] {
+			env.username = u.username
+			maps.Copy(env.attrs, u.attrs())
+		}
+	}
+	// the attributes of the request take precedence over the stored ones
+	if attrs, ok := ctx.Value(attributesKey).(map[string]string); ok {
+		maps.Copy(env.attrs, attrs)
+	}
+	for _, g := range a.groups {
+		if ids[g.id] {
+			env.groups[g.name] = true
+		}
+	}
+	return env, nil
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvColumns are the columns written by WriteCSV, before those of the attributes.
+var csvColumns = []string{"username", "password", "display_name", "email", "disabled", "expires", "groups"}
+
+// csvFields are the fields of the columns.
+var csvFields = map[string]DirectoryField{
+	"password":     FieldPassword,
+	"display_name": FieldDisplayName,
+	"email":        FieldEmail,
+	"disabled":     FieldDisabled,
+	"expires":      FieldExpires,
+	"groups":       FieldGroups,
+}
+
+// csvAttribute is the prefix of the columns holding custom attributes.
+const csvAttribute = "attr:"
+
+// WriteCSV writes the users of d as CSV with a header row. The columns are the username, the password
+// hash, the display name, the email, whether the account is disabled, its expiry date in RFC 3339
+// format and the groups, separated by semicolons; then each attribute has an attr:<key> column.
+// Group nesting isn't part of the format.
+func (d *Directory) WriteCSV(w io.Writer) error {
+	keys := make(map[string]bool)
+	for _, u := range d.Users {
+		for key := range u.Attributes {
+			keys[key] = true
+		}
+	}
+	attrs := slices.Sorted(maps.Keys(keys))
+
+	cw := csv.NewWriter(w)
+	header := slices.Clone(csvColumns)
+	for _, key := range attrs {
+		header = append(header, csvAttribute+key)
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, u := range d.Users {
+		for _, g := range u.Groups {
+			if strings.Contains(g, ";") {
+				return fmt.Errorf("%w: group %q: semicolons can't be written to CSV", ErrInvalidDirectory, g)
+			}
+		}
+		var expires string
+		if !u.Expires.IsZero() {
+			expires = u.Expires.Format(time.RFC3339)
+		}
+		row := []string{u.Username, u.PasswordHash, u.DisplayName, u.Email, strconv.FormatBool(u.Disabled), expires,
+			strings.Join(u.Groups, ";")}
+		for _, key := range attrs {
+			row = append(row, u.Attributes[key])
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ReadCSV reads users from CSV written by WriteCSV. The columns can be in any order and only the
+// username one is required; the fields of the missing ones are Missing, so importing leaves them
+// unchanged. Empty attribute values are left out, and the users have nil attributes if there is no
+// attr:<key> column.
+func ReadCSV(r io.Reader) (*Directory, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return &Directory{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int)
+	hasAttrs := false
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if !slices.Contains(csvColumns, name) && !strings.HasPrefix(name, csvAttribute) {
+			return nil, fmt.Errorf("%w: unknown column %q", ErrInvalidDirectory, name)
+		}
+		if _, ok := columns[name]; ok {
+			return nil, fmt.Errorf("%w: duplicate column %q", ErrInvalidDirectory, name)
+		}
+		columns[name] = i
+		hasAttrs = hasAttrs || strings.HasPrefix(name, csvAttribute)
+	}
+	if _, ok := columns["username"]; !ok {
+		return nil, fmt.Errorf("%w: no username column", ErrInvalidDirectory)
+	}
+	var missing DirectoryField
+	for column, f := range csvFields {
+		if _, ok := columns[column]; !ok {
+			missing |= f
+		}
+	}
+	if !hasAttrs {
+		missing |= FieldAttributes
+	}
+
+	d := &Directory{}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return row[i]
+			}
+			return ""
+		}
+
+		u := DirectoryUser{
+			Username:     field("username"),
+			PasswordHash: field("password"),
+			DisplayName:  field("display_name"),
+			Email:        field("email"),
+			Missing:      missing,
+		}
+		if s := field("disabled"); s != "" {
+			if u.Disabled, err = strconv.ParseBool(s); err != nil {
+				return nil, fmt.Errorf("%w: %s: disabled: %v", ErrInvalidDirectory, u.Username, err)
+			}
+		}
+		if s := field("expires"); s != "" {
+			if u.Expires, err = time.Parse(time.RFC3339, s); err != nil {
+				return nil, fmt.Errorf("%w: %s: expires: %v", ErrInvalidDirectory, u.Username, err)
+			}
+		}
+		for _, g := range strings.Split(field("groups"), ";") {
+			if g = strings.TrimSpace(g); g != "" {
+				u.Groups = append(u.Groups, g)
+			}
+		}
+		if hasAttrs {
+			u.Attributes = make(map[string]string)
+			for name, i := range columns {
+				if key, ok := strings.CutPrefix(name, csvAttribute); ok && row[i] != "" {
+					u.Attributes[key] = row[i]
+				}
+			}
+		}
+		d.Users = append(d.Users, u)
+	}
+	return d, nil
+}
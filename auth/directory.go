@@ -0,0 +1,470 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Directory holds the users and groups of an Auth in a portable form. It is read and written in the
+// LDIF, CSV and passwd formats, to move users between deployments with ExportDirectory and ImportDirectory.
+type Directory struct {
+	Users  []DirectoryUser
+	Groups []DirectoryGroup
+}
+
+// DirectoryUser is a user of a Directory.
+type DirectoryUser struct {
+	Username string
+	// PasswordHash is an argon2id hash in the PHC string format or a bcrypt hash, empty if unknown.
+	PasswordHash string
+	DisplayName  string
+	Email        string
+	Disabled     bool
+	Expires      time.Time
+	// Groups are the names of the groups the user is a direct member of.
+	Groups []string
+	// Attributes are the custom attributes of the user, nil if the format doesn't carry them.
+	Attributes map[string]string
+	// Missing are the fields the source doesn't carry, which ImportDirectory leaves unchanged.
+	Missing DirectoryField
+}
+
+// DirectoryField is a set of fields of a DirectoryUser.
+type DirectoryField uint8
+
+const (
+	FieldPassword DirectoryField = 1 << iota
+	FieldDisplayName
+	FieldEmail
+	FieldDisabled
+	FieldExpires
+	FieldGroups
+	FieldAttributes
+)
+
+// has reports whether the user carries a field.
+func (u *DirectoryUser) has(f DirectoryField) bool {
+	switch f {
+	case FieldPassword:
+		if u.PasswordHash == "" {
+			return false
+		}
+	case FieldAttributes:
+		if u.Attributes == nil {
+			return false
+		}
+	}
+	return u.Missing&f == 0
+}
+
+// DirectoryGroup is a group of a Directory.
+type DirectoryGroup struct {
+	Name string
+	// Parents are the names of the groups the group is a direct member of.
+	Parents []string
+}
+
+// DirectoryChangeKind is the kind of a DirectoryChange.
+type DirectoryChangeKind uint8
+
+const (
+	DirectoryAddUser DirectoryChangeKind = iota + 1
+	DirectoryUpdateUser
+	DirectoryAddGroup
+	// DirectoryJoinGroup is a user or a group becoming a member of a group.
+	DirectoryJoinGroup
+	// DirectoryLeaveGroup is a user or a group leaving a group.
+	DirectoryLeaveGroup
+)
+
+// DirectoryChange is a change made by ImportDirectory.
+type DirectoryChange struct {
+	Kind DirectoryChangeKind
+	// User is the user added, updated, joining or leaving Group.
+	User string
+	// Group is the group added, or the one joined or left.
+	Group string
+	// Child is the group joining or leaving Group.
+	Child string
+	// Fields are the fields of the user that change: password, display_name, email, disabled, expires
+	// or attributes.
+	Fields []string
+}
+
+// String returns the change in a diff-like form, such as "+ user alice" or "- alice in staff".
+func (c DirectoryChange) String() string {
+	switch c.Kind {
+	case DirectoryAddUser:
+		return "+ user " + c.User
+	case DirectoryUpdateUser:
+		return fmt.Sprintf("~ user %s: %s", c.User, strings.Join(c.Fields, ", "))
+	case DirectoryAddGroup:
+		return "+ group " + c.Group
+	case DirectoryJoinGroup, DirectoryLeaveGroup:
+		sign, member := "+", c.User
+		if c.Kind == DirectoryLeaveGroup {
+			sign = "-"
+		}
+		if c.Child != "" {
+			member = "group " + c.Child
+		}
+		return fmt.Sprintf("%s %s in %s", sign, member, c.Group)
+	}
+	return fmt.Sprintf("DirectoryChange(%d)", uint8(c.Kind))
+}
+
+// ExportDirectory returns the users and groups of a, sorted by name.
+func (a *Auth) ExportDirectory() *Directory {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	d := &Directory{}
+	for _, u := range a.users {
+		attrs := maps.Clone(u.attrs())
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+		d.Users = append(d.Users, DirectoryUser{
+			Username:     u.username,
+			PasswordHash: u.password.String(),
+			DisplayName:  u.displayName,
+			Email:        u.email,
+			Disabled:     u.disabled,
+			Expires:      u.expires,
+			Groups:       slices.Clone(u.groupNames),
+			Attributes:   attrs,
+		})
+	}
+	for _, g := range a.groups {
+		d.Groups = append(d.Groups, DirectoryGroup{Name: g.name, Parents: slices.Clone(g.parentNames)})
+	}
+
+	slices.SortFunc(d.Users, func(x, y DirectoryUser) int { return strings.Compare(x.Username, y.Username) })
+	slices.SortFunc(d.Groups, func(x, y DirectoryGroup) int { return strings.Compare(x.Name, y.Name) })
+	return d
+}
+
+// ImportDirectory adds the users and groups of d to a, and returns the changes made, or only the
+// ones it would make if dryRun is set. Users and groups that are only in a are left alone. The users
+// in d get its profile fields, direct groups and attributes, except the Missing ones; nil attributes
+// and empty password hashes are missing too. New users without a hash get a random password, so they
+// need a reset before logging in. Likewise, the groups in d get its parents, and the groups only named by memberships
+// are created. Email addresses may move between the users in d. The changes are made one by one: on
+// error, those before it are kept.
+func (a *Auth) ImportDirectory(d *Directory, dryRun bool) ([]DirectoryChange, error) {
+	changes, err := a.diffDirectory(d)
+	if err != nil || dryRun {
+		return changes, err
+	}
+
+	users := make(map[string]*DirectoryUser, len(d.Users))
+	for i := range d.Users {
+		users[d.Users[i].Username] = &d.Users[i]
+	}
+	// the addresses moving between users are taken from their owners first, so that they can be swapped;
+	// diffDirectory made sure the owners get another one
+	for _, c := range changes {
+		du := users[c.User]
+		if du == nil || du.Email == "" || !du.has(FieldEmail) {
+			continue
+		}
+		if other, ok := a.GetUserByEmail(du.Email); ok && other.username != du.Username {
+			if err = a.SetEmail(other.username, ""); err != nil {
+				return changes, fmt.Errorf("%s: %w", c, err)
+			}
+		}
+	}
+	for _, c := range changes {
+		if err = a.applyDirectoryChange(c, users[c.User]); err != nil {
+			return changes, fmt.Errorf("%s: %w", c, err)
+		}
+	}
+	return changes, nil
+}
+
+// diffDirectory returns the changes needed to import d: the new groups, their nesting, then each user
+// followed by its memberships.
+func (a *Auth) diffDirectory(d *Directory) ([]DirectoryChange, error) {
+	var changes []DirectoryChange
+	seen := make(map[string]bool)
+	addGroup := func(name string) error {
+		if name == "" {
+			return fmt.Errorf("%w: empty group name", ErrInvalidDirectory)
+		}
+		if _, ok := a.GetGroup(name); !ok && !seen[name] {
+			changes = append(changes, DirectoryChange{Kind: DirectoryAddGroup, Group: name})
+		}
+		seen[name] = true
+		return nil
+	}
+
+	groups := make(map[string]bool, len(d.Groups))
+	for _, g := range d.Groups {
+		if groups[g.Name] {
+			return nil, fmt.Errorf("%w: duplicate group %q", ErrInvalidDirectory, g.Name)
+		}
+		groups[g.Name] = true
+		if err := addGroup(g.Name); err != nil {
+			return nil, err
+		}
+		for _, p := range g.Parents {
+			if err := addGroup(p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, u := range d.Users {
+		for _, g := range u.Groups {
+			if err := addGroup(g); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, g := range d.Groups {
+		var current []string
+		if existing, ok := a.GetGroup(g.Name); ok {
+			current = existing.ParentNames()
+		}
+		joined, left := diffNames(current, g.Parents)
+		for _, p := range joined {
+			changes = append(changes, DirectoryChange{Kind: DirectoryJoinGroup, Group: p, Child: g.Name})
+		}
+		for _, p := range left {
+			changes = append(changes, DirectoryChange{Kind: DirectoryLeaveGroup, Group: p, Child: g.Name})
+		}
+	}
+
+	users := make(map[string]bool, len(d.Users))
+	listed := make(map[string]bool, len(d.Users)) // the users whose email may change
+	for _, du := range d.Users {
+		listed[du.Username] = du.has(FieldEmail)
+	}
+	emails := make(map[string]string, len(d.Users))
+	for i := range d.Users {
+		du := &d.Users[i]
+		if du.Username == "" {
+			return nil, fmt.Errorf("%w: empty username", ErrInvalidDirectory)
+		}
+		if users[du.Username] {
+			return nil, fmt.Errorf("%w: duplicate user %q", ErrInvalidDirectory, du.Username)
+		}
+		users[du.Username] = true
+		if du.Email != "" && du.has(FieldEmail) {
+			if !validEmail(du.Email) {
+				return nil, fmt.Errorf("%w: %s: %q", ErrInvalidEmail, du.Username, du.Email)
+			}
+			key := strings.ToLower(du.Email)
+			if other, ok := emails[key]; ok {
+				return nil, fmt.Errorf("%w: %s and %s: %q", ErrEmailInUse, other, du.Username, du.Email)
+			}
+			if other, ok := a.GetUserByEmail(du.Email); ok && !listed[other.username] {
+				return nil, fmt.Errorf("%w: %s and %s: %q", ErrEmailInUse, other.username, du.Username, du.Email)
+			}
+			emails[key] = du.Username
+		}
+
+		var hash string
+		if du.has(FieldPassword) {
+			h, err := parsePasswordHash(du.PasswordHash)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s", err, du.Username)
+			}
+			hash = h.String()
+		}
+
+		u, ok := a.GetUser(du.Username)
+		if !ok {
+			changes = append(changes, DirectoryChange{Kind: DirectoryAddUser, User: du.Username})
+			if !du.has(FieldGroups) {
+				continue
+			}
+			for _, g := range compactNames(du.Groups) {
+				changes = append(changes, DirectoryChange{Kind: DirectoryJoinGroup, User: du.Username, Group: g})
+			}
+			continue
+		}
+
+		a.lock.RLock()
+		changed := map[DirectoryField]bool{
+			FieldPassword:    hash != u.password.String(),
+			FieldDisplayName: du.DisplayName != u.displayName,
+			FieldEmail:       du.Email != u.email,
+			FieldDisabled:    du.Disabled != u.disabled,
+			FieldExpires:     !du.Expires.Equal(u.expires),
+			FieldAttributes:  !maps.Equal(du.Attributes, u.attrs()),
+		}
+		current := slices.Clone(u.groupNames)
+		a.lock.RUnlock()
+
+		var fields []string
+		for _, f := range profileFields {
+			if du.has(f) && changed[f] {
+				fields = append(fields, fieldNames[f])
+			}
+		}
+		if len(fields) > 0 {
+			changes = append(changes, DirectoryChange{Kind: DirectoryUpdateUser, User: du.Username, Fields: fields})
+		}
+		if !du.has(FieldGroups) {
+			continue
+		}
+		joined, left := diffNames(current, du.Groups)
+		for _, g := range joined {
+			changes = append(changes, DirectoryChange{Kind: DirectoryJoinGroup, User: du.Username, Group: g})
+		}
+		for _, g := range left {
+			changes = append(changes, DirectoryChange{Kind: DirectoryLeaveGroup, User: du.Username, Group: g})
+		}
+	}
+	return changes, nil
+}
+
+func (a *Auth) applyDirectoryChange(c DirectoryChange, du *DirectoryUser) error {
+	switch c.Kind {
+	case DirectoryAddGroup:
+		return a.AddGroup(c.Group)
+	case DirectoryJoinGroup:
+		if c.Child != "" {
+			return a.AddGroupToGroup(c.Child, c.Group)
+		}
+		return a.AddUserToGroup(c.User, c.Group)
+	case DirectoryLeaveGroup:
+		if c.Child != "" {
+			return a.RemoveGroupFromGroup(c.Child, c.Group)
+		}
+		return a.RemoveUserFromGroup(c.User, c.Group)
+	case DirectoryAddUser:
+		var hash string
+		if du.has(FieldPassword) {
+			hash = du.PasswordHash
+		}
+		if hash == "" {
+			random := make([]byte, 32)
+			if _, err := rand.Read(random); err != nil {
+				return err
+			}
+			h, err := newPasswordHash(base64.RawURLEncoding.EncodeToString(random), a.HashParams())
+			if err != nil {
+				return err
+			}
+			hash = h.String()
+		}
+		if err := a.ImportUser(du.Username, hash); err != nil {
+			return err
+		}
+		var fields []string
+		for _, f := range profileFields[1:] { // the password is set already
+			if du.has(f) {
+				fields = append(fields, fieldNames[f])
+			}
+		}
+		return a.setProfile(du, fields)
+	case DirectoryUpdateUser:
+		return a.setProfile(du, c.Fields)
+	}
+	return nil
+}
+
+// setProfile sets the fields of a user to those of du.
+func (a *Auth) setProfile(du *DirectoryUser, fields []string) error {
+	u, ok := a.GetUser(du.Username)
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	for _, field := range fields {
+		var err error
+		switch field {
+		case "password":
+			var h passwordHash
+			if h, err = parsePasswordHash(du.PasswordHash); err == nil {
+				var keep int
+				if policy := a.PasswordPolicy(); policy != nil {
+					keep = policy.History
+				}
+				err = a.replacePassword(u, h, keep)
+			}
+		case "display_name":
+			if du.DisplayName != u.DisplayName() {
+				err = a.SetDisplayName(u.username, du.DisplayName)
+			}
+		case "email":
+			if du.Email != u.Email() {
+				err = a.SetEmail(u.username, du.Email)
+			}
+		case "disabled":
+			if du.Disabled != u.Disabled() {
+				err = a.SetDisabled(u.username, du.Disabled)
+			}
+		case "expires":
+			if !du.Expires.Equal(u.Expires()) {
+				err = a.SetExpiry(u.username, du.Expires)
+			}
+		case "attributes":
+			if du.Attributes == nil {
+				continue
+			}
+			for key := range u.Attributes() {
+				if _, ok := du.Attributes[key]; !ok {
+					if err = a.SetAttribute(u.username, key, ""); err != nil {
+						return err
+					}
+				}
+			}
+			for key, value := range du.Attributes {
+				if err = a.SetAttribute(u.username, key, value); err != nil {
+					return err
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// profileFields are the fields of a DirectoryUser a DirectoryUpdateUser change can list, in order.
+var profileFields = []DirectoryField{FieldPassword, FieldDisplayName, FieldEmail, FieldDisabled, FieldExpires, FieldAttributes}
+
+// fieldNames are the names of the fields in DirectoryChange.Fields.
+var fieldNames = map[DirectoryField]string{
+	FieldPassword:    "password",
+	FieldDisplayName: "display_name",
+	FieldEmail:       "email",
+	FieldDisabled:    "disabled",
+	FieldExpires:     "expires",
+	FieldAttributes:  "attributes",
+}
+
+// diffNames returns the names of want that aren't in current, and those of current that aren't in want.
+func diffNames(current, want []string) (added, removed []string) {
+	for _, name := range compactNames(want) {
+		if !slices.Contains(current, name) {
+			added = append(added, name)
+		}
+	}
+	for _, name := range current {
+		if !slices.Contains(want, name) {
+			removed = append(removed, name)
+		}
+	}
+	return added, removed
+}
+
+// compactNames returns names without duplicates, in their order.
+func compactNames(names []string) []string {
+	var out []string
+	for _, name := range names {
+		if !slices.Contains(out, name) {
+			out = append(out, name)
+		}
+	}
+	return out
+}
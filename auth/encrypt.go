@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/another-d-mention/unicomplex/crypt/gcm"
+	"golang.org/x/crypto/argon2"
+)
+
+// Encrypted snapshots are written as:
+//
+//	magic   [4]byte  "UCXE"
+//	time    uint32   argon2id iterations
+//	memory  uint32   argon2id memory, in KiB
+//	threads uint8    argon2id parallelism
+//	salt    [16]byte
+//	data    []byte   gcm stream of the snapshot container
+//
+// The key is derived from the passphrase with the parameters stored in the header, so they can be
+// raised later without breaking existing files. Nothing but the header is readable without the key.
+var encryptedMagic = [4]byte{'U', 'C', 'X', 'E'}
+
+const (
+	kdfTime    = 3
+	kdfMemory  = 64 * 1024
+	kdfThreads = 4
+	kdfKeyLen  = 32
+	kdfSaltLen = 16
+
+	// kdfMaxMemory, kdfMaxTime and kdfMaxThreads bound the memory, time and goroutines a header can make
+	// UnmarshalEncrypted use. 1 GiB leaves plenty of room above kdfMemory.
+	kdfMaxMemory  = 1024 * 1024
+	kdfMaxTime    = 64
+	kdfMaxThreads = 64
+)
+
+type kdfHeader struct {
+	Magic   [4]byte
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	Salt    [kdfSaltLen]byte
+}
+
+func (h *kdfHeader) password(passphrase []byte) (gcm.Password, error) {
+	key := argon2.IDKey(passphrase, h.Salt[:], h.Time, h.Memory, h.Threads, kdfKeyLen)
+	return gcm.NewPassword(key)
+}
+
+// MarshalEncrypted writes a snapshot like MarshalBinary, encrypted with a key derived from passphrase.
+func (a *Auth) MarshalEncrypted(w io.Writer, passphrase []byte) error {
+	h := kdfHeader{Magic: encryptedMagic, Time: kdfTime, Memory: kdfMemory, Threads: kdfThreads}
+	if _, err := rand.Read(h.Salt[:]); err != nil {
+		return err
+	}
+	password, err := h.password(passphrase)
+	if err != nil {
+		return err
+	}
+
+	if err = binary.Write(w, binary.BigEndian, &h); err != nil {
+		return err
+	}
+	sw, err := gcm.NewStreamWriter(password, w, 0)
+	if err != nil {
+		return err
+	}
+	if err = a.MarshalBinary(sw); err != nil {
+		return err
+	}
+	return sw.Flush()
+}
+
+// UnmarshalEncrypted replaces the state with a snapshot written by MarshalEncrypted. A wrong passphrase
+// or tampered data results in ErrDecryption.
+func (a *Auth) UnmarshalEncrypted(r io.Reader, passphrase []byte) error {
+	var h kdfHeader
+	if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+		return err
+	}
+	if h.Magic != encryptedMagic {
+		return ErrInvalidFormat
+	}
+	if h.Time == 0 || h.Time > kdfMaxTime || h.Threads == 0 || h.Threads > kdfMaxThreads || h.Memory > kdfMaxMemory {
+		return ErrInvalidFormat
+	}
+	password, err := h.password(passphrase)
+	if err != nil {
+		return err
+	}
+
+	sr, err := gcm.NewStreamReader(password, r)
+	if err != nil {
+		return err
+	}
+	// decrypt everything before touching the state, so a bad file leaves it unchanged
+	data, err := io.ReadAll(sr)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDecryption, err)
+	}
+	if !bytes.HasPrefix(data, magic[:]) {
+		return ErrInvalidFormat
+	}
+	return a.UnmarshalBinary(bytes.NewReader(data))
+}
@@ -5,8 +5,52 @@ import (
 )
 
 var (
-	ErrUserNotFound       = errors.New("user not found")
-	ErrGroupNotFound      = errors.New("group not found")
-	ErrGroupAlreadyExists = errors.New("group already exists")
-	ErrUserAlreadyExists  = errors.New("user already exists")
+	ErrUserNotFound           = errors.New("user not found")
+	ErrGroupNotFound          = errors.New("group not found")
+	ErrGroupAlreadyExists     = errors.New("group already exists")
+	ErrUserAlreadyExists      = errors.New("user already exists")
+	ErrInvalidPassword        = errors.New("invalid password")
+	ErrPasswordTooShort       = errors.New("password too short")
+	ErrPasswordTooWeak        = errors.New("password lacks required character classes")
+	ErrPasswordDenied         = errors.New("password is too common")
+	ErrPasswordReused         = errors.New("password was used recently")
+	ErrInvalidToken           = errors.New("invalid token")
+	ErrTokenExpired           = errors.New("token expired")
+	ErrInvalidKey             = errors.New("invalid key")
+	ErrInvalidHash            = errors.New("invalid password hash")
+	ErrInvalidHashParams      = errors.New("invalid hash parameters")
+	ErrInvalidCredentials     = errors.New("invalid username or password")
+	ErrThrottled              = errors.New("too many failed attempts")
+	ErrAccountLocked          = errors.New("account locked")
+	ErrAccountDisabled        = errors.New("account disabled")
+	ErrAccountExpired         = errors.New("account expired")
+	ErrInvalidEmail           = errors.New("invalid email address")
+	ErrEmailInUse             = errors.New("email address already in use")
+	ErrInvalidDirectory       = errors.New("invalid directory")
+	ErrPasswordChangeRequired = errors.New("password change required")
+	ErrSessionExpired         = errors.New("session expired")
+	ErrTOTPNotEnrolled        = errors.New("TOTP not enrolled")
+	ErrSecretKeyNotSet        = errors.New("secret key not set")
+	ErrSecondFactorRequired   = errors.New("second factor required")
+	ErrInvalidAPIKey          = errors.New("invalid API key")
+	ErrAPIKeyExpired          = errors.New("API key expired")
+	ErrAPIKeyNotFound         = errors.New("API key not found")
+	ErrGroupCycle             = errors.New("group would contain itself")
+	ErrUnknownPermission      = errors.New("unknown permission")
+	ErrPermissionExists       = errors.New("permission already registered")
+	ErrInvalidPermissionName  = errors.New("invalid permission name")
+	ErrInvalidResource        = errors.New("invalid resource")
+	ErrResourceNotFound       = errors.New("resource not found")
+	ErrRoleNotFound           = errors.New("role not found")
+	ErrRoleAlreadyExists      = errors.New("role already exists")
+	ErrRoleCycle              = errors.New("role would inherit from itself")
+	ErrInvalidPolicy          = errors.New("invalid policy")
+	ErrAccessDenied           = errors.New("access denied")
+	ErrAuditTampered          = errors.New("audit log tampered with")
+	ErrNoStore                = errors.New("no store configured")
+	ErrInvalidRecord          = errors.New("invalid journal record")
+	ErrInvalidFormat          = errors.New("invalid snapshot format")
+	ErrUnsupportedVersion     = errors.New("unsupported snapshot version")
+	ErrChecksum               = errors.New("snapshot checksum mismatch")
+	ErrDecryption             = errors.New("decryption failed")
 )
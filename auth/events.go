@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// ChangeKind is the kind of a ChangeEvent.
+type ChangeKind uint8
+
+const (
+	UserAdded ChangeKind = iota + 1
+	UserDeleted
+	GroupAdded
+	GroupDeleted
+	// MembershipChanged is sent when a user joins or leaves a group.
+	MembershipChanged
+	// GroupNestingChanged is sent when a group is nested in another one, or taken out of it.
+	GroupNestingChanged
+	// ACLChanged is sent when an entry of an ACL changes, or its resolution.
+	ACLChanged
+	// ResourceChanged is sent when a resource gets or loses an ACL, or changes its inheritance.
+	ResourceChanged
+	RoleChanged
+	RoleDeleted
+	// RoleAssignmentChanged is sent when a role is assigned or unassigned.
+	RoleAssignmentChanged
+	// StateReplaced is sent when the whole state is replaced by UnmarshalBinary, and in place of the events
+	// a subscriber missed because its channel was full; everything may have changed.
+	StateReplaced
+	// UserChanged is sent when a user is disabled or enabled, its expiry changes or one of its attributes.
+	UserChanged
+	APIKeyAdded
+	APIKeyRevoked
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case UserAdded:
+		return "user added"
+	case UserDeleted:
+		return "user deleted"
+	case GroupAdded:
+		return "group added"
+	case GroupDeleted:
+		return "group deleted"
+	case MembershipChanged:
+		return "membership changed"
+	case GroupNestingChanged:
+		return "group nesting changed"
+	case ACLChanged:
+		return "ACL changed"
+	case ResourceChanged:
+		return "resource changed"
+	case RoleChanged:
+		return "role changed"
+	case RoleDeleted:
+		return "role deleted"
+	case RoleAssignmentChanged:
+		return "role assignment changed"
+	case StateReplaced:
+		return "state replaced"
+	case UserChanged:
+		return "user changed"
+	case APIKeyAdded:
+		return "API key added"
+	case APIKeyRevoked:
+		return "API key revoked"
+	}
+	return fmt.Sprintf("ChangeKind(%d)", uint8(k))
+}
+
+// ChangeEvent describes a change that may affect permissions. The fields that don't apply to its kind are zero.
+type ChangeEvent struct {
+	Kind ChangeKind
+	// User is the user concerned; the owner for APIKeyAdded and APIKeyRevoked.
+	User uuid.UUID
+	// Group is the group concerned; the child group for GroupNestingChanged.
+	Group uuid.UUID
+	// Parent is the parent group for GroupNestingChanged.
+	Parent uuid.UUID
+	// ACL is the ACL that changed. Its entry for User or Group changed, or its resolution if both are zero.
+	ACL uuid.UUID
+	// Resource is the path of the resource concerned, if any.
+	Resource string
+	Role     uuid.UUID
+	APIKey   uuid.UUID
+}
+
+// Subscribe returns a channel receiving the changes made to a. When the channel is full, further events
+// are dropped and replaced by a single StateReplaced event, upon which subscribers must flush their caches
+// entirely.
+func (a *Auth) Subscribe() <-chan ChangeEvent {
+	return a.changes.Subscribe()
+}
+
+// Unsubscribe stops sending changes to a channel returned by Subscribe, and closes it.
+func (a *Auth) Unsubscribe(ch <-chan ChangeEvent) {
+	a.changes.Unsubscribe(ch)
+}
+
+func (a *Auth) publish(e ChangeEvent) {
+	a.changes.Publish(e)
+}
+
+// publishACL publishes a change to the entry of a user or a group in acl.
+func (a *Auth) publishACL(acl *ACL, user, group uuid.UUID) {
+	e := ChangeEvent{Kind: ACLChanged, ACL: acl.ID(), User: user, Group: group}
+	if acl == a.acl {
+		e.Resource = "/"
+	} else if p, _, ok := a.resourceOf(acl); ok {
+		e.Resource = p
+	}
+	a.publish(e)
+}
+
+func (ra RoleAssignment) changeEvent() ChangeEvent {
+	e := ChangeEvent{Kind: RoleAssignmentChanged, Role: ra.Role, Resource: ra.Resource}
+	if ra.Group {
+		e.Group = ra.Subject
+	} else {
+		e.User = ra.Subject
+	}
+	return e
+}
@@ -0,0 +1,353 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"maps"
+	"math"
+	"time"
+
+	"github.com/another-d-mention/unicomplex/crypt/hashing"
+	"github.com/another-d-mention/unicomplex/encoding/msgpack"
+	"github.com/google/uuid"
+)
+
+// Snapshots are written in a container made of:
+//
+//	magic   [4]byte  "UCXA"
+//	version uint16
+//	length  uint64   length of the payload
+//	payload []byte   MessagePack encoded records
+//	crc     [4]byte  CRC32 (IEEE) of the payload
+//
+// Records are MessagePack maps, so fields can be added without breaking older readers.
+// Data starting with anything but the magic is read as the original, unversioned format.
+var magic = [4]byte{'U', 'C', 'X', 'A'}
+
+// formatVersion 2 stores password hashes as encoded strings carrying their parameters.
+const formatVersion uint16 = 2
+
+// maxPayload bounds the payload size accepted when reading a container.
+const maxPayload = math.MaxInt32
+
+type snapshotRecord struct {
+	Users       []userRecord       `msgpack:"users"`
+	Groups      []groupRecord      `msgpack:"groups"`
+	ACL         aclRecord          `msgpack:"acl"`
+	APIKeys     []apiKeyRecord     `msgpack:"api_keys,omitempty"`
+	Resources   []resourceRecord   `msgpack:"resources,omitempty"`
+	Roles       []roleRecord       `msgpack:"roles,omitempty"`
+	Assignments []assignmentRecord `msgpack:"assignments,omitempty"`
+}
+
+type userRecord struct {
+	ID              uuid.UUID         `msgpack:"id"`
+	Username        string            `msgpack:"username"`
+	Password        string            `msgpack:"password,omitempty"`
+	PasswordHash    []byte            `msgpack:"password_hash,omitempty"` // version 1
+	PasswordSalt    []byte            `msgpack:"password_salt,omitempty"` // version 1
+	LastLogin       time.Time         `msgpack:"last_login"`
+	PasswordChanged time.Time         `msgpack:"password_changed"`
+	Groups          []uuid.UUID       `msgpack:"groups,omitempty"`
+	PasswordHistory []string          `msgpack:"password_history,omitempty"`
+	History         []passwordRecord  `msgpack:"history,omitempty"` // version 1
+	ResetNonce      []byte            `msgpack:"reset_nonce,omitempty"`
+	MustChange      bool              `msgpack:"must_change,omitempty"`
+	FailedAttempts  int               `msgpack:"failed_attempts,omitempty"`
+	LastFailure     time.Time         `msgpack:"last_failure,omitempty"`
+	LockedUntil     time.Time         `msgpack:"locked_until,omitempty"`
+	TOTPSecret      []byte            `msgpack:"totp_secret,omitempty"`
+	TOTPEnabled     bool              `msgpack:"totp_enabled,omitempty"`
+	TOTPLastStep    uint64            `msgpack:"totp_last_step,omitempty"`
+	RecoveryCodes   [][]byte          `msgpack:"recovery_codes,omitempty"`
+	DisplayName     string            `msgpack:"display_name,omitempty"`
+	Email           string            `msgpack:"email,omitempty"`
+	Disabled        bool              `msgpack:"disabled,omitempty"`
+	Expires         time.Time         `msgpack:"expires,omitempty"`
+	Attributes      map[string]string `msgpack:"attributes,omitempty"`
+}
+
+type passwordRecord struct {
+	Hash []byte `msgpack:"hash"`
+	Salt []byte `msgpack:"salt"`
+}
+
+type apiKeyRecord struct {
+	ID       uuid.UUID  `msgpack:"id"`
+	Prefix   string     `msgpack:"prefix"`
+	Name     string     `msgpack:"name"`
+	Owner    uuid.UUID  `msgpack:"owner"`
+	Scopes   Permission `msgpack:"scopes"`
+	Hash     []byte     `msgpack:"hash"`
+	Created  time.Time  `msgpack:"created"`
+	Expires  time.Time  `msgpack:"expires"`
+	LastUsed time.Time  `msgpack:"last_used"`
+}
+
+type groupRecord struct {
+	ID      uuid.UUID   `msgpack:"id"`
+	Name    string      `msgpack:"name"`
+	Parents []uuid.UUID `msgpack:"parents,omitempty"`
+}
+
+type aclRecord struct {
+	ID          uuid.UUID                `msgpack:"id"`
+	Resolution  Resolution               `msgpack:"resolution,omitempty"`
+	Users       map[uuid.UUID]Permission `msgpack:"users,omitempty"`
+	Groups      map[uuid.UUID]Permission `msgpack:"groups,omitempty"`
+	UserDenies  map[uuid.UUID]Permission `msgpack:"user_denies,omitempty"`
+	GroupDenies map[uuid.UUID]Permission `msgpack:"group_denies,omitempty"`
+}
+
+type resourceRecord struct {
+	Path  string     `msgpack:"path"`
+	Block bool       `msgpack:"block,omitempty"`
+	ACL   *aclRecord `msgpack:"acl,omitempty"`
+}
+
+type roleRecord struct {
+	ID          uuid.UUID   `msgpack:"id"`
+	Name        string      `msgpack:"name"`
+	Permissions Permission  `msgpack:"permissions"`
+	Parents     []uuid.UUID `msgpack:"parents,omitempty"`
+}
+
+type assignmentRecord struct {
+	Role     uuid.UUID `msgpack:"role"`
+	Subject  uuid.UUID `msgpack:"subject"`
+	Group    bool      `msgpack:"group,omitempty"`
+	Resource string    `msgpack:"resource"`
+}
+
+func (u *User) record() userRecord {
+	r := userRecord{
+		ID:              u.id,
+		Username:        u.username,
+		Password:        u.password.String(),
+		LastLogin:       u.lastLogin,
+		PasswordChanged: u.passwordChanged,
+		Groups:          u.GroupIDs(),
+		PasswordHistory: make([]string, len(u.history)),
+		ResetNonce:      u.resetNonce,
+		MustChange:      u.mustChange,
+		FailedAttempts:  u.failedAttempts,
+		LastFailure:     u.lastFailure,
+		LockedUntil:     u.lockedUntil,
+		TOTPSecret:      u.totpSecret,
+		TOTPEnabled:     u.totpEnabled,
+		TOTPLastStep:    u.totpLastStep,
+		RecoveryCodes:   u.recoveryCodes,
+		DisplayName:     u.displayName,
+		Email:           u.email,
+		Disabled:        u.disabled,
+		Expires:         u.expires,
+		Attributes:      maps.Clone(u.attrs()),
+	}
+	for i, old := range u.history {
+		r.PasswordHistory[i] = old.String()
+	}
+	return r
+}
+
+func userFromRecord(r userRecord) (*User, error) {
+	u := &User{
+		id:              r.ID,
+		username:        r.Username,
+		lastLogin:       r.LastLogin,
+		passwordChanged: r.PasswordChanged,
+		groups:          r.Groups,
+		resetNonce:      r.ResetNonce,
+		mustChange:      r.MustChange,
+		failedAttempts:  r.FailedAttempts,
+		lastFailure:     r.LastFailure,
+		lockedUntil:     r.LockedUntil,
+		totpSecret:      r.TOTPSecret,
+		totpEnabled:     r.TOTPEnabled,
+		totpLastStep:    r.TOTPLastStep,
+		recoveryCodes:   r.RecoveryCodes,
+		displayName:     r.DisplayName,
+		email:           r.Email,
+		disabled:        r.Disabled,
+		expires:         r.Expires,
+	}
+	if r.Attributes != nil {
+		u.attributes.Store(&r.Attributes)
+	}
+
+	var err error
+	if r.Password != "" {
+		if u.password, err = parsePasswordHash(r.Password); err != nil {
+			return nil, err
+		}
+	} else if u.password, err = legacyPasswordHash(r.PasswordHash, r.PasswordSalt); err != nil {
+		return nil, err
+	}
+	for _, old := range r.PasswordHistory {
+		h, err := parsePasswordHash(old)
+		if err != nil {
+			return nil, err
+		}
+		u.history = append(u.history, h)
+	}
+	for _, old := range r.History {
+		h, err := legacyPasswordHash(old.Hash, old.Salt)
+		if err != nil {
+			return nil, err
+		}
+		u.history = append(u.history, h)
+	}
+	if u.groups == nil {
+		u.groups = []uuid.UUID{}
+	}
+	return u, nil
+}
+
+// legacyPasswordHash returns a hash made with the parameters all of them used in version 1.
+func legacyPasswordHash(hash, salt []byte) (passwordHash, error) {
+	if len(hash) != int(legacyHashParams.KeyLen) || len(salt) != int(legacyHashParams.SaltLen) {
+		return passwordHash{}, ErrInvalidFormat
+	}
+	return passwordHash{algorithm: argon2id, params: legacyHashParams, hash: hash, salt: salt}, nil
+}
+
+func (k *APIKey) record() apiKeyRecord {
+	return apiKeyRecord{
+		ID:       k.id,
+		Prefix:   k.prefix,
+		Name:     k.name,
+		Owner:    k.owner,
+		Scopes:   k.scopes,
+		Hash:     k.hash[:],
+		Created:  k.created,
+		Expires:  k.expires,
+		LastUsed: k.lastUsed,
+	}
+}
+
+func apiKeyFromRecord(r apiKeyRecord) (*APIKey, error) {
+	k := &APIKey{
+		id:       r.ID,
+		prefix:   r.Prefix,
+		name:     r.Name,
+		owner:    r.Owner,
+		scopes:   r.Scopes,
+		created:  r.Created,
+		expires:  r.Expires,
+		lastUsed: r.LastUsed,
+	}
+	if len(r.Hash) != len(k.hash) {
+		return nil, ErrInvalidFormat
+	}
+	copy(k.hash[:], r.Hash)
+	return k, nil
+}
+
+func (g *Group) record() groupRecord {
+	return groupRecord{ID: g.id, Name: g.name, Parents: g.ParentIDs()}
+}
+
+func groupFromRecord(r groupRecord) *Group {
+	return &Group{id: r.ID, name: r.Name, parents: r.Parents}
+}
+
+func (a *ACL) record() aclRecord {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return aclRecord{
+		ID:          a.id,
+		Resolution:  a.resolution,
+		Users:       maps.Clone(a.users),
+		Groups:      maps.Clone(a.groups),
+		UserDenies:  maps.Clone(a.userDenies),
+		GroupDenies: maps.Clone(a.groupDenies),
+	}
+}
+
+func (a *ACL) setRecord(r aclRecord) {
+	for _, m := range []*map[uuid.UUID]Permission{&r.Users, &r.Groups, &r.UserDenies, &r.GroupDenies} {
+		if *m == nil {
+			*m = make(map[uuid.UUID]Permission)
+		}
+	}
+
+	a.lock.Lock()
+	if r.ID != uuid.Nil {
+		a.id = r.ID
+	}
+	a.resolution = r.Resolution
+	a.users = r.Users
+	a.groups = r.Groups
+	a.userDenies = r.UserDenies
+	a.groupDenies = r.GroupDenies
+	a.lock.Unlock()
+}
+
+// writeContainer encodes v as the payload of a versioned container.
+func writeContainer(w io.Writer, v any) error {
+	payload, err := msgpack.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 0, 14)
+	header = append(header, magic[:]...)
+	header = binary.BigEndian.AppendUint16(header, formatVersion)
+	header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+
+	if _, err = w.Write(header); err != nil {
+		return err
+	}
+	if _, err = w.Write(payload); err != nil {
+		return err
+	}
+	_, err = w.Write(hashing.NewCRC32Hasher().Bytes(payload))
+	return err
+}
+
+// readContainer decodes the payload of a versioned container into v. If r doesn't start with
+// the container magic, it returns false and a reader yielding the whole legacy data.
+func readContainer(r io.Reader, v any) (bool, io.Reader, error) {
+	var head [4]byte
+	n, err := io.ReadFull(r, head[:])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, nil, err
+	}
+	if n < len(head) || head != magic {
+		return false, io.MultiReader(bytes.NewReader(head[:n]), r), nil
+	}
+
+	var version uint16
+	if err = binary.Read(r, binary.BigEndian, &version); err != nil {
+		return true, nil, err
+	}
+	if version == 0 || version > formatVersion {
+		return true, nil, ErrUnsupportedVersion
+	}
+
+	var length uint64
+	if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+		return true, nil, err
+	}
+	if length > maxPayload {
+		return true, nil, ErrInvalidFormat
+	}
+
+	var payload bytes.Buffer
+	if _, err = io.CopyN(&payload, r, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return true, nil, err
+	}
+	var sum [4]byte
+	if _, err = io.ReadFull(r, sum[:]); err != nil {
+		return true, nil, err
+	}
+	if !bytes.Equal(sum[:], hashing.NewCRC32Hasher().Bytes(payload.Bytes())) {
+		return true, nil, ErrChecksum
+	}
+
+	return true, nil, msgpack.Unmarshal(payload.Bytes(), v)
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashParams are the argon2id parameters used to hash passwords.
+type HashParams struct {
+	Time    uint32 // number of passes
+	Memory  uint32 // in KiB
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+// DefaultHashParams are the parameters used by New.
+var DefaultHashParams = legacyHashParams
+
+// legacyHashParams are the parameters every password was hashed with before they became configurable.
+var legacyHashParams = HashParams{Time: 1, Memory: 64 * 1024, Threads: 4, KeyLen: 32, SaltLen: 16}
+
+// weakerThan reports whether hashes made with p are cheaper to attack than ones made with q.
+// The number of threads only affects speed, not strength, so it is ignored.
+func (p HashParams) weakerThan(q HashParams) bool {
+	return p.Time < q.Time || p.Memory < q.Memory || p.KeyLen < q.KeyLen || p.SaltLen < q.SaltLen
+}
+
+// maxHashTime, maxHashMemory, maxHashThreads and maxHashLen bound the cost of checking a password against
+// a hash, so that a tampered database or an imported hash can't make every login exhaust the memory or CPU.
+const (
+	maxHashTime    = 64
+	maxHashMemory  = 1024 * 1024 // 1 GiB
+	maxHashThreads = 64
+	maxHashLen     = 1024 // of the key and the salt
+)
+
+func (p HashParams) valid() bool {
+	return p.Time > 0 && p.Time <= maxHashTime && p.Memory > 0 && p.Memory <= maxHashMemory &&
+		p.Threads > 0 && p.Threads <= maxHashThreads &&
+		p.KeyLen >= 16 && p.KeyLen <= maxHashLen && p.SaltLen >= 8 && p.SaltLen <= maxHashLen
+}
+
+const (
+	argon2id = "argon2id"
+	bcryptID = "bcrypt"
+)
+
+// passwordHash is a hashed password along with everything needed to verify it.
+type passwordHash struct {
+	algorithm string
+	params    HashParams // argon2id only
+	salt      []byte     // argon2id only
+	hash      []byte     // the whole encoded hash for bcrypt
+}
+
+func newPasswordHash(password string, params HashParams) (passwordHash, error) {
+	salt := make([]byte, params.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return passwordHash{}, err
+	}
+	h := passwordHash{algorithm: argon2id, params: params, salt: salt}
+	h.hash = h.compute(password)
+	return h, nil
+}
+
+func (h passwordHash) compute(password string) []byte {
+	return argon2.IDKey([]byte(password), h.salt, h.params.Time, h.params.Memory, h.params.Threads, h.params.KeyLen)
+}
+
+func (h passwordHash) match(password string) bool {
+	switch h.algorithm {
+	case argon2id:
+		return subtle.ConstantTimeCompare(h.hash, h.compute(password)) == 1
+	case bcryptID:
+		return bcrypt.CompareHashAndPassword(h.hash, []byte(password)) == nil
+	}
+	return false
+}
+
+// needsRehash reports whether the hash is weaker than one made with params would be.
+func (h passwordHash) needsRehash(params HashParams) bool {
+	return h.algorithm != argon2id || h.params.weakerThan(params)
+}
+
+// String returns the hash in the PHC string format for argon2id or the modular crypt format for bcrypt.
+func (h passwordHash) String() string {
+	if h.algorithm == bcryptID {
+		return string(h.hash)
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.params.Memory, h.params.Time, h.params.Threads, enc.EncodeToString(h.salt), enc.EncodeToString(h.hash))
+}
+
+// parsePasswordHash reads a hash in one of the formats written by String.
+func parsePasswordHash(s string) (passwordHash, error) {
+	if strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$") {
+		if _, err := bcrypt.Cost([]byte(s)); err != nil {
+			return passwordHash{}, fmt.Errorf("%w: %v", ErrInvalidHash, err)
+		}
+		return passwordHash{algorithm: bcryptID, hash: []byte(s)}, nil
+	}
+
+	// $argon2id$v=19$m=65536,t=1,p=4$salt$hash, with parameters checked by HashParams.valid
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != argon2id {
+		return passwordHash{}, ErrInvalidHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return passwordHash{}, ErrInvalidHash
+	}
+	h := passwordHash{algorithm: argon2id}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.params.Memory, &h.params.Time, &h.params.Threads); err != nil {
+		return passwordHash{}, ErrInvalidHash
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return passwordHash{}, ErrInvalidHash
+	}
+	if h.hash, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return passwordHash{}, ErrInvalidHash
+	}
+	h.params.KeyLen = uint32(len(h.hash))
+	h.params.SaltLen = uint32(len(h.salt))
+	if !h.params.valid() {
+		return passwordHash{}, ErrInvalidHash
+	}
+	return h, nil
+}
@@ -0,0 +1,414 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ldifTime is the LDAP generalized time format.
+const ldifTime = "20060102150405Z"
+
+// ldifLocked is the pwdAccountLockedTime of accounts locked until an administrator unlocks them.
+const ldifLocked = "000001010000Z"
+
+// ldifAttribute holds the custom attributes of a user, as key=value.
+const ldifAttribute = "x-attribute"
+
+// WriteLDIF writes the users and groups of d as LDIF entries under baseDN: inetOrgPerson entries named
+// uid=<username>,ou=people,<baseDN> and groupOfNames entries named cn=<name>,ou=groups,<baseDN>, whose
+// members are users and nested groups. The ou entries themselves aren't written. Passwords are written
+// with the {ARGON2} or {CRYPT} scheme, disabled accounts with a permanent pwdAccountLockedTime, expiry
+// dates as pwdEndTime, and custom attributes as x-attribute values.
+func (d *Directory) WriteLDIF(w io.Writer, baseDN string) error {
+	suffix := ""
+	if baseDN != "" {
+		suffix = "," + baseDN
+	}
+	userDN := func(name string) string { return "uid=" + escapeDN(name) + ",ou=people" + suffix }
+	groupDN := func(name string) string { return "cn=" + escapeDN(name) + ",ou=groups" + suffix }
+
+	members := make(map[string][]string)
+	for _, u := range d.Users {
+		for _, g := range u.Groups {
+			members[g] = append(members[g], userDN(u.Username))
+		}
+	}
+	groups := slices.Clone(d.Groups)
+	for _, g := range d.Groups {
+		for _, p := range g.Parents {
+			members[p] = append(members[p], groupDN(g.Name))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(members)) {
+		if !slices.ContainsFunc(groups, func(g DirectoryGroup) bool { return g.Name == name }) {
+			groups = append(groups, DirectoryGroup{Name: name})
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("version: 1\n")
+	for _, u := range d.Users {
+		cn := u.DisplayName
+		if cn == "" {
+			cn = u.Username
+		}
+		bw.WriteString("\n")
+		writeLDIFLine(bw, "dn", userDN(u.Username))
+		writeLDIFLine(bw, "objectClass", "inetOrgPerson")
+		writeLDIFLine(bw, "uid", u.Username)
+		writeLDIFLine(bw, "cn", cn)
+		writeLDIFLine(bw, "sn", cn)
+		if u.DisplayName != "" {
+			writeLDIFLine(bw, "displayName", u.DisplayName)
+		}
+		if u.Email != "" {
+			writeLDIFLine(bw, "mail", u.Email)
+		}
+		if u.PasswordHash != "" {
+			scheme := "{ARGON2}"
+			if !strings.HasPrefix(u.PasswordHash, "$argon2") {
+				scheme = "{CRYPT}"
+			}
+			writeLDIFLine(bw, "userPassword", scheme+u.PasswordHash)
+		}
+		if u.Disabled {
+			writeLDIFLine(bw, "pwdAccountLockedTime", ldifLocked)
+		}
+		if !u.Expires.IsZero() {
+			writeLDIFLine(bw, "pwdEndTime", u.Expires.UTC().Format(ldifTime))
+		}
+		for _, key := range slices.Sorted(maps.Keys(u.Attributes)) {
+			writeLDIFLine(bw, ldifAttribute, key+"="+u.Attributes[key])
+		}
+	}
+	for _, g := range groups {
+		bw.WriteString("\n")
+		writeLDIFLine(bw, "dn", groupDN(g.Name))
+		writeLDIFLine(bw, "objectClass", "groupOfNames")
+		writeLDIFLine(bw, "cn", g.Name)
+		for _, m := range members[g.Name] {
+			writeLDIFLine(bw, "member", m)
+		}
+	}
+	return bw.Flush()
+}
+
+// writeLDIFLine writes an attribute, in base64 if the value isn't a safe string, folded at 76 columns.
+func writeLDIFLine(w *bufio.Writer, name, value string) {
+	line := name + ": " + value
+	if !ldifSafe(value) {
+		line = name + ":: " + base64.StdEncoding.EncodeToString([]byte(value))
+	}
+	for len(line) > 76 {
+		w.WriteString(line[:76])
+		w.WriteString("\n ")
+		line = line[76:]
+	}
+	w.WriteString(line)
+	w.WriteString("\n")
+}
+
+// ldifSafe reports whether s is a SAFE-STRING of RFC 2849, which can be written as is.
+func ldifSafe(s string) bool {
+	if s == "" {
+		return true
+	}
+	if s[0] == ' ' || s[0] == ':' || s[0] == '<' || s[len(s)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == 0 || c == '\n' || c == '\r' || c > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// ldifEntry is an entry of an LDIF file: its DN and its attributes, by lower case name.
+type ldifEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+func (e ldifEntry) first(name string) string {
+	if values := e.attrs[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (e ldifEntry) hasClass(classes ...string) bool {
+	for _, c := range e.attrs["objectclass"] {
+		if slices.Contains(classes, strings.ToLower(c)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadLDIF reads users and groups from LDIF entries, like those written by WriteLDIF. Entries of
+// the groupOfNames, groupOfUniqueNames and posixGroup classes are groups, whose members are
+// resolved by DN, or by name for memberUid. Other entries with a uid are users. Passwords in other
+// schemes than {ARGON2}, {CRYPT} with a bcrypt hash and {BCRYPT} are dropped, and users without
+// x-attribute values have nil attributes, so that importing leaves both unchanged.
+func ReadLDIF(r io.Reader) (*Directory, error) {
+	entries, err := readLDIFEntries(r)
+	if err != nil {
+		return nil, err
+	}
+
+	type member struct {
+		name  string
+		group bool
+	}
+	byDN := make(map[string]member)
+	for _, e := range entries {
+		switch {
+		case e.hasClass("groupofnames", "groupofuniquenames", "posixgroup"):
+			name := e.first("cn")
+			if name == "" {
+				name = firstRDNValue(e.dn)
+			}
+			byDN[normalizeDN(e.dn)] = member{name: name, group: true}
+		case e.first("uid") != "":
+			byDN[normalizeDN(e.dn)] = member{name: e.first("uid")}
+		}
+	}
+
+	d := &Directory{}
+	users := make(map[string]int)
+	parents := make(map[string][]string)
+	var memberships [][2]string
+	for _, e := range entries {
+		m, ok := byDN[normalizeDN(e.dn)]
+		if !ok {
+			continue
+		}
+		if m.group {
+			d.Groups = append(d.Groups, DirectoryGroup{Name: m.name})
+			for _, dn := range append(e.attrs["member"], e.attrs["uniquemember"]...) {
+				dn, _, _ = strings.Cut(dn, "#") // uniqueMember may end with #<bit string>
+				if sub, ok := byDN[normalizeDN(dn)]; ok && sub.group {
+					parents[sub.name] = append(parents[sub.name], m.name)
+				} else if ok {
+					memberships = append(memberships, [2]string{sub.name, m.name})
+				}
+			}
+			for _, uid := range e.attrs["memberuid"] {
+				memberships = append(memberships, [2]string{uid, m.name})
+			}
+			continue
+		}
+
+		u := DirectoryUser{
+			Username:    m.name,
+			DisplayName: e.first("displayname"),
+			Email:       e.first("mail"),
+		}
+		if len(e.attrs[ldifAttribute]) > 0 {
+			u.Attributes = make(map[string]string)
+		}
+		for _, p := range e.attrs["userpassword"] {
+			if hash, ok := ldifPassword(p); ok {
+				u.PasswordHash = hash
+				break
+			}
+		}
+		if e.first("pwdaccountlockedtime") != "" {
+			u.Disabled = true
+		}
+		if end := e.first("pwdendtime"); end != "" {
+			if u.Expires, err = time.Parse(ldifTime, end); err != nil {
+				return nil, fmt.Errorf("%w: %s: pwdEndTime: %v", ErrInvalidDirectory, e.dn, err)
+			}
+		}
+		for _, kv := range e.attrs[ldifAttribute] {
+			key, value, ok := strings.Cut(kv, "=")
+			if !ok {
+				return nil, fmt.Errorf("%w: %s: %s without =", ErrInvalidDirectory, e.dn, ldifAttribute)
+			}
+			u.Attributes[key] = value
+		}
+		users[u.Username] = len(d.Users)
+		d.Users = append(d.Users, u)
+	}
+
+	for _, m := range memberships {
+		i, ok := users[m[0]]
+		if !ok {
+			continue
+		}
+		if !slices.Contains(d.Users[i].Groups, m[1]) {
+			d.Users[i].Groups = append(d.Users[i].Groups, m[1])
+		}
+	}
+	for i, g := range d.Groups {
+		d.Groups[i].Parents = compactNames(parents[g.Name])
+	}
+	return d, nil
+}
+
+// ldifPassword returns the hash of a userPassword value, if its scheme is supported.
+func ldifPassword(value string) (string, bool) {
+	scheme, hash, ok := strings.Cut(value, "}")
+	if !ok || !strings.HasPrefix(scheme, "{") {
+		return "", false
+	}
+	switch strings.ToUpper(scheme[1:]) {
+	case "ARGON2", "CRYPT", "BCRYPT":
+		if _, err := parsePasswordHash(hash); err == nil {
+			return hash, true
+		}
+	}
+	return "", false
+}
+
+// readLDIFEntries parses the entries of an LDIF file. Change records are read as plain entries, their
+// changetype being an attribute like the others.
+func readLDIFEntries(r io.Reader) ([]ldifEntry, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		switch {
+		case strings.HasPrefix(line, " "):
+			if len(lines) == 0 || lines[len(lines)-1] == "" {
+				return nil, fmt.Errorf("%w: line %d: continuation of nothing", ErrInvalidDirectory, n)
+			}
+			if lines[len(lines)-1] != "#" {
+				lines[len(lines)-1] += line[1:]
+			}
+		case strings.HasPrefix(line, "#"):
+			// comments may be folded too; keep them out of the attributes
+			lines = append(lines, "#")
+		default:
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var entries []ldifEntry
+	var e *ldifEntry
+	for _, line := range lines {
+		if line == "" {
+			e = nil
+			continue
+		}
+		if line == "#" || line == "-" { // comments, and the separators of modify records
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidDirectory, line)
+		}
+		name, _, _ = strings.Cut(strings.ToLower(name), ";") // drop options such as ;lang-en
+		switch {
+		case strings.HasPrefix(value, ":"):
+			data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", ErrInvalidDirectory, name, err)
+			}
+			value = string(data)
+		case strings.HasPrefix(value, "<"):
+			return nil, fmt.Errorf("%w: %s: URL values aren't supported", ErrInvalidDirectory, name)
+		default:
+			value = strings.TrimLeft(value, " ")
+		}
+
+		if e == nil {
+			if name == "version" {
+				continue
+			}
+			if name != "dn" {
+				return nil, fmt.Errorf("%w: entry without dn", ErrInvalidDirectory)
+			}
+			entries = append(entries, ldifEntry{dn: value, attrs: make(map[string][]string)})
+			e = &entries[len(entries)-1]
+			continue
+		}
+		e.attrs[name] = append(e.attrs[name], value)
+	}
+	return entries, nil
+}
+
+// escapeDN escapes an attribute value for a DN, as in RFC 4514.
+func escapeDN(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0,
+			(c == ' ' || c == '#') && i == 0,
+			c == ' ' && i == len(value)-1:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// splitDN returns the RDNs of a DN, still escaped.
+func splitDN(dn string) []string {
+	var rdns []string
+	start := 0
+	for i := 0; i < len(dn); i++ {
+		switch dn[i] {
+		case '\\':
+			i++
+		case ',':
+			rdns = append(rdns, strings.TrimSpace(dn[start:i]))
+			start = i + 1
+		}
+	}
+	return append(rdns, strings.TrimSpace(dn[start:]))
+}
+
+// normalizeDN returns a DN in a form where equivalent DNs are equal, for the common cases.
+func normalizeDN(dn string) string {
+	rdns := splitDN(dn)
+	for i, rdn := range rdns {
+		name, value, _ := strings.Cut(rdn, "=")
+		rdns[i] = strings.ToLower(strings.TrimSpace(name)) + "=" + strings.ToLower(unescapeDN(strings.TrimSpace(value)))
+	}
+	return strings.Join(rdns, ",")
+}
+
+// firstRDNValue returns the unescaped value of the first RDN of a DN.
+func firstRDNValue(dn string) string {
+	_, value, _ := strings.Cut(splitDN(dn)[0], "=")
+	return unescapeDN(strings.TrimSpace(value))
+}
+
+func unescapeDN(value string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '\\' || i+1 == len(value) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i+1 < len(value) {
+			if c, err := hex.DecodeString(value[i : i+2]); err == nil {
+				b.Write(c)
+				i++
+				continue
+			}
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/google/uuid"
+)
+
+// Readers for the unversioned format written before snapshots had a header. It used a single byte
+// for name lengths and group counts, and a uint16 for ACL entry counts.
+
+func (a *Auth) unmarshalLegacy(r io.Reader) error {
+	var numUsers, numGroups uint64
+	err := binary.Read(r, binary.BigEndian, &numUsers)
+	if err != nil {
+		return err
+	}
+	users := make(map[string]*User, numUsers)
+	for i := 0; i < int(numUsers); i++ {
+		u := new(User)
+		if err = u.unmarshalLegacy(r); err != nil {
+			return err
+		}
+		users[u.username] = u
+	}
+
+	err = binary.Read(r, binary.BigEndian, &numGroups)
+	if err != nil {
+		return err
+	}
+
+	groups := make(map[string]*Group, numGroups)
+	for i := 0; i < int(numGroups); i++ {
+		g := new(Group)
+		if err = g.unmarshalLegacy(r); err != nil {
+			return err
+		}
+		groups[g.name] = g
+	}
+
+	a.lock.Lock()
+	a.users = users
+	a.groups = groups
+	a.resources = make(map[string]*resource)
+	a.roles = make(map[string]*Role)
+	a.assignments = make(map[RoleAssignment]struct{})
+	a.lock.Unlock()
+
+	if err = a.acl.unmarshalLegacy(r); err != nil {
+		return err
+	}
+
+	return a.load()
+}
+
+func (u *User) unmarshalLegacy(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, &u.id); err != nil {
+		return err
+	}
+	var usernameLen byte
+	if err := binary.Read(r, binary.BigEndian, &usernameLen); err != nil {
+		return err
+	}
+	var usernameBytes = make([]byte, int(usernameLen))
+	if err := binary.Read(r, binary.BigEndian, usernameBytes); err != nil {
+		return err
+	}
+	u.username = string(usernameBytes)
+	b := make([]byte, 15)
+	if err := binary.Read(r, binary.BigEndian, b); err != nil {
+		return err
+	}
+	if err := u.lastLogin.UnmarshalBinary(b); err != nil {
+		return err
+	}
+	x := make([]byte, 15)
+	if err := binary.Read(r, binary.BigEndian, x); err != nil {
+		return err
+	}
+	if err := u.passwordChanged.UnmarshalBinary(x); err != nil {
+		return err
+	}
+	var hash [32]byte
+	if err := binary.Read(r, binary.BigEndian, &hash); err != nil {
+		return err
+	}
+	var salt [16]byte
+	if err := binary.Read(r, binary.BigEndian, &salt); err != nil {
+		return err
+	}
+	u.password = passwordHash{algorithm: argon2id, params: legacyHashParams, hash: hash[:], salt: salt[:]}
+	var groupCount byte
+	if err := binary.Read(r, binary.BigEndian, &groupCount); err != nil {
+		return err
+	}
+	for i := 0; i < int(groupCount); i++ {
+		var g uuid.UUID
+		if err := binary.Read(r, binary.BigEndian, &g); err != nil {
+			return err
+		}
+		u.groups = append(u.groups, g)
+	}
+	return nil
+}
+
+func (g *Group) unmarshalLegacy(r io.Reader) error {
+	if err := binary.Read(r, binary.BigEndian, &g.id); err != nil {
+		return err
+	}
+	var nameLen byte
+	if err := binary.Read(r, binary.BigEndian, &nameLen); err != nil {
+		return err
+	}
+	var nameBytes = make([]byte, int(nameLen))
+	if err := binary.Read(r, binary.BigEndian, nameBytes); err != nil {
+		return err
+	}
+	g.name = string(nameBytes)
+	return nil
+}
+
+func (a *ACL) unmarshalLegacy(r io.Reader) error {
+	var numUsers, numGroups uint16
+	err := binary.Read(r, binary.BigEndian, &numUsers)
+	if err != nil {
+		return err
+	}
+	users := make(map[uuid.UUID]Permission, numUsers)
+	for i := 0; i < int(numUsers); i++ {
+		var id uuid.UUID
+		err := binary.Read(r, binary.BigEndian, &id)
+		if err != nil {
+			return err
+		}
+		var p Permission
+		err = binary.Read(r, binary.BigEndian, &p)
+		if err != nil {
+			return err
+		}
+		users[id] = p
+	}
+
+	err = binary.Read(r, binary.BigEndian, &numGroups)
+	if err != nil {
+		return err
+	}
+	groups := make(map[uuid.UUID]Permission, numGroups)
+	for i := 0; i < int(numGroups); i++ {
+		var id uuid.UUID
+		err := binary.Read(r, binary.BigEndian, &id)
+		if err != nil {
+			return err
+		}
+		var p Permission
+		err = binary.Read(r, binary.BigEndian, &p)
+		if err != nil {
+			return err
+		}
+		groups[id] = p
+	}
+
+	a.lock.Lock()
+	a.users = users
+	a.groups = groups
+	a.lock.Unlock()
+	return nil
+}
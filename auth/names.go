@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PermissionRegistry gives names to the bits of a Permission, so that permissions can be
+// written as "read|write" instead of numbers.
+type PermissionRegistry struct {
+	lock  sync.RWMutex
+	bits  map[string]Permission
+	names []string // in registration order, which is also the formatting order
+}
+
+// DefaultPermissions is the registry used by Permission.String and by the JSON and text encodings of Permission.
+var DefaultPermissions = NewPermissionRegistry()
+
+func NewPermissionRegistry() *PermissionRegistry {
+	return &PermissionRegistry{bits: make(map[string]Permission)}
+}
+
+// RegisterPermission names bits in DefaultPermissions.
+func RegisterPermission(name string, bits Permission) error {
+	return DefaultPermissions.Register(name, bits)
+}
+
+// ParsePermission parses a permission with DefaultPermissions.
+func ParsePermission(s string) (Permission, error) {
+	return DefaultPermissions.Parse(s)
+}
+
+// Register gives a name to one or more bits. Names are case-sensitive, can't start with a digit
+// and can't contain '|' or spaces.
+func (r *PermissionRegistry) Register(name string, bits Permission) error {
+	if bits == 0 || !validPermissionName(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidPermissionName, name)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.bits[name]; ok {
+		return fmt.Errorf("%w: %q", ErrPermissionExists, name)
+	}
+	r.bits[name] = bits
+	r.names = append(r.names, name)
+	return nil
+}
+
+func validPermissionName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	return !strings.ContainsAny(name, "| \t\r\n\"")
+}
+
+// Lookup returns the bits of a name.
+func (r *PermissionRegistry) Lookup(name string) (Permission, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	bits, ok := r.bits[name]
+	return bits, ok
+}
+
+// Names returns the names that make up p, in registration order. The bits of p that have no
+// name are returned as a single hexadecimal number, so that the result can always be parsed back.
+func (r *PermissionRegistry) Names(p Permission) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	var list []string
+	var covered Permission
+	for _, name := range r.names {
+		bits := r.bits[name]
+		if p&bits == bits && covered&bits != bits {
+			list = append(list, name)
+			covered |= bits
+		}
+	}
+	if rest := p &^ covered; rest != 0 {
+		list = append(list, "0x"+strconv.FormatUint(uint64(rest), 16))
+	}
+	return list
+}
+
+// Format writes p as its names separated by '|', or "0" if it is empty.
+func (r *PermissionRegistry) Format(p Permission) string {
+	if p == 0 {
+		return "0"
+	}
+	return strings.Join(r.Names(p), "|")
+}
+
+// Parse reads a permission written by Format. Each part is either a registered name or a number;
+// unknown names are rejected with ErrUnknownPermission.
+func (r *PermissionRegistry) Parse(s string) (Permission, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	return r.parseNames(strings.Split(s, "|"))
+}
+
+func (r *PermissionRegistry) parseNames(names []string) (Permission, error) {
+	var p Permission
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if bits, ok := r.Lookup(name); ok {
+			p |= bits
+			continue
+		}
+		if name != "" && name[0] >= '0' && name[0] <= '9' {
+			bits, err := strconv.ParseUint(name, 0, 64)
+			if err != nil {
+				return 0, fmt.Errorf("%w: %q", ErrUnknownPermission, name)
+			}
+			p |= Permission(bits)
+			continue
+		}
+		return 0, fmt.Errorf("%w: %q", ErrUnknownPermission, name)
+	}
+	return p, nil
+}
+
+// MarshalJSON implements json.Marshaler interface. The permission is written as the list of
+// its names in DefaultPermissions, for people to read; encodings read by other programs, which
+// may register other names, should use the number.
+func (p Permission) MarshalJSON() ([]byte, error) {
+	names := DefaultPermissions.Names(p)
+	if names == nil {
+		names = []string{}
+	}
+	return json.Marshal(names)
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface. Besides lists of names, it accepts
+// the "read|write" form and plain numbers.
+func (p *Permission) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return ErrUnknownPermission
+	}
+
+	switch data[0] {
+	case '[':
+		var names []string
+		if err := json.Unmarshal(data, &names); err != nil {
+			return err
+		}
+		v, err := DefaultPermissions.parseNames(names)
+		if err != nil {
+			return err
+		}
+		*p = v
+		return nil
+	case '"':
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		return p.UnmarshalText([]byte(s))
+	case 'n': // null
+		return nil
+	default:
+		var v uint64
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		*p = Permission(v)
+		return nil
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler interface, for config files.
+func (p Permission) MarshalText() ([]byte, error) {
+	return []byte(DefaultPermissions.Format(p)), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler interface.
+func (p *Permission) UnmarshalText(text []byte) error {
+	v, err := DefaultPermissions.Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// passwdFirstID is the first uid and gid written by WritePasswd.
+	passwdFirstID = 1000
+	// passwdUsersGID is the gid of the users without group.
+	passwdUsersGID = 100
+)
+
+// WritePasswd writes the users of d in the format of /etc/passwd, and its groups in that of /etc/group.
+// The password field holds the hash, prefixed with ! for disabled accounts, and the GECOS field the
+// display name and the email, as its first and fifth comma-separated values. Uids and gids are numbered
+// from 1000 in the order of d, the primary group of a user being its first one. Group members are listed
+// by name, nested groups as @<name>. Expiry dates and attributes aren't part of the format.
+func (d *Directory) WritePasswd(passwd, group io.Writer) error {
+	names := make(map[string]bool)
+	for _, g := range d.Groups {
+		names[g.Name] = true
+		for _, p := range g.Parents {
+			names[p] = true
+		}
+	}
+	for _, u := range d.Users {
+		for _, g := range u.Groups {
+			names[g] = true
+		}
+	}
+	var groups []string
+	for _, g := range d.Groups {
+		groups = append(groups, g.Name)
+		delete(names, g.Name)
+	}
+	groups = append(groups, slices.Sorted(maps.Keys(names))...)
+
+	gids := make(map[string]int, len(groups))
+	members := make(map[string][]string, len(groups))
+	for i, g := range groups {
+		if err := passwdField(g); err != nil {
+			return err
+		}
+		gids[g] = passwdFirstID + i
+	}
+	for _, g := range d.Groups {
+		for _, p := range g.Parents {
+			members[p] = append(members[p], "@"+g.Name)
+		}
+	}
+
+	pw := bufio.NewWriter(passwd)
+	for i, u := range d.Users {
+		for _, s := range []string{u.Username, u.DisplayName, u.Email} {
+			if err := passwdField(s); err != nil {
+				return err
+			}
+		}
+		hash := u.PasswordHash
+		if hash == "" {
+			hash = "*"
+		}
+		if u.Disabled {
+			hash = "!" + hash
+		}
+		gid := passwdUsersGID
+		if len(u.Groups) > 0 {
+			gid = gids[u.Groups[0]]
+		}
+		gecos := u.DisplayName + ",,,," + u.Email
+		fmt.Fprintf(pw, "%s:%s:%d:%d:%s:/home/%s:/usr/sbin/nologin\n", u.Username, hash, passwdFirstID+i, gid, gecos, u.Username)
+		for _, g := range u.Groups {
+			members[g] = append(members[g], u.Username)
+		}
+	}
+	if err := pw.Flush(); err != nil {
+		return err
+	}
+
+	gw := bufio.NewWriter(group)
+	for _, g := range groups {
+		fmt.Fprintf(gw, "%s:x:%d:%s\n", g, gids[g], strings.Join(members[g], ","))
+	}
+	return gw.Flush()
+}
+
+// passwdField checks that s can be written in a field of the passwd and group formats.
+func passwdField(s string) error {
+	if strings.ContainsAny(s, ":,\n") {
+		return fmt.Errorf("%w: %q: colons, commas and newlines can't be written to passwd", ErrInvalidDirectory, s)
+	}
+	return nil
+}
+
+// ReadPasswd reads users and groups in the format written by WritePasswd; group may be nil, leaving
+// the groups of the users Missing. Password fields without a supported hash, such as x for shadowed
+// passwords, give users without password. Users are members of their primary group and of those listing
+// them. Expiry dates and attributes are Missing, as are emails when the GECOS field has no fifth value,
+// so importing leaves them unchanged. System accounts are read too: filter them out of the Directory
+// before importing it if needed.
+func ReadPasswd(passwd, group io.Reader) (*Directory, error) {
+	d := &Directory{}
+	byGID := make(map[string]string)
+	members := make(map[string][]string) // groups by member
+	if group != nil {
+		parents := make(map[string][]string)
+		err := readColonFile(group, 4, func(fields []string) error {
+			byGID[fields[2]] = fields[0]
+			d.Groups = append(d.Groups, DirectoryGroup{Name: fields[0]})
+			for _, m := range strings.Split(fields[3], ",") {
+				if child, ok := strings.CutPrefix(m, "@"); ok {
+					parents[child] = append(parents[child], fields[0])
+				} else if m != "" {
+					members[m] = append(members[m], fields[0])
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for i, g := range d.Groups {
+			d.Groups[i].Parents = compactNames(parents[g.Name])
+		}
+	}
+
+	err := readColonFile(passwd, 7, func(fields []string) error {
+		if _, err := strconv.Atoi(fields[3]); err != nil {
+			return fmt.Errorf("%w: %s: gid %q", ErrInvalidDirectory, fields[0], fields[3])
+		}
+		u := DirectoryUser{Username: fields[0], Missing: FieldExpires | FieldAttributes}
+		if group == nil {
+			u.Missing |= FieldGroups
+		}
+		hash := fields[1]
+		if strings.HasPrefix(hash, "!") {
+			u.Disabled, hash = true, strings.TrimLeft(hash, "!")
+		}
+		if _, err := parsePasswordHash(hash); err == nil {
+			u.PasswordHash = hash
+		}
+		gecos := strings.Split(fields[4], ",")
+		u.DisplayName = gecos[0]
+		if len(gecos) >= 5 {
+			u.Email = gecos[4]
+		} else {
+			u.Missing |= FieldEmail
+		}
+		if g, ok := byGID[fields[3]]; ok {
+			u.Groups = append(u.Groups, g)
+		}
+		u.Groups = compactNames(append(u.Groups, members[u.Username]...))
+		d.Users = append(d.Users, u)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// readColonFile calls fn with the fields of each line of a colon-separated file, skipping blank lines
+// and comments.
+func readColonFile(r io.Reader, n int, fn func(fields []string) error) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ":")
+		if len(fields) != n {
+			return fmt.Errorf("%w: line %d: %d fields instead of %d", ErrInvalidDirectory, line, len(fields), n)
+		}
+		if err := fn(fields); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -1,10 +1,10 @@
 package auth
 
 import (
-	"encoding/binary"
 	"fmt"
 	"io"
 	"math"
+	"strings"
 	"sync"
 
 	"github.com/google/uuid"
@@ -56,91 +56,229 @@ func (p Permission) HasAllPermissions(list ...uint64) bool {
 	return true
 }
 
+// String formats p with the names of DefaultPermissions, like "read|write".
 func (p Permission) String() string {
-	return fmt.Sprintf("%064b", p)
+	return DefaultPermissions.Format(p)
+}
+
+// Resolution is how an ACL combines the entries of a user (or group) with those of its groups.
+// Deny entries are subtracted from the combined grants in every mode.
+type Resolution uint8
+
+const (
+	// ResolveHighest uses the grant of the user if there is one, otherwise the numerically
+	// highest grant among its groups. It is the default, for compatibility.
+	ResolveHighest Resolution = iota
+	// ResolveUnion merges the grants of the user and all its groups.
+	ResolveUnion
+	// ResolveOverride merges the grants of the groups, unless the user has entries of its own,
+	// which are then used alone.
+	ResolveOverride
+)
+
+func (r Resolution) String() string {
+	switch r {
+	case ResolveHighest:
+		return "highest"
+	case ResolveUnion:
+		return "union"
+	case ResolveOverride:
+		return "override"
+	}
+	return fmt.Sprintf("Resolution(%d)", uint8(r))
 }
 
 type ACL struct {
-	lock   sync.RWMutex
-	id     uuid.UUID
-	users  map[uuid.UUID]Permission
-	groups map[uuid.UUID]Permission
+	lock        sync.RWMutex
+	id          uuid.UUID
+	resolution  Resolution
+	users       map[uuid.UUID]Permission
+	groups      map[uuid.UUID]Permission
+	userDenies  map[uuid.UUID]Permission
+	groupDenies map[uuid.UUID]Permission
 }
 
 func NewACL() *ACL {
 	return &ACL{
-		id:     uuid.New(),
-		users:  make(map[uuid.UUID]Permission),
-		groups: make(map[uuid.UUID]Permission),
+		id:          uuid.New(),
+		users:       make(map[uuid.UUID]Permission),
+		groups:      make(map[uuid.UUID]Permission),
+		userDenies:  make(map[uuid.UUID]Permission),
+		groupDenies: make(map[uuid.UUID]Permission),
 	}
 }
 
-func (a *ACL) ID() uuid.UUID {
-	return a.id
-}
-
-func (a *ACL) MarshalBinary(w io.Writer) error {
+func (a *ACL) Resolution() Resolution {
 	a.lock.RLock()
 	defer a.lock.RUnlock()
+	return a.resolution
+}
 
-	_ = binary.Write(w, binary.BigEndian, uint16(len(a.users)))
-	for id, p := range a.users {
-		_ = binary.Write(w, binary.BigEndian, id[:])
-		_ = binary.Write(w, binary.BigEndian, uint64(p))
-	}
+// EntryKind tells how an ACLEntry affects a permission.
+type EntryKind uint8
+
+const (
+	EntryGrant EntryKind = iota
+	EntryDeny
+	// EntryScope is the scope of an API key, which limits the permissions of its owner.
+	EntryScope
+)
 
-	_ = binary.Write(w, binary.BigEndian, uint16(len(a.groups)))
-	for id, p := range a.groups {
-		_ = binary.Write(w, binary.BigEndian, id[:])
-		_ = binary.Write(w, binary.BigEndian, uint64(p))
+// ACLEntry is an entry considered while resolving a permission.
+type ACLEntry struct {
+	Kind  EntryKind
+	ID    uuid.UUID
+	Name  string
+	Group bool
+	Mask  Permission
+	// Effect holds the bits this entry granted, or removed for denies and scopes.
+	Effect Permission
+}
+
+func (e ACLEntry) String() string {
+	var b strings.Builder
+	switch e.Kind {
+	case EntryGrant:
+		b.WriteString("+")
+	case EntryDeny:
+		b.WriteString("-")
+	case EntryScope:
+		b.WriteString("scope ")
+	}
+	if e.Group {
+		b.WriteString("group:")
+	} else if e.Kind != EntryScope {
+		b.WriteString("user:")
+	}
+	if e.Name != "" {
+		b.WriteString(e.Name)
+	} else {
+		b.WriteString(e.ID.String())
 	}
+	return b.String()
+}
 
-	return nil
+// Explanation tells how a permission was resolved.
+type Explanation struct {
+	Resolution Resolution
+	Permission Permission
+	Entries    []ACLEntry
 }
 
-func (a *ACL) UnmarshalBinary(r io.Reader) error {
-	var numUsers, numGroups uint16
-	err := binary.Read(r, binary.BigEndian, &numUsers)
-	if err != nil {
-		return err
+// Bit returns the entries that granted or removed bit n of the permission.
+func (e Explanation) Bit(n uint) []ACLEntry {
+	var list []ACLEntry
+	for _, entry := range e.Entries {
+		if entry.Effect&(1<<n) != 0 {
+			list = append(list, entry)
+		}
 	}
-	users := make(map[uuid.UUID]Permission, numUsers)
-	for i := 0; i < int(numUsers); i++ {
-		var id uuid.UUID
-		err := binary.Read(r, binary.BigEndian, &id)
-		if err != nil {
-			return err
+	return list
+}
+
+// String lists every bit affected by an entry, along with those entries.
+func (e Explanation) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s resolution: %s", e.Resolution, e.Permission)
+	for n := uint(0); n < 64; n++ {
+		entries := e.Bit(n)
+		if len(entries) == 0 {
+			continue
+		}
+		state := "denied"
+		if e.Permission&(1<<n) != 0 {
+			state = "granted"
 		}
-		var p Permission
-		err = binary.Read(r, binary.BigEndian, &p)
-		if err != nil {
-			return err
+		fmt.Fprintf(&b, "\nbit %d %s:", n, state)
+		for _, entry := range entries {
+			b.WriteString(" ")
+			b.WriteString(entry.String())
 		}
-		users[id] = p
 	}
+	return b.String()
+}
 
-	err = binary.Read(r, binary.BigEndian, &numGroups)
-	if err != nil {
-		return err
+// resolve combines the entries of a subject, a user or a group, with those of the groups it
+// inherits from. The result is valid if the subject has a grant or the permission isn't empty.
+func (a *ACL) resolve(subject uuid.UUID, group bool, inherited []uuid.UUID) (Explanation, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	grants, denies := a.users, a.userDenies
+	if group {
+		grants, denies = a.groups, a.groupDenies
+	}
+	own, hasOwn := grants[subject]
+	ownDeny, hasOwnDeny := denies[subject]
+
+	e := Explanation{Resolution: a.resolution}
+	var granted, denied Permission
+	if hasOwn {
+		granted = own
+		e.Entries = append(e.Entries, ACLEntry{Kind: EntryGrant, ID: subject, Group: group, Mask: own})
 	}
-	groups := make(map[uuid.UUID]Permission, numGroups)
-	for i := 0; i < int(numGroups); i++ {
-		var id uuid.UUID
-		err := binary.Read(r, binary.BigEndian, &id)
-		if err != nil {
-			return err
+	if hasOwnDeny {
+		denied = ownDeny
+		e.Entries = append(e.Entries, ACLEntry{Kind: EntryDeny, ID: subject, Group: group, Mask: ownDeny})
+	}
+
+	useGrants := !hasOwn || a.resolution == ResolveUnion
+	useDenies := true
+	if a.resolution == ResolveOverride && (hasOwn || hasOwnDeny) {
+		useGrants, useDenies = false, false
+	}
+
+	highest := -1
+	for _, id := range inherited {
+		if p, ok := a.groups[id]; ok && useGrants {
+			e.Entries = append(e.Entries, ACLEntry{Kind: EntryGrant, ID: id, Group: true, Mask: p})
+			if a.resolution != ResolveHighest {
+				granted |= p
+			} else if highest < 0 || p > e.Entries[highest].Mask {
+				highest = len(e.Entries) - 1
+			}
 		}
-		var p Permission
-		err = binary.Read(r, binary.BigEndian, &p)
-		if err != nil {
-			return err
+		if p, ok := a.groupDenies[id]; ok && useDenies {
+			denied |= p
+			e.Entries = append(e.Entries, ACLEntry{Kind: EntryDeny, ID: id, Group: true, Mask: p})
+		}
+	}
+	if highest >= 0 {
+		granted = e.Entries[highest].Mask
+	}
+
+	e.Permission = granted &^ denied
+	for i := range e.Entries {
+		entry := &e.Entries[i]
+		switch {
+		case entry.Kind == EntryDeny:
+			entry.Effect = entry.Mask & granted
+		case a.resolution != ResolveHighest || i == highest || (highest < 0 && entry.ID == subject):
+			entry.Effect = entry.Mask & granted
 		}
-		groups[id] = p
 	}
+	return e, hasOwn || e.Permission != 0
+}
+
+func (a *ACL) ID() uuid.UUID {
+	return a.id
+}
+
+// MarshalBinary writes the ACL in the versioned snapshot format.
+func (a *ACL) MarshalBinary(w io.Writer) error {
+	return writeContainer(w, a.record())
+}
 
-	a.lock.Lock()
-	a.users = users
-	a.groups = groups
-	a.lock.Unlock()
+// UnmarshalBinary reads an ACL written by MarshalBinary, or by its unversioned predecessor.
+func (a *ACL) UnmarshalBinary(r io.Reader) error {
+	var rec aclRecord
+	versioned, legacy, err := readContainer(r, &rec)
+	if err != nil {
+		return err
+	}
+	if !versioned {
+		return a.unmarshalLegacy(legacy)
+	}
+	a.setRecord(rec)
 	return nil
 }
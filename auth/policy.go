@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/another-d-mention/unicomplex/filesystem"
+)
+
+// CharClass is a set of character classes a password must contain.
+type CharClass uint8
+
+const (
+	ClassLower CharClass = 1 << iota
+	ClassUpper
+	ClassDigit
+	ClassSymbol
+)
+
+// PasswordPolicy describes the passwords accepted by AddUser and ChangePassword.
+// A policy must not be modified after it has been set on an Auth.
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters (runes).
+	MinLength int
+	// Require lists the character classes that must all be present.
+	Require CharClass
+	// MaxAge is how long a password stays valid after it was set. Zero means forever.
+	MaxAge time.Duration
+	// History is the number of previous passwords that can't be reused.
+	History int
+
+	denied map[string]struct{}
+}
+
+// Deny adds passwords to the deny-list. Matching is case-insensitive.
+func (p *PasswordPolicy) Deny(passwords ...string) {
+	if p.denied == nil {
+		p.denied = make(map[string]struct{}, len(passwords))
+	}
+	for _, pwd := range passwords {
+		p.denied[strings.ToLower(pwd)] = struct{}{}
+	}
+}
+
+// LoadDenyList adds the passwords read from r, one per line, to the deny-list.
+// Empty lines and lines starting with # are ignored.
+func (p *PasswordPolicy) LoadDenyList(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		p.Deny(line)
+	}
+	return scanner.Err()
+}
+
+// LoadDenyListFile is LoadDenyList for a file of fs.
+func (p *PasswordPolicy) LoadDenyListFile(fs filesystem.FileSystem, path string) error {
+	f, err := fs.Open(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return p.LoadDenyList(f)
+}
+
+// Validate checks a password against the length, character class and deny-list rules.
+func (p *PasswordPolicy) Validate(password string) error {
+	if p == nil {
+		return nil
+	}
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return ErrPasswordTooShort
+	}
+	if _, ok := p.denied[strings.ToLower(password)]; ok {
+		return ErrPasswordDenied
+	}
+	if p.Require != 0 && classes(password)&p.Require != p.Require {
+		return ErrPasswordTooWeak
+	}
+	return nil
+}
+
+// Expired reports whether the password of u is older than MaxAge.
+func (p *PasswordPolicy) Expired(u *User) bool {
+	return p != nil && p.MaxAge > 0 && time.Since(u.passwordChanged) > p.MaxAge
+}
+
+func classes(password string) CharClass {
+	var c CharClass
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			c |= ClassLower
+		case unicode.IsUpper(r):
+			c |= ClassUpper
+		case unicode.IsDigit(r):
+			c |= ClassDigit
+		default:
+			c |= ClassSymbol
+		}
+	}
+	return c
+}
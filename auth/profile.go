@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"maps"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// DisplayName returns the name of the user meant for display, empty if it isn't set.
+func (u *User) DisplayName() string {
+	return u.displayName
+}
+
+// Email returns the email address of the user, empty if it isn't set.
+func (u *User) Email() string {
+	return u.email
+}
+
+// Disabled reports whether the account is disabled, which prevents the user from logging in.
+func (u *User) Disabled() bool {
+	return u.disabled
+}
+
+// Expires returns the time after which the account can't be used anymore, zero if it doesn't expire.
+func (u *User) Expires() time.Time {
+	return u.expires
+}
+
+// Expired reports whether the account has expired.
+func (u *User) Expired() bool {
+	return !u.expires.IsZero() && time.Now().After(u.expires)
+}
+
+// Attribute returns a custom attribute of the user.
+func (u *User) Attribute(key string) (string, bool) {
+	v, ok := u.attrs()[key]
+	return v, ok
+}
+
+// Attributes returns a copy of the custom attributes of the user.
+func (u *User) Attributes() map[string]string {
+	return maps.Clone(u.attrs())
+}
+
+// attrs returns the custom attributes of the user, which must not be modified.
+func (u *User) attrs() map[string]string {
+	if p := u.attributes.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// active returns why the account of a user can't be used, if it can't.
+func (a *Auth) active(u *User) error {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return u.active()
+}
+
+// active is Auth.active for callers holding the lock.
+func (u *User) active() error {
+	if u.disabled {
+		return ErrAccountDisabled
+	}
+	if u.Expired() {
+		return ErrAccountExpired
+	}
+	return nil
+}
+
+func (a *Auth) SetDisplayName(usernameOrId, name string) error {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return ErrUserNotFound
+	}
+	a.lock.Lock()
+	u.displayName = name
+	a.lock.Unlock()
+	return a.persistUser(u)
+}
+
+// SetEmail sets the email address of a user, which must not belong to another user. An empty address removes it.
+func (a *Auth) SetEmail(usernameOrId, email string) error {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return ErrUserNotFound
+	}
+	if email != "" && !validEmail(email) {
+		return ErrInvalidEmail
+	}
+
+	key := strings.ToLower(email)
+	a.lock.Lock()
+	if other, ok := a.emails[key]; ok && other != u && key != "" {
+		a.lock.Unlock()
+		return ErrEmailInUse
+	}
+	delete(a.emails, strings.ToLower(u.email))
+	u.email = email
+	if key != "" {
+		a.emails[key] = u
+	}
+	a.lock.Unlock()
+
+	return a.persistUser(u)
+}
+
+// GetUserByEmail returns the user with an email address, compared case-insensitively.
+func (a *Auth) GetUserByEmail(email string) (*User, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	u, ok := a.emails[strings.ToLower(email)]
+	return u, ok
+}
+
+// SetDisabled disables or enables an account. Disabled users can't log in, use their sessions or API keys.
+func (a *Auth) SetDisabled(usernameOrId string, disabled bool) error {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return ErrUserNotFound
+	}
+	a.lock.Lock()
+	u.disabled = disabled
+	a.lock.Unlock()
+
+	if err := a.persistUser(u); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: UserChanged, User: u.id})
+	action := AuditEnableUser
+	if disabled {
+		action = AuditDisableUser
+	}
+	return a.audit(AuditEvent{Action: action, Subject: u.username})
+}
+
+// SetExpiry sets when an account expires, like a disabled one. The zero time means never.
+func (a *Auth) SetExpiry(usernameOrId string, expires time.Time) error {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return ErrUserNotFound
+	}
+	a.lock.Lock()
+	u.expires = expires
+	a.lock.Unlock()
+
+	if err := a.persistUser(u); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: UserChanged, User: u.id})
+	detail := "never"
+	if !expires.IsZero() {
+		detail = expires.Format(time.RFC3339)
+	}
+	return a.audit(AuditEvent{Action: AuditUserExpiry, Subject: u.username, Detail: detail})
+}
+
+// SetAttribute sets a custom attribute of a user. An empty value removes it. Attributes are available
+// to the conditions of the Policy.
+func (a *Auth) SetAttribute(usernameOrId, key, value string) error {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return ErrUserNotFound
+	}
+	// the map may be read without the lock, so it is copied rather than modified
+	a.lock.Lock()
+	attrs := maps.Clone(u.attrs())
+	if value == "" {
+		delete(attrs, key)
+	} else {
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+		attrs[key] = value
+	}
+	u.attributes.Store(&attrs)
+	a.lock.Unlock()
+
+	if err := a.persistUser(u); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: UserChanged, User: u.id})
+	return nil
+}
+
+// validEmail reports whether email is a bare address, without a name or angle brackets.
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/another-d-mention/unicomplex/crypt/box"
+	"github.com/google/uuid"
+)
+
+// SetSecretKey sets the key used to sign tokens and to encrypt TOTP secrets. It isn't stored, so it has
+// to be kept elsewhere and set again after Open. New generates a random one, with which sessions and reset
+// tokens only last as long as the process, and EnrollTOTP fails with ErrSecretKeyNotSet since the TOTP
+// secrets would be lost with it.
+func (a *Auth) SetSecretKey(key box.Key) error {
+	if !box.KeyIsSuitable(key) {
+		return ErrInvalidKey
+	}
+	a.lock.Lock()
+	a.secret = key
+	a.secretSet = true
+	a.lock.Unlock()
+	return nil
+}
+
+func (a *Auth) secretKey() box.Key {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.secret
+}
+
+// IssueResetToken returns a token that lets the user set a new password without knowing the
+// current one, until ttl passes. Only the last issued token is valid, and only once.
+func (a *Auth) IssueResetToken(usernameOrId string, ttl time.Duration) (string, error) {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return "", ErrUserNotFound
+	}
+
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+	u.resetNonce = nonce[:]
+	if err := a.persistUser(u); err != nil {
+		return "", err
+	}
+
+	// <user id>.<expiry>.<nonce>.<signature>
+	message := u.id.String() + "." + strconv.FormatInt(time.Now().Add(ttl).Unix(), 10) + "." + hex.EncodeToString(nonce[:])
+	return message + "." + box.Sign(message, a.secretKey()), nil
+}
+
+// ResetPassword sets a new password for the user a token was issued to, subject to the password policy.
+func (a *Auth) ResetPassword(token, newPassword string) error {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 || !box.Verify(token[:i], token[i+1:], a.secretKey()) {
+		return ErrInvalidToken
+	}
+	parts := strings.Split(token[:i], ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+	id, err := uuid.Parse(parts[0])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	nonce, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	u, ok := a.GetUser(id.String())
+	if !ok || len(u.resetNonce) == 0 || subtle.ConstantTimeCompare(u.resetNonce, nonce) != 1 {
+		return ErrInvalidToken
+	}
+	if time.Now().Unix() > expires {
+		return ErrTokenExpired
+	}
+	return a.setPassword(u, newPassword)
+}
+
+// RequirePasswordChange sets or clears the flag forcing a user to change the password at next login.
+// The flag is cleared whenever the password changes.
+func (a *Auth) RequirePasswordChange(usernameOrId string, required bool) error {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return ErrUserNotFound
+	}
+	u.mustChange = required
+	return a.persistUser(u)
+}
@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"path"
+	"slices"
+
+	"github.com/another-d-mention/unicomplex/encoding/msgpack"
+)
+
+// Resources form a tree of slash-separated paths like "/projects/x/docs", whose root "/" is guarded by
+// the root ACL. Any other node can have an ACL of its own; the permission of a subject on a resource
+// merges the grants of every ACL from that resource up to the root, minus all their denies. A node
+// blocking inheritance stops the walk, so the ACLs of its parents don't apply to it or below it.
+type resource struct {
+	acl   *ACL
+	block bool
+}
+
+// cleanResource returns the canonical form of a resource path.
+func cleanResource(resourcePath string) string {
+	return path.Clean("/" + resourcePath)
+}
+
+// Resources returns the paths of the resources that have an ACL or block inheritance, sorted.
+func (a *Auth) Resources() []string {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	list := make([]string, 0, len(a.resources))
+	for p := range a.resources {
+		list = append(list, p)
+	}
+	slices.Sort(list)
+	return list
+}
+
+// ResourceACL returns the ACL attached to a resource, the root ACL for "/", or nil if it has none.
+func (a *Auth) ResourceACL(resourcePath string) *ACL {
+	resourcePath = cleanResource(resourcePath)
+	if resourcePath == "/" {
+		return a.acl
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if r, ok := a.resources[resourcePath]; ok {
+		return r.acl
+	}
+	return nil
+}
+
+// SetResourceACL attaches acl to a resource, replacing its previous ACL. A nil acl detaches it.
+// The root ACL can't be replaced, and an ACL can only be attached to one resource.
+func (a *Auth) SetResourceACL(resourcePath string, acl *ACL) error {
+	resourcePath = cleanResource(resourcePath)
+	if resourcePath == "/" || acl == a.acl {
+		return ErrInvalidResource
+	}
+
+	a.lock.Lock()
+	if acl != nil {
+		for p, r := range a.resources {
+			if r.acl == acl && p != resourcePath {
+				a.lock.Unlock()
+				return ErrInvalidResource
+			}
+		}
+	}
+	r, ok := a.resources[resourcePath]
+	if !ok {
+		if acl == nil {
+			a.lock.Unlock()
+			return nil
+		}
+		r = &resource{}
+		a.resources[resourcePath] = r
+	}
+	r.acl = acl
+	a.lock.Unlock()
+
+	if err := a.persistResource(resourcePath, r); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: ResourceChanged, Resource: resourcePath})
+	return nil
+}
+
+// SetResourceInheritance sets whether a resource inherits the ACLs of its parents, which is the default.
+func (a *Auth) SetResourceInheritance(resourcePath string, inherit bool) error {
+	resourcePath = cleanResource(resourcePath)
+	if resourcePath == "/" {
+		return ErrInvalidResource
+	}
+
+	a.lock.Lock()
+	r, ok := a.resources[resourcePath]
+	if !ok {
+		if inherit {
+			a.lock.Unlock()
+			return nil
+		}
+		r = &resource{}
+		a.resources[resourcePath] = r
+	}
+	r.block = !inherit
+	a.lock.Unlock()
+
+	if err := a.persistResource(resourcePath, r); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: ResourceChanged, Resource: resourcePath})
+	return nil
+}
+
+// DeleteResource removes the ACL and the inheritance setting of a resource. Its children are kept.
+func (a *Auth) DeleteResource(resourcePath string) error {
+	resourcePath = cleanResource(resourcePath)
+
+	a.lock.Lock()
+	_, ok := a.resources[resourcePath]
+	delete(a.resources, resourcePath)
+	a.lock.Unlock()
+	if !ok {
+		return ErrResourceNotFound
+	}
+
+	if err := a.persist(recordDeleteResource, []byte(resourcePath)); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: ResourceChanged, Resource: resourcePath})
+	return nil
+}
+
+// resourceScope returns the paths whose ACLs and role assignments apply to a resource, from the
+// resource up to the root or to the first resource blocking inheritance.
+func (a *Auth) resourceScope(resourcePath string) []string {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var scope []string
+	for p := cleanResource(resourcePath); ; p = path.Dir(p) {
+		scope = append(scope, p)
+		if r, ok := a.resources[p]; p == "/" || (ok && r.block) {
+			return scope
+		}
+	}
+}
+
+// resourceChain returns the ACLs that apply to a resource, from the resource up to the root.
+func (a *Auth) resourceChain(resourcePath string) []*ACL {
+	var chain []*ACL
+	for _, p := range a.resourceScope(resourcePath) {
+		if acl := a.ResourceACL(p); acl != nil {
+			chain = append(chain, acl)
+		}
+	}
+	return chain
+}
+
+// ResourcePermission returns the permissions of a user, a group or an API key on a resource, granted
+// by the ACLs or by the roles it has there.
+func (a *Auth) ResourcePermission(resourcePath, nameOrId string) (Permission, bool) {
+	granted := a.RolePermission(nameOrId, resourcePath)
+	denied := Permission(0)
+	scope := Permission(0).SetAll()
+	found := granted != 0
+	for _, acl := range a.resourceChain(resourcePath) {
+		e, ok, err := a.explain(acl, nameOrId)
+		if err != nil {
+			return Permission(0), false
+		}
+		found = found || ok
+		for _, entry := range e.Entries {
+			switch entry.Kind {
+			case EntryGrant:
+				granted |= entry.Effect
+			case EntryDeny:
+				denied |= entry.Mask
+			case EntryScope:
+				scope = entry.Mask
+			}
+		}
+	}
+
+	if k, ok := a.apiKeySubject(nameOrId); ok {
+		scope &= k.scopes // the ACLs only scope the grants they hold, not those of the roles
+	}
+	p := granted &^ denied & scope
+	return p, found && p != 0
+}
+
+// Check tells whether a user, a group or an API key has all the permissions in perm on a resource.
+func (a *Auth) Check(nameOrId, resourcePath string, perm Permission) bool {
+	p, ok := a.ResourcePermission(resourcePath, nameOrId)
+	return ok && p&perm == perm
+}
+
+// ---------------- JOURNAL ---------------
+
+// resourceOf returns the resource acl is attached to, and its path.
+func (a *Auth) resourceOf(acl *ACL) (string, *resource, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	for p, r := range a.resources {
+		if r.acl == acl {
+			return p, r, true
+		}
+	}
+	return "", nil, false
+}
+
+// persistResource journals a resource, or drops it when it has neither an ACL nor blocks inheritance.
+func (a *Auth) persistResource(resourcePath string, r *resource) error {
+	if r.acl == nil && !r.block {
+		a.lock.Lock()
+		delete(a.resources, resourcePath)
+		a.lock.Unlock()
+		return a.persist(recordDeleteResource, []byte(resourcePath))
+	}
+	if a.store == nil {
+		return nil
+	}
+
+	data, err := msgpack.Marshal(r.record(resourcePath))
+	if err != nil {
+		return err
+	}
+	return a.persist(recordResource, data)
+}
+
+func (r *resource) record(resourcePath string) resourceRecord {
+	rec := resourceRecord{Path: resourcePath, Block: r.block}
+	if r.acl != nil {
+		acl := r.acl.record()
+		rec.ACL = &acl
+	}
+	return rec
+}
+
+func resourceFromRecord(rec resourceRecord) (string, *resource) {
+	r := &resource{block: rec.Block}
+	if rec.ACL != nil {
+		r.acl = NewACL()
+		r.acl.setRecord(*rec.ACL)
+	}
+	return cleanResource(rec.Path), r
+}
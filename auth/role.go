@@ -0,0 +1,529 @@
+package auth
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/another-d-mention/unicomplex/encoding/msgpack"
+	"github.com/google/uuid"
+)
+
+// Role is a named bundle of permissions. Roles are assigned to users and groups, either everywhere
+// or on a resource and the resources below it, and a role inherits the permissions of its parents.
+// Role permissions are merged with the grants of the resource ACLs by Check.
+type Role struct {
+	id          uuid.UUID
+	name        string
+	permissions Permission
+	parents     []uuid.UUID
+}
+
+func (r *Role) ID() uuid.UUID {
+	return r.id
+}
+
+func (r *Role) Name() string {
+	return r.name
+}
+
+// Permissions returns the permissions of the role itself, without those of its parents.
+func (r *Role) Permissions() Permission {
+	return r.permissions
+}
+
+// ParentIDs returns the IDs of the roles this role inherits from.
+func (r *Role) ParentIDs() []uuid.UUID {
+	return slices.Clone(r.parents)
+}
+
+// RoleAssignment gives a role to a user or a group on a resource ("/" for everywhere).
+type RoleAssignment struct {
+	Role     uuid.UUID
+	Subject  uuid.UUID
+	Group    bool
+	Resource string
+}
+
+func (a *Auth) Roles() []*Role {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	list := make([]*Role, 0, len(a.roles))
+	for _, r := range a.roles {
+		list = append(list, r)
+	}
+	return list
+}
+
+func (a *Auth) AddRole(name string, permissions Permission) error {
+	if _, ok := a.GetRole(name); ok {
+		return ErrRoleAlreadyExists
+	}
+
+	r := &Role{id: uuid.New(), name: name, permissions: permissions}
+
+	a.lock.Lock()
+	a.roles[r.name] = r
+	a.lock.Unlock()
+
+	if err := a.persistRole(r); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: RoleChanged, Role: r.id})
+	return a.audit(AuditEvent{Action: AuditAddRole, Role: r.name, Permission: permissions})
+}
+
+func (a *Auth) GetRole(nameOrId string) (*Role, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if r, ok := a.roles[nameOrId]; ok {
+		return r, true
+	}
+	if id, err := uuid.Parse(nameOrId); err == nil {
+		for _, r := range a.roles {
+			if r.id == id {
+				return r, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// DeleteRole deletes a role along with its assignments. The roles inheriting from it lose its permissions.
+func (a *Auth) DeleteRole(nameOrId string) error {
+	r, ok := a.GetRole(nameOrId)
+	if !ok {
+		return ErrRoleNotFound
+	}
+
+	a.lock.Lock()
+	delete(a.roles, r.name)
+	var children []*Role
+	for _, child := range a.roles {
+		if i := slices.Index(child.parents, r.id); i >= 0 {
+			child.parents = slices.Delete(child.parents, i, i+1)
+			children = append(children, child)
+		}
+	}
+	a.deleteAssignments(func(ra RoleAssignment) bool { return ra.Role == r.id })
+	a.lock.Unlock()
+
+	for _, child := range children {
+		if err := a.persistRole(child); err != nil {
+			return err
+		}
+	}
+	if err := a.persist(recordDeleteRole, r.id[:]); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: RoleDeleted, Role: r.id})
+	return a.audit(AuditEvent{Action: AuditDeleteRole, Role: r.name})
+}
+
+func (a *Auth) SetRolePermissions(nameOrId string, permissions Permission) error {
+	r, ok := a.GetRole(nameOrId)
+	if !ok {
+		return ErrRoleNotFound
+	}
+
+	a.lock.Lock()
+	r.permissions = permissions
+	a.lock.Unlock()
+
+	if err := a.persistRole(r); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: RoleChanged, Role: r.id})
+	return a.audit(AuditEvent{Action: AuditRolePermissions, Role: r.name, Permission: permissions})
+}
+
+// AddRoleToRole makes child inherit the permissions of parent, so that whoever has child also has parent.
+// It fails with ErrRoleCycle if parent already inherits from child, directly or not.
+func (a *Auth) AddRoleToRole(child, parent string) error {
+	c, ok := a.GetRole(child)
+	if !ok {
+		return ErrRoleNotFound
+	}
+	p, ok := a.GetRole(parent)
+	if !ok {
+		return ErrRoleNotFound
+	}
+
+	a.lock.Lock()
+	if slices.Contains(c.parents, p.id) {
+		a.lock.Unlock()
+		return nil
+	}
+	if c.id == p.id || a.roleAncestors(map[uuid.UUID]bool{p.id: true})[c.id] {
+		a.lock.Unlock()
+		return ErrRoleCycle
+	}
+	c.parents = append(c.parents, p.id)
+	a.lock.Unlock()
+
+	if err := a.persistRole(c); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: RoleChanged, Role: c.id})
+	return a.audit(AuditEvent{Action: AuditRoleInherit, Role: c.name, Detail: p.name})
+}
+
+func (a *Auth) RemoveRoleFromRole(child, parent string) error {
+	c, ok := a.GetRole(child)
+	if !ok {
+		return ErrRoleNotFound
+	}
+	p, ok := a.GetRole(parent)
+	if !ok {
+		return ErrRoleNotFound
+	}
+
+	a.lock.Lock()
+	i := slices.Index(c.parents, p.id)
+	if i < 0 {
+		a.lock.Unlock()
+		return nil
+	}
+	c.parents = slices.Delete(c.parents, i, i+1)
+	a.lock.Unlock()
+
+	if err := a.persistRole(c); err != nil {
+		return err
+	}
+	a.publish(ChangeEvent{Kind: RoleChanged, Role: c.id})
+	return a.audit(AuditEvent{Action: AuditRoleDisinherit, Role: c.name, Detail: p.name})
+}
+
+// roleAncestors returns the given roles and all the roles they inherit from. a.lock must be held.
+func (a *Auth) roleAncestors(roles map[uuid.UUID]bool) map[uuid.UUID]bool {
+	byID := make(map[uuid.UUID]*Role, len(a.roles))
+	for _, r := range a.roles {
+		byID[r.id] = r
+	}
+
+	seen := make(map[uuid.UUID]bool, len(roles))
+	queue := slices.Collect(maps.Keys(roles))
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		r, ok := byID[id]
+		if !ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		queue = append(queue, r.parents...)
+	}
+	return seen
+}
+
+// ---------------- ASSIGNMENTS ---------------
+
+// AssignRole gives a role to a user or a group on a resource and the resources below it.
+// An empty resource path means everywhere.
+func (a *Auth) AssignRole(nameOrId, role, resourcePath string) error {
+	ra, err := a.assignment(nameOrId, role, resourcePath)
+	if err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	_, exists := a.assignments[ra]
+	a.assignments[ra] = struct{}{}
+	a.lock.Unlock()
+
+	if exists {
+		return nil
+	}
+	if err := a.persistAssignment(recordAssignRole, ra); err != nil {
+		return err
+	}
+	a.publish(ra.changeEvent())
+	return a.auditRole(AuditAssignRole, ra)
+}
+
+// UnassignRole takes back a role given by AssignRole.
+func (a *Auth) UnassignRole(nameOrId, role, resourcePath string) error {
+	ra, err := a.assignment(nameOrId, role, resourcePath)
+	if err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	_, exists := a.assignments[ra]
+	delete(a.assignments, ra)
+	a.lock.Unlock()
+
+	if !exists {
+		return nil
+	}
+	if err := a.persistAssignment(recordUnassignRole, ra); err != nil {
+		return err
+	}
+	a.publish(ra.changeEvent())
+	return a.auditRole(AuditUnassignRole, ra)
+}
+
+func (a *Auth) assignment(nameOrId, role, resourcePath string) (RoleAssignment, error) {
+	r, ok := a.GetRole(role)
+	if !ok {
+		return RoleAssignment{}, ErrRoleNotFound
+	}
+	ra := RoleAssignment{Role: r.id, Resource: cleanResource(resourcePath)}
+	if u, ok := a.GetUser(nameOrId); ok {
+		ra.Subject = u.id
+	} else if g, ok := a.GetGroup(nameOrId); ok {
+		ra.Subject, ra.Group = g.id, true
+	} else {
+		return RoleAssignment{}, ErrUserNotFound
+	}
+	return ra, nil
+}
+
+// RoleAssignments returns the roles given directly to a user or a group, on any resource.
+func (a *Auth) RoleAssignments(nameOrId string) []RoleAssignment {
+	var id uuid.UUID
+	if u, ok := a.GetUser(nameOrId); ok {
+		id = u.id
+	} else if g, ok := a.GetGroup(nameOrId); ok {
+		id = g.id
+	} else {
+		return nil
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	var list []RoleAssignment
+	for ra := range a.assignments {
+		if ra.Subject == id {
+			list = append(list, ra)
+		}
+	}
+	slices.SortFunc(list, func(x, y RoleAssignment) int {
+		if c := strings.Compare(x.Resource, y.Resource); c != 0 {
+			return c
+		}
+		return bytes.Compare(x.Role[:], y.Role[:])
+	})
+	return list
+}
+
+// deleteAssignments deletes the assignments matching f. a.lock must be held.
+func (a *Auth) deleteAssignments(f func(RoleAssignment) bool) {
+	for ra := range a.assignments {
+		if f(ra) {
+			delete(a.assignments, ra)
+		}
+	}
+}
+
+// EffectiveRoles returns the roles a user, a group or an API key has on a resource: the roles assigned to
+// it or to its groups on that resource or above, and the roles these inherit from.
+func (a *Auth) EffectiveRoles(nameOrId, resourcePath string) []*Role {
+	ids, ok := a.subjectIDs(nameOrId)
+	if !ok {
+		return nil
+	}
+	scope := a.resourceScope(resourcePath)
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	direct := make(map[uuid.UUID]bool)
+	for ra := range a.assignments {
+		if ids[ra.Subject] && slices.Contains(scope, ra.Resource) {
+			direct[ra.Role] = true
+		}
+	}
+	roles := a.roleAncestors(direct)
+
+	list := make([]*Role, 0, len(roles))
+	for _, r := range a.roles {
+		if roles[r.id] {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// HasRole tells whether a user, a group or an API key has a role on a resource, directly, through its
+// groups or through a role inheriting from it.
+func (a *Auth) HasRole(nameOrId, role, resourcePath string) bool {
+	r, ok := a.GetRole(role)
+	if !ok {
+		return false
+	}
+	for _, effective := range a.EffectiveRoles(nameOrId, resourcePath) {
+		if effective.id == r.id {
+			return true
+		}
+	}
+	return false
+}
+
+// RolePermission returns the permissions granted by the roles a subject has on a resource. API keys
+// are not limited to their scope here; ResourcePermission and Check apply it.
+func (a *Auth) RolePermission(nameOrId, resourcePath string) Permission {
+	var p Permission
+	for _, r := range a.EffectiveRoles(nameOrId, resourcePath) {
+		p |= r.permissions
+	}
+	return p
+}
+
+// subjectIDs returns the IDs a user, a group or the owner of an API key acts as: its own and those
+// of the groups it belongs to, directly or not. Disabled and expired users act as nobody.
+func (a *Auth) subjectIDs(nameOrId string) (map[uuid.UUID]bool, bool) {
+	var id uuid.UUID
+	var groups []uuid.UUID
+	var user *User
+	if u, ok := a.GetUser(nameOrId); ok {
+		user = u
+	} else if g, ok := a.GetGroup(nameOrId); ok {
+		id, groups = g.id, g.ParentIDs()
+	} else if k, ok := a.GetAPIKey(nameOrId); ok && !k.Expired() {
+		if user, ok = a.GetUser(k.owner.String()); !ok {
+			return nil, false
+		}
+	} else {
+		return nil, false
+	}
+	if user != nil {
+		if a.active(user) != nil {
+			return nil, false
+		}
+		id, groups = user.id, user.GroupIDs()
+	}
+
+	a.lock.RLock()
+	ids := a.ancestors(groups)
+	a.lock.RUnlock()
+	ids[id] = true
+	return ids, true
+}
+
+// MigrateACL converts the grants of the users and groups in acl into role assignments on a resource,
+// then removes them from acl; its denies, and the grants of subjects that don't exist anymore, are
+// kept. Every distinct permission becomes a role, reusing a role with the same permissions if there is
+// one, or else creating one named after the permission. Roles are merged like ResolveUnion, so
+// permissions resolved by another mode may change.
+func (a *Auth) MigrateACL(acl *ACL, resourcePath string) ([]RoleAssignment, error) {
+	if acl == nil {
+		acl = a.acl
+	}
+
+	acl.lock.RLock()
+	users, groups := maps.Clone(acl.users), maps.Clone(acl.groups)
+	acl.lock.RUnlock()
+
+	// the grants of users and groups deleted since are left in acl, rather than stopping the migration halfway
+	for id := range users {
+		if _, ok := a.GetUser(id.String()); !ok {
+			delete(users, id)
+		}
+	}
+	for id := range groups {
+		if _, ok := a.GetGroup(id.String()); !ok {
+			delete(groups, id)
+		}
+	}
+
+	var list []RoleAssignment
+	migrate := func(id uuid.UUID, p Permission) error {
+		if p == 0 {
+			return nil
+		}
+		role, err := a.roleFor(p)
+		if err != nil {
+			return err
+		}
+		if err = a.AssignRole(id.String(), role.id.String(), resourcePath); err != nil {
+			return err
+		}
+		ra, _ := a.assignment(id.String(), role.id.String(), resourcePath)
+		list = append(list, ra)
+		return nil
+	}
+	for id, p := range users {
+		if err := migrate(id, p); err != nil {
+			return list, err
+		}
+	}
+	for id, p := range groups {
+		if err := migrate(id, p); err != nil {
+			return list, err
+		}
+	}
+
+	acl.lock.Lock()
+	for id := range users {
+		delete(acl.users, id)
+	}
+	for id := range groups {
+		delete(acl.groups, id)
+	}
+	acl.lock.Unlock()
+
+	if err := a.persistACL(acl); err != nil {
+		return list, err
+	}
+	a.publishACL(acl, uuid.Nil, uuid.Nil)
+	return list, nil
+}
+
+// roleFor returns a role with exactly the permissions p, creating it if needed.
+func (a *Auth) roleFor(p Permission) (*Role, error) {
+	a.lock.RLock()
+	var found *Role
+	for _, r := range a.roles {
+		if r.permissions == p && len(r.parents) == 0 && (found == nil || r.name < found.name) {
+			found = r
+		}
+	}
+	a.lock.RUnlock()
+	if found != nil {
+		return found, nil
+	}
+
+	name := "acl:" + p.String()
+	if err := a.AddRole(name, p); err != nil {
+		return nil, err
+	}
+	r, _ := a.GetRole(name)
+	return r, nil
+}
+
+// ---------------- JOURNAL ---------------
+
+func (a *Auth) persistRole(r *Role) error {
+	if a.store == nil {
+		return nil
+	}
+	data, err := msgpack.Marshal(r.record())
+	if err != nil {
+		return err
+	}
+	return a.persist(recordRole, data)
+}
+
+func (a *Auth) persistAssignment(kind byte, ra RoleAssignment) error {
+	if a.store == nil {
+		return nil
+	}
+	data, err := msgpack.Marshal(assignmentRecord(ra))
+	if err != nil {
+		return err
+	}
+	return a.persist(kind, data)
+}
+
+func (r *Role) record() roleRecord {
+	return roleRecord{ID: r.id, Name: r.name, Permissions: r.permissions, Parents: r.ParentIDs()}
+}
+
+func roleFromRecord(rec roleRecord) *Role {
+	return &Role{id: rec.ID, name: rec.Name, permissions: rec.Permissions, parents: rec.Parents}
+}
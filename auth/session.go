@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/another-d-mention/unicomplex/crypt/box"
+	"github.com/google/uuid"
+)
+
+// Session is a login of a user, identified by the token returned by CreateSession.
+type Session struct {
+	ID       string
+	UserID   uuid.UUID
+	Created  time.Time
+	LastSeen time.Time
+	Expires  time.Time
+	// TTL is how long the session lives after it was last used.
+	TTL time.Duration
+}
+
+// SessionStore keeps the sessions of an Auth. Stores are responsible for dropping expired sessions.
+type SessionStore interface {
+	Get(id string) (Session, bool)
+	Put(s Session) error
+	// Touch records that a session was used at now and extends it by its TTL, reporting false if the
+	// session doesn't exist anymore. It must not bring back a session deleted concurrently.
+	Touch(id string, now time.Time) (bool, error)
+	Delete(id string) error
+	// DeleteUser deletes all the sessions of a user.
+	DeleteUser(userID uuid.UUID) error
+}
+
+// MemorySessionStore is a SessionStore keeping sessions in memory. Expired sessions are swept by a
+// background goroutine until Close is called.
+type MemorySessionStore struct {
+	lock     sync.RWMutex
+	sessions map[string]Session
+	done     chan struct{}
+	once     sync.Once
+}
+
+// DefaultSweepInterval is how often a MemorySessionStore sweeps expired sessions when not told otherwise.
+const DefaultSweepInterval = time.Minute
+
+// NewMemorySessionStore returns a store sweeping expired sessions every sweepInterval, or
+// DefaultSweepInterval if it isn't positive.
+func NewMemorySessionStore(sweepInterval time.Duration) *MemorySessionStore {
+	if sweepInterval <= 0 {
+		sweepInterval = DefaultSweepInterval
+	}
+	s := &MemorySessionStore{
+		sessions: make(map[string]Session),
+		done:     make(chan struct{}),
+	}
+	go s.sweep(sweepInterval)
+	return s
+}
+
+func (s *MemorySessionStore) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.DeleteExpired(now)
+		}
+	}
+}
+
+// DeleteExpired deletes the sessions that expired before now.
+func (s *MemorySessionStore) DeleteExpired(now time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, session := range s.sessions {
+		if now.After(session.Expires) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// Close stops the background sweeping.
+func (s *MemorySessionStore) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *MemorySessionStore) Get(id string) (Session, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	session, ok := s.sessions[id]
+	return session, ok
+}
+
+func (s *MemorySessionStore) Put(session Session) error {
+	s.lock.Lock()
+	s.sessions[session.ID] = session
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemorySessionStore) Touch(id string, now time.Time) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return false, nil
+	}
+	session.LastSeen = now
+	session.Expires = now.Add(session.TTL)
+	s.sessions[id] = session
+	return true, nil
+}
+
+func (s *MemorySessionStore) Delete(id string) error {
+	s.lock.Lock()
+	delete(s.sessions, id)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteUser(userID uuid.UUID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, session := range s.sessions {
+		if session.UserID == userID {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+// sessionPrefix keeps session signatures apart from the other tokens signed with the same key.
+const sessionPrefix = "session:"
+
+// SetSessionStore sets where sessions are kept. Without one, a MemorySessionStore sweeping every
+// DefaultSweepInterval is created on first use, and stopped by Close.
+func (a *Auth) SetSessionStore(store SessionStore) {
+	a.lock.Lock()
+	a.sessions = store
+	a.lock.Unlock()
+}
+
+func (a *Auth) sessionStore() SessionStore {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.sessions == nil {
+		a.ownSessions = NewMemorySessionStore(DefaultSweepInterval)
+		a.sessions = a.ownSessions
+	}
+	return a.sessions
+}
+
+// Close stops the sweeping of the session store created when none was set with SetSessionStore.
+// Stores set with SetSessionStore are left to their owner.
+func (a *Auth) Close() error {
+	a.lock.Lock()
+	store := a.ownSessions
+	a.ownSessions = nil
+	a.lock.Unlock()
+	if store == nil {
+		return nil
+	}
+	return store.Close()
+}
+
+// CreateSession starts a session for a user and returns its token. The session expires once it
+// hasn't been validated for ttl.
+func (a *Auth) CreateSession(usernameOrId string, ttl time.Duration) (string, error) {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return "", ErrUserNotFound
+	}
+
+	var id [32]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	session := Session{
+		ID:       hex.EncodeToString(id[:]),
+		UserID:   u.id,
+		Created:  now,
+		LastSeen: now,
+		Expires:  now.Add(ttl),
+		TTL:      ttl,
+	}
+	if err := a.sessionStore().Put(session); err != nil {
+		return "", err
+	}
+	return session.ID + "." + box.Sign(sessionPrefix+session.ID, a.secretKey()), nil
+}
+
+// ValidateSession returns the user a session token belongs to and extends the session by its TTL.
+func (a *Auth) ValidateSession(token string) (*User, error) {
+	id, ok := a.sessionID(token)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	store := a.sessionStore()
+	session, ok := store.Get(id)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	now := time.Now()
+	if now.After(session.Expires) {
+		_ = store.Delete(id)
+		return nil, ErrSessionExpired
+	}
+	u, ok := a.GetUser(session.UserID.String())
+	if !ok {
+		_ = store.Delete(id)
+		return nil, ErrUserNotFound
+	}
+	if err := a.active(u); err != nil {
+		return nil, err
+	}
+
+	// a session revoked meanwhile must stay revoked, so it is only extended if it still exists
+	touched, err := store.Touch(id, now)
+	if err != nil {
+		return nil, err
+	}
+	if !touched {
+		return nil, ErrInvalidToken
+	}
+	return u, nil
+}
+
+// RevokeSession ends the session of a token.
+func (a *Auth) RevokeSession(token string) error {
+	id, ok := a.sessionID(token)
+	if !ok {
+		return ErrInvalidToken
+	}
+	return a.sessionStore().Delete(id)
+}
+
+// RevokeAllForUser ends all the sessions of a user.
+func (a *Auth) RevokeAllForUser(usernameOrId string) error {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return ErrUserNotFound
+	}
+	return a.sessionStore().DeleteUser(u.id)
+}
+
+// revokeUserSessions ends all the sessions of u, if any store was set or created.
+func (a *Auth) revokeUserSessions(u *User) error {
+	a.lock.RLock()
+	store := a.sessions
+	a.lock.RUnlock()
+	if store == nil {
+		return nil
+	}
+	return store.DeleteUser(u.id)
+}
+
+// sessionID returns the session id of a token if its signature is valid.
+func (a *Auth) sessionID(token string) (string, bool) {
+	id, signature, ok := strings.Cut(token, ".")
+	if !ok || !box.Verify(sessionPrefix+id, signature, a.secretKey()) {
+		return "", false
+	}
+	return id, true
+}
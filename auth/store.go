@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/another-d-mention/unicomplex/crypt/hashing"
+	"github.com/another-d-mention/unicomplex/filesystem"
+)
+
+const (
+	recordLegacyUser byte = iota + 1
+	recordDeleteUser
+	recordLegacyGroup
+	recordDeleteGroup
+	recordLegacyACL
+	recordUser
+	recordGroup
+	recordACL
+	recordAPIKey
+	recordDeleteAPIKey
+	recordResource
+	recordDeleteResource
+	recordRole
+	recordDeleteRole
+	recordAssignRole
+	recordUnassignRole
+)
+
+// compactAfter is the number of journal records after which a new snapshot is saved.
+const compactAfter = 1024
+
+// Store persists the state of an Auth as a snapshot followed by a journal of the changes made since
+// that snapshot was saved.
+type Store interface {
+	// Load returns the last saved snapshot (nil if there is none) and the journal records appended after it.
+	Load() (snapshot []byte, journal [][]byte, err error)
+	// Save atomically replaces the snapshot and empties the journal.
+	Save(snapshot []byte) error
+	// Append durably adds a record to the journal.
+	Append(record []byte) error
+}
+
+// FileStore is a Store keeping the snapshot and the journal in two files of a filesystem.FileSystem.
+// Snapshots are written to a temporary file that is renamed over the previous one, and every journal
+// record is checksummed, so an interrupted write never leaves a half-written database behind.
+type FileStore struct {
+	lock sync.Mutex
+	fs   filesystem.FileSystem
+	path string
+}
+
+func NewFileStore(fs filesystem.FileSystem, path string) *FileStore {
+	return &FileStore{fs: fs, path: path}
+}
+
+func (s *FileStore) journalPath() string {
+	return s.path + ".journal"
+}
+
+func (s *FileStore) Load() ([]byte, [][]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var snapshot []byte
+	if s.fs.Exists(s.path) {
+		data, err := s.fs.ReadFile(s.path)
+		if err != nil {
+			return nil, nil, err
+		}
+		snapshot = data
+	}
+
+	if !s.fs.Exists(s.journalPath()) {
+		return snapshot, nil, nil
+	}
+	data, err := s.fs.ReadFile(s.journalPath())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// each record is framed as: uint32 length, crc32 of the payload, payload.
+	// A short or corrupt frame can only be the result of an interrupted append, so it ends the journal.
+	var journal [][]byte
+	rest := data
+	for len(rest) >= 8 {
+		size := binary.BigEndian.Uint32(rest)
+		if uint64(len(rest)-8) < uint64(size) {
+			break
+		}
+		record := rest[8 : 8+size]
+		if !bytes.Equal(rest[4:8], hashing.NewCRC32Hasher().Bytes(record)) {
+			break
+		}
+		journal = append(journal, record)
+		rest = rest[8+size:]
+	}
+	good := len(data) - len(rest)
+
+	// cut the torn tail off, or the records appended after it would never be read back
+	if good < len(data) {
+		tmp := s.journalPath() + ".tmp"
+		if err = writeSynced(s.fs, tmp, data[:good], os.O_CREATE|os.O_TRUNC|os.O_WRONLY); err != nil {
+			_ = s.fs.Remove(tmp)
+			return nil, nil, err
+		}
+		if err = s.fs.Rename(tmp, s.journalPath()); err != nil {
+			return nil, nil, err
+		}
+	}
+	return snapshot, journal, nil
+}
+
+func (s *FileStore) Save(snapshot []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tmp := s.path + ".tmp"
+	if err := writeSynced(s.fs, tmp, snapshot, os.O_CREATE|os.O_TRUNC|os.O_WRONLY); err != nil {
+		_ = s.fs.Remove(tmp)
+		return err
+	}
+	if err := s.fs.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	// replaying the journal over the new snapshot is harmless, so a crash right here loses nothing
+	if s.fs.Exists(s.journalPath()) {
+		return s.fs.Remove(s.journalPath())
+	}
+	return nil
+}
+
+func (s *FileStore) Append(record []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	frame := make([]byte, 8, 8+len(record))
+	binary.BigEndian.PutUint32(frame, uint32(len(record)))
+	copy(frame[4:], hashing.NewCRC32Hasher().Bytes(record))
+	frame = append(frame, record...)
+
+	return writeSynced(s.fs, s.journalPath(), frame, os.O_CREATE|os.O_WRONLY)
+}
+
+// writeSynced writes data to a file, at its end unless flags truncate it, and syncs it.
+func writeSynced(fs filesystem.FileSystem, path string, data []byte, flags int) error {
+	f, err := fs.Open(path, flags, 0600)
+	if err != nil {
+		return err
+	}
+	if flags&os.O_TRUNC == 0 {
+		if _, err = f.Seek(0, io.SeekEnd); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,304 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/another-d-mention/unicomplex/network"
+)
+
+// LockoutPolicy controls how Authenticate slows down and stops repeated failed logins.
+type LockoutPolicy struct {
+	// FreeAttempts is the number of failures allowed before any delay is imposed.
+	FreeAttempts int
+	// BaseDelay is the wait imposed after the first failure past FreeAttempts. It doubles with
+	// every further failure, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockAfter is the number of failures after which the account is locked for LockDuration.
+	// Zero disables locking. Failures from a client IP are forgotten after LockDuration too.
+	LockAfter    int
+	LockDuration time.Duration
+}
+
+var DefaultLockoutPolicy = LockoutPolicy{
+	FreeAttempts: 3,
+	BaseDelay:    time.Second,
+	MaxDelay:     5 * time.Minute,
+	LockAfter:    10,
+	LockDuration: 30 * time.Minute,
+}
+
+// delay returns how long to wait after the last of n consecutive failures.
+func (p LockoutPolicy) delay(n int) time.Duration {
+	if n <= p.FreeAttempts || p.BaseDelay <= 0 {
+		return 0
+	}
+	d := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < n && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, p.MaxDelay)
+}
+
+type attempts struct {
+	count int
+	last  time.Time
+}
+
+// throttle tracks the failed logins from client IPs. It is kept in memory only.
+type throttle struct {
+	lock sync.Mutex
+	ips  map[string]*attempts
+}
+
+// sweepAfter is the number of tracked IPs at which forgotten entries are dropped.
+const sweepAfter = 4096
+
+// reserve counts an attempt from ip as failed before it is checked, so that concurrent attempts can't
+// all get past the delay, and returns how long to wait if it is too early for another attempt.
+// The attempt is undone by release if it succeeds.
+func (t *throttle) reserve(ip string, policy LockoutPolicy, now time.Time) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if at, ok := t.ips[ip]; ok {
+		if wait := at.last.Add(policy.delay(at.count)).Sub(now); wait > 0 {
+			return wait
+		}
+	}
+
+	if t.ips == nil {
+		t.ips = make(map[string]*attempts)
+	}
+	if len(t.ips) >= sweepAfter {
+		for k, at := range t.ips {
+			if now.Sub(at.last) > policy.LockDuration {
+				delete(t.ips, k)
+			}
+		}
+	}
+
+	at, ok := t.ips[ip]
+	if !ok || now.Sub(at.last) > policy.LockDuration {
+		at = &attempts{}
+		t.ips[ip] = at
+	}
+	at.count++
+	at.last = now
+	return 0
+}
+
+func (t *throttle) release(ip string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if at, ok := t.ips[ip]; ok && at.count > 0 {
+		at.count--
+	}
+}
+
+// SetLockoutPolicy sets the policy applied by Authenticate.
+func (a *Auth) SetLockoutPolicy(policy LockoutPolicy) {
+	a.lock.Lock()
+	a.lockout = policy
+	a.lock.Unlock()
+}
+
+func (a *Auth) LockoutPolicy() LockoutPolicy {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.lockout
+}
+
+// Authenticate verifies the credentials of a user, keeping track of failures per user and per client
+// IP (taken from r, which can be nil). Repeated failures from a client make its next attempts fail with
+// ErrThrottled until a delay passes. Repeated failures for a user delay its next attempts too, and
+// eventually lock the account for a while; meanwhile they fail with ErrInvalidCredentials like for an
+// unknown username, and the audit log records why.
+//
+// A wrong username or password both result in ErrInvalidCredentials, and take as long. Right credentials
+// of a disabled or expired account result in ErrAccountDisabled or ErrAccountExpired. If the credentials
+// are right but the user has TOTP enabled, the user is returned along with ErrSecondFactorRequired, and
+// the login must be completed with VerifyTOTP. If the password must be changed, the user is returned
+// along with ErrPasswordChangeRequired.
+func (a *Auth) Authenticate(username, password string, r *http.Request) (*User, error) {
+	u, err := a.authenticate(username, password, r)
+
+	e := AuditEvent{Action: AuditLoginSuccess, Subject: username, IP: network.GetClientIP(r)}
+	if u == nil {
+		e.Action = AuditLoginFailure
+	} else {
+		if errors.Is(err, ErrSecondFactorRequired) {
+			e.Action = AuditLoginPassword
+		}
+		e.Subject = u.username
+	}
+	if err != nil {
+		e.Detail = err.Error()
+	}
+	if auditErr := a.audit(e); auditErr != nil {
+		return nil, auditErr
+	}
+	var blocked accountBlocked
+	if errors.As(err, &blocked) {
+		return nil, ErrInvalidCredentials
+	}
+	return u, err
+}
+
+// accountBlocked is returned by authenticate for an account that is locked or must wait before another
+// attempt. Only existing users can be blocked, so callers are told ErrInvalidCredentials instead.
+type accountBlocked struct {
+	err error
+}
+
+func (e accountBlocked) Error() string {
+	return e.err.Error()
+}
+
+func (e accountBlocked) Unwrap() error {
+	return e.err
+}
+
+func (a *Auth) authenticate(username, password string, r *http.Request) (*User, error) {
+	policy := a.LockoutPolicy()
+	now := time.Now()
+	ip := network.GetClientIP(r)
+
+	// every attempt is counted as failed until the password is found right
+	if ip != "" {
+		if wait := a.throttle.reserve(ip, policy, now); wait > 0 {
+			return nil, fmt.Errorf("%w: retry in %s", ErrThrottled, wait.Round(time.Second))
+		}
+	}
+
+	u, ok := a.GetUser(username)
+	if !ok {
+		// take as long as a wrong password, so that timing doesn't tell which usernames exist
+		a.dummyHash().match(password)
+		return nil, ErrInvalidCredentials
+	}
+	release, err := a.reserveAttempt(u, policy, now)
+	if err != nil {
+		a.dummyHash().match(password)
+		return nil, accountBlocked{err}
+	}
+
+	ok, err = a.checkPassword(u, password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if err = a.persistUser(u); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidCredentials
+	}
+	if ip != "" {
+		a.throttle.release(ip)
+	}
+	// only tell whether the account can be used to those who know its password
+	if err = a.active(u); err != nil {
+		release()
+		return nil, err
+	}
+
+	a.lock.RLock()
+	totp := u.totpEnabled
+	a.lock.RUnlock()
+	if totp {
+		// the earlier failures are only forgotten once the second factor is verified too, or a wrong
+		// code could be tried again and again after logging in with the password
+		release()
+		return u, ErrSecondFactorRequired
+	}
+	a.clearFailures(u)
+	if err = a.persistUser(u); err != nil {
+		return nil, err
+	}
+	if u.mustChange || a.PasswordPolicy().Expired(u) {
+		return u, ErrPasswordChangeRequired
+	}
+	return u, nil
+}
+
+// Unlock clears the failed logins of a user, lifting any lock or delay.
+func (a *Auth) Unlock(usernameOrId string) error {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return ErrUserNotFound
+	}
+	a.clearFailures(u)
+	return a.persistUser(u)
+}
+
+// reserveAttempt counts a login attempt of a user as failed before it is checked, so that concurrent
+// attempts can't all get past the lockout, locking the account after too many. It fails if the account
+// is locked or the delay after the last failure hasn't passed. A successful attempt is undone by
+// clearFailures, or by the returned function to keep the earlier failures. The caller persists the user.
+func (a *Auth) reserveAttempt(u *User, policy LockoutPolicy, now time.Time) (func(), error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if now.Before(u.lockedUntil) {
+		return nil, ErrAccountLocked
+	}
+	if wait := u.lastFailure.Add(policy.delay(u.failedAttempts)).Sub(now); wait > 0 {
+		return nil, fmt.Errorf("%w: retry in %s", ErrThrottled, wait.Round(time.Second))
+	}
+
+	if !u.lockedUntil.IsZero() { // the previous lock expired, start over
+		u.failedAttempts, u.lockedUntil = 0, time.Time{}
+	}
+	last := u.lastFailure
+	u.failedAttempts++
+	u.lastFailure = now
+	if policy.LockAfter > 0 && u.failedAttempts >= policy.LockAfter {
+		u.lockedUntil = now.Add(policy.LockDuration)
+	}
+
+	release := func() {
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		if u.failedAttempts > 0 {
+			u.failedAttempts--
+		}
+		if u.lastFailure.Equal(now) {
+			u.lastFailure = last
+		}
+		if policy.LockAfter == 0 || u.failedAttempts < policy.LockAfter {
+			u.lockedUntil = time.Time{}
+		}
+	}
+	return release, nil
+}
+
+// clearFailures forgets the failed logins of a user after a successful one. The caller persists the user.
+func (a *Auth) clearFailures(u *User) {
+	a.lock.Lock()
+	u.failedAttempts, u.lastFailure, u.lockedUntil = 0, time.Time{}, time.Time{}
+	a.lock.Unlock()
+}
+
+// dummyHash returns a hash made with the current parameters, which the password given for an unknown
+// username is checked against.
+func (a *Auth) dummyHash() passwordHash {
+	params := a.HashParams()
+	a.lock.RLock()
+	h := a.dummy
+	a.lock.RUnlock()
+	if h.hash != nil && h.params == params {
+		return h
+	}
+
+	h, err := newPasswordHash("", params)
+	if err != nil {
+		return h
+	}
+	a.lock.Lock()
+	a.dummy = h
+	a.lock.Unlock()
+	return h
+}
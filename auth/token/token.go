@@ -0,0 +1,326 @@
+// Package token issues and verifies stateless access tokens for auth users. Tokens are JSON Web
+// Tokens signed with HS256 or EdDSA, carrying the user ID, group names and root permissions, so
+// services can authorize a request without calling back to the auth database.
+package token
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/another-d-mention/unicomplex/auth"
+	"github.com/another-d-mention/unicomplex/crypt/box"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalidToken         = errors.New("token: invalid token")
+	ErrExpired              = errors.New("token: expired")
+	ErrNotYetValid          = errors.New("token: not yet valid")
+	ErrInvalidAudience      = errors.New("token: invalid audience")
+	ErrUnknownKey           = errors.New("token: unknown key")
+	ErrUnsupportedAlgorithm = errors.New("token: unsupported algorithm")
+	ErrCannotSign           = errors.New("token: key cannot sign")
+	ErrWeakKey              = errors.New("token: HMAC secret shorter than 32 bytes")
+)
+
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+)
+
+var encoding = base64.RawURLEncoding
+
+// Key is a signing or verification key, identified in tokens by its ID (the kid header).
+type Key struct {
+	ID        string
+	Algorithm string
+
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// minHMACSecret is the minimum length of HS256 secrets, that of the hash.
+const minHMACSecret = sha256.Size
+
+// NewHMACKey returns an HS256 key. The secret must be at least 32 bytes long, like those of box.GenerateKey.
+func NewHMACKey(id string, secret box.Key) (*Key, error) {
+	if len(secret) < minHMACSecret {
+		return nil, ErrWeakKey
+	}
+	return &Key{ID: id, Algorithm: HS256, secret: secret}, nil
+}
+
+// NewEd25519Key returns an EdDSA key able to sign and verify.
+func NewEd25519Key(id string, private ed25519.PrivateKey) *Key {
+	return &Key{ID: id, Algorithm: EdDSA, private: private, public: private.Public().(ed25519.PublicKey)}
+}
+
+// NewEd25519VerifyKey returns an EdDSA key that can only verify, for services that don't issue tokens.
+func NewEd25519VerifyKey(id string, public ed25519.PublicKey) *Key {
+	return &Key{ID: id, Algorithm: EdDSA, public: public}
+}
+
+func (k *Key) sign(message string) ([]byte, error) {
+	switch {
+	case k.Algorithm == HS256:
+		return hs256(message, k.secret), nil
+	case k.Algorithm == EdDSA && k.private != nil:
+		return ed25519.Sign(k.private, []byte(message)), nil
+	case k.Algorithm == EdDSA:
+		return nil, ErrCannotSign
+	}
+	return nil, ErrUnsupportedAlgorithm
+}
+
+func (k *Key) verify(message string, signature []byte) bool {
+	switch k.Algorithm {
+	case HS256:
+		return hmac.Equal(signature, hs256(message, k.secret))
+	case EdDSA:
+		return ed25519.Verify(k.public, []byte(message), signature)
+	}
+	return false
+}
+
+// hs256 is box.Sign with SHA-256 and a raw result.
+func hs256(message string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// Audience is the aud claim. It is encoded as a string when it has a single value.
+type Audience []string
+
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = Audience{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (a Audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Claims is the payload of a token. Times are seconds since the Unix epoch.
+type Claims struct {
+	Subject   string   `json:"sub,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+
+	Username   string          `json:"name,omitempty"`
+	Groups     []string        `json:"groups,omitempty"`
+	Permission auth.Permission `json:"perm,omitempty"`
+}
+
+// ForUser returns the claims of a token for u, valid for ttl from now, with its permissions in
+// the root ACL of a.
+func ForUser(a *auth.Auth, u *auth.User, ttl time.Duration) Claims {
+	now := time.Now()
+	permission, _ := a.GetPermission(nil, u.ID().String())
+	return Claims{
+		Subject:    u.ID().String(),
+		ExpiresAt:  now.Add(ttl).Unix(),
+		NotBefore:  now.Unix(),
+		IssuedAt:   now.Unix(),
+		ID:         uuid.NewString(),
+		Username:   u.Username(),
+		Groups:     u.GroupNames(),
+		Permission: permission,
+	}
+}
+
+// MarshalJSON implements json.Marshaler interface. The permission is written as a number, so that
+// tokens don't depend on the names registered where they are issued.
+func (c Claims) MarshalJSON() ([]byte, error) {
+	type plain Claims
+	return json.Marshal(struct {
+		plain
+		Permission uint64 `json:"perm,omitempty"`
+	}{plain(c), uint64(c.Permission)})
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface. The permission must be a number.
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	type plain Claims
+	v := struct {
+		*plain
+		Permission uint64 `json:"perm,omitempty"`
+	}{plain: (*plain)(c)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	c.Permission = auth.Permission(v.Permission)
+	return nil
+}
+
+// UserID returns the subject of the claims as a user ID.
+func (c *Claims) UserID() (uuid.UUID, error) {
+	return uuid.Parse(c.Subject)
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// VerifyOptions are the checks made by Verify besides the signature and validity period.
+type VerifyOptions struct {
+	// Audience, if set, must be part of the aud claim.
+	Audience string
+	// Leeway is the clock skew tolerated on exp and nbf.
+	Leeway time.Duration
+}
+
+// Keyring signs tokens with its current key and verifies them with any of its keys, selected by
+// kid. Keys are rotated by adding a new current key and removing the old one once the tokens it
+// signed have expired.
+type Keyring struct {
+	lock    sync.RWMutex
+	keys    map[string]*Key
+	current string
+}
+
+// NewKeyring returns a keyring signing with current and also verifying with others.
+func NewKeyring(current *Key, others ...*Key) *Keyring {
+	k := &Keyring{keys: make(map[string]*Key, len(others)+1)}
+	for _, key := range others {
+		k.keys[key.ID] = key
+	}
+	k.Rotate(current)
+	return k
+}
+
+// Rotate adds key and makes it the one used for signing.
+func (k *Keyring) Rotate(key *Key) {
+	k.lock.Lock()
+	k.keys[key.ID] = key
+	k.current = key.ID
+	k.lock.Unlock()
+}
+
+// Add adds a key used for verification only.
+func (k *Keyring) Add(key *Key) {
+	k.lock.Lock()
+	k.keys[key.ID] = key
+	k.lock.Unlock()
+}
+
+// Remove drops a key. Tokens it signed no longer verify.
+func (k *Keyring) Remove(id string) {
+	k.lock.Lock()
+	delete(k.keys, id)
+	k.lock.Unlock()
+}
+
+func (k *Keyring) key(id string) (*Key, bool) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+// Sign returns the token for claims, signed with the current key.
+func (k *Keyring) Sign(claims Claims) (string, error) {
+	k.lock.RLock()
+	key, ok := k.keys[k.current]
+	k.lock.RUnlock()
+	if !ok {
+		return "", ErrUnknownKey
+	}
+
+	h, err := json.Marshal(header{Algorithm: key.Algorithm, Type: "JWT", KeyID: key.ID})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	message := encoding.EncodeToString(h) + "." + encoding.EncodeToString(c)
+	signature, err := key.sign(message)
+	if err != nil {
+		return "", err
+	}
+	return message + "." + encoding.EncodeToString(signature), nil
+}
+
+// Verify checks the signature and validity period of a token and returns its claims.
+func (k *Keyring) Verify(token string, opts VerifyOptions) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var h header
+	if err := decode(parts[0], &h); err != nil {
+		return nil, err
+	}
+	key, ok := k.key(h.KeyID)
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	// the algorithm is fixed by the key, never chosen by the token
+	if h.Algorithm != key.Algorithm {
+		return nil, ErrUnsupportedAlgorithm
+	}
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil || !key.verify(parts[0]+"."+parts[1], signature) {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err = decode(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if claims.ExpiresAt != 0 && now.Add(-opts.Leeway).Unix() >= claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+	if claims.NotBefore != 0 && now.Add(opts.Leeway).Unix() < claims.NotBefore {
+		return nil, ErrNotYetValid
+	}
+	if opts.Audience != "" && !claims.Audience.contains(opts.Audience) {
+		return nil, ErrInvalidAudience
+	}
+	return &claims, nil
+}
+
+func decode(part string, v any) error {
+	data, err := encoding.DecodeString(part)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/another-d-mention/unicomplex/auth"
+	"github.com/another-d-mention/unicomplex/crypt/box"
+)
+
+func TestToken(t *testing.T) {
+	a := auth.New()
+	if err := a.AddUser("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddGroup("admins"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddUserToGroup("user", "admins"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddGroupToACL(nil, "admins", 5); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := a.GetUser("user")
+
+	if _, err := NewHMACKey("weak", box.Key("secret")); !errors.Is(err, ErrWeakKey) {
+		t.Error("expected ErrWeakKey, got", err)
+	}
+	secret, _ := box.GenerateKey()
+	key, err := NewHMACKey("k1", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := NewKeyring(key)
+
+	claims := ForUser(a, u, time.Hour)
+	claims.Audience = Audience{"api"}
+	tok, err := keys.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := keys.Verify(tok, VerifyOptions{Audience: "api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := got.UserID(); id != u.ID() || got.Username != "user" || got.Permission != 5 || len(got.Groups) != 1 || got.Groups[0] != "admins" {
+		t.Error("unexpected claims", got)
+	}
+	// the permission is numeric, whatever names are registered
+	payload, _ := base64.RawURLEncoding.DecodeString(strings.Split(tok, ".")[1])
+	if !strings.Contains(string(payload), `"perm":5`) {
+		t.Error("permission not numeric:", string(payload))
+	}
+	if err = a.SetDisabled("user", true); err != nil {
+		t.Fatal(err)
+	}
+	if c := ForUser(a, u, time.Hour); c.Permission != 0 {
+		t.Error("disabled user got permissions", c.Permission)
+	}
+	if err = a.SetDisabled("user", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = keys.Verify(tok, VerifyOptions{Audience: "other"}); !errors.Is(err, ErrInvalidAudience) {
+		t.Error("expected ErrInvalidAudience, got", err)
+	}
+	parts := strings.Split(tok, ".")
+	if _, err = keys.Verify(parts[0]+"."+parts[1]+"x."+parts[2], VerifyOptions{}); !errors.Is(err, ErrInvalidToken) {
+		t.Error("expected ErrInvalidToken, got", err)
+	}
+
+	expired := claims
+	expired.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	tok, _ = keys.Sign(expired)
+	if _, err = keys.Verify(tok, VerifyOptions{}); !errors.Is(err, ErrExpired) {
+		t.Error("expected ErrExpired, got", err)
+	}
+	if _, err = keys.Verify(tok, VerifyOptions{Leeway: 2 * time.Minute}); err != nil {
+		t.Error("leeway not applied:", err)
+	}
+
+	// rotation to an EdDSA key keeps older tokens valid until their key is removed
+	old, _ := keys.Sign(claims)
+	public, private, _ := ed25519.GenerateKey(nil)
+	keys.Rotate(NewEd25519Key("k2", private))
+	tok, err = keys.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = keys.Verify(old, VerifyOptions{}); err != nil {
+		t.Error("old token rejected after rotation:", err)
+	}
+	keys.Remove("k1")
+	if _, err = keys.Verify(old, VerifyOptions{}); !errors.Is(err, ErrUnknownKey) {
+		t.Error("expected ErrUnknownKey, got", err)
+	}
+
+	verifier := NewKeyring(NewEd25519VerifyKey("k2", public))
+	if _, err = verifier.Verify(tok, VerifyOptions{}); err != nil {
+		t.Error(err)
+	}
+	if _, err = verifier.Sign(claims); !errors.Is(err, ErrCannotSign) {
+		t.Error("expected ErrCannotSign, got", err)
+	}
+
+	// a token can't pick another algorithm than the one of its key
+	key, _ = NewHMACKey("k2", box.Key(public))
+	tok, _ = NewKeyring(key).Sign(claims)
+	if _, err = verifier.Verify(tok, VerifyOptions{}); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Error("expected ErrUnsupportedAlgorithm, got", err)
+	}
+}
@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/another-d-mention/unicomplex/crypt/box"
+)
+
+// TOTP parameters (RFC 6238), the defaults understood by every authenticator app.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is the number of periods before and after the current one whose codes are accepted.
+	totpSkew = 1
+
+	recoveryCodes   = 10
+	recoveryCodeLen = 10
+)
+
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// hotp returns the HOTP value (RFC 4226) of a counter.
+func hotp(secret []byte, counter uint64) string {
+	mac := hmac.New(sha1.New, secret)
+	_ = binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+// EnrollTOTP gives a user a new TOTP secret and returns it as an otpauth:// URI for authenticator apps,
+// along with single-use recovery codes. TOTP is enabled once a first code is verified with VerifyTOTP.
+//
+// The secret is encrypted with the key set by SetSecretKey, so that key must be kept for the secret
+// to be usable after a restart. Without one, EnrollTOTP fails with ErrSecretKeyNotSet.
+func (a *Auth) EnrollTOTP(usernameOrId, issuer string) (string, []string, error) {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return "", nil, ErrUserNotFound
+	}
+	a.lock.RLock()
+	set := a.secretSet
+	a.lock.RUnlock()
+	if !set {
+		return "", nil, ErrSecretKeyNotSet
+	}
+
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	sealed, ok := box.Seal(secret, a.secretKey())
+	if !ok {
+		return "", nil, ErrInvalidKey
+	}
+
+	codes := make([]string, recoveryCodes)
+	hashes := make([][]byte, recoveryCodes)
+	for i := range codes {
+		b := make([]byte, recoveryCodeLen*5/8)
+		if _, err := rand.Read(b); err != nil {
+			return "", nil, err
+		}
+		codes[i] = base32Encoding.EncodeToString(b)
+		sum := sha256.Sum256([]byte(codes[i]))
+		hashes[i] = sum[:]
+	}
+
+	a.lock.Lock()
+	u.totpSecret = sealed
+	u.totpEnabled = false
+	u.totpLastStep = 0
+	u.recoveryCodes = hashes
+	a.lock.Unlock()
+	if err := a.persistUser(u); err != nil {
+		return "", nil, err
+	}
+
+	label := url.PathEscape(u.username)
+	if issuer != "" {
+		label = url.PathEscape(issuer) + ":" + label
+	}
+	query := url.Values{}
+	query.Set("secret", base32Encoding.EncodeToString(secret))
+	if issuer != "" {
+		query.Set("issuer", issuer)
+	}
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + query.Encode(), codes, nil
+}
+
+// VerifyTOTP checks a code from the authenticator app of a user. Codes of the adjacent periods are
+// accepted to allow for clock skew, but a code can't be used twice. Wrong codes count as failed logins
+// of the LockoutPolicy, so guessing them gets throttled and locks the account like guessing passwords.
+func (a *Auth) VerifyTOTP(usernameOrId, code string) (bool, error) {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return false, ErrUserNotFound
+	}
+	a.lock.RLock()
+	sealed := u.totpSecret
+	a.lock.RUnlock()
+	if sealed == nil {
+		return false, ErrTOTPNotEnrolled
+	}
+	secret, ok := box.Open(sealed, a.secretKey())
+	if !ok {
+		return false, ErrInvalidKey
+	}
+	policy := a.LockoutPolicy()
+	now := time.Now()
+	if _, err := a.reserveAttempt(u, policy, now); err != nil {
+		return false, err
+	}
+
+	// check and consume the code at once, so that concurrent requests can't both use it
+	current := uint64(now.Unix() / totpPeriod)
+	matched := false
+	a.lock.Lock()
+	for step := current - totpSkew; step <= current+totpSkew && !matched; step++ {
+		if step <= u.totpLastStep {
+			continue // already used, or older than a used code
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(secret, step)), []byte(code)) == 1 {
+			u.totpLastStep = step
+			u.totpEnabled = true
+			matched = true
+		}
+	}
+	a.lock.Unlock()
+
+	if matched {
+		a.clearFailures(u)
+		if err := a.persistUser(u); err != nil {
+			return true, err
+		}
+		return true, a.audit(AuditEvent{Action: AuditTOTPSuccess, Subject: u.username})
+	}
+	if err := a.persistUser(u); err != nil {
+		return false, err
+	}
+	return false, a.audit(AuditEvent{Action: AuditTOTPFailure, Subject: u.username})
+}
+
+// UseRecoveryCode checks one of the recovery codes returned by EnrollTOTP, which can't be used again.
+// Recovery codes only replace TOTP codes once TOTP is enabled. Wrong codes count as failed logins, like
+// with VerifyTOTP.
+func (a *Auth) UseRecoveryCode(usernameOrId, code string) (bool, error) {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return false, ErrUserNotFound
+	}
+	a.lock.RLock()
+	enabled := u.totpEnabled
+	a.lock.RUnlock()
+	if !enabled {
+		return false, ErrTOTPNotEnrolled
+	}
+	policy := a.LockoutPolicy()
+	now := time.Now()
+	if _, err := a.reserveAttempt(u, policy, now); err != nil {
+		return false, err
+	}
+
+	sum := sha256.Sum256([]byte(strings.ToUpper(strings.TrimSpace(code))))
+	matched := false
+	a.lock.Lock()
+	for i, hash := range u.recoveryCodes {
+		if subtle.ConstantTimeCompare(hash, sum[:]) == 1 {
+			u.recoveryCodes = append(u.recoveryCodes[:i:i], u.recoveryCodes[i+1:]...)
+			matched = true
+			break
+		}
+	}
+	a.lock.Unlock()
+
+	if matched {
+		a.clearFailures(u)
+		if err := a.persistUser(u); err != nil {
+			return true, err
+		}
+		return true, a.audit(AuditEvent{Action: AuditTOTPSuccess, Subject: u.username, Detail: "recovery code"})
+	}
+	if err := a.persistUser(u); err != nil {
+		return false, err
+	}
+	return false, a.audit(AuditEvent{Action: AuditTOTPFailure, Subject: u.username, Detail: "recovery code"})
+}
+
+// DisableTOTP removes the TOTP secret and recovery codes of a user.
+func (a *Auth) DisableTOTP(usernameOrId string) error {
+	u, ok := a.GetUser(usernameOrId)
+	if !ok {
+		return ErrUserNotFound
+	}
+	a.lock.Lock()
+	u.totpSecret, u.totpEnabled, u.totpLastStep, u.recoveryCodes = nil, false, 0, nil
+	a.lock.Unlock()
+	return a.persistUser(u)
+}
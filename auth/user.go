@@ -1,24 +1,34 @@
 package auth
 
 import (
-	"crypto/hmac"
-	"crypto/rand"
-	"encoding/binary"
-	"io"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
-	"golang.org/x/crypto/argon2"
 )
 
 type User struct {
 	id              uuid.UUID
 	username        string
-	passwordHash    [32]byte
-	passwordSalt    [16]byte
+	password        passwordHash
 	lastLogin       time.Time
 	passwordChanged time.Time
 	groups          []uuid.UUID
+	history         []passwordHash
+	resetNonce      []byte
+	mustChange      bool
+	failedAttempts  int
+	lastFailure     time.Time
+	lockedUntil     time.Time
+	totpSecret      []byte // sealed with the secret key of the Auth
+	totpEnabled     bool
+	totpLastStep    uint64
+	recoveryCodes   [][]byte // SHA-256 hashes
+	displayName     string
+	email           string
+	disabled        bool
+	expires         time.Time
+	attributes      atomic.Pointer[map[string]string] // replaced on change, so that it can be read without the lock
 
 	groupNames []string
 }
@@ -40,6 +50,35 @@ func (u *User) PasswordChangeDate() time.Time {
 	return u.passwordChanged
 }
 
+// FailedAttempts returns the number of consecutive failed logins.
+func (u *User) FailedAttempts() int {
+	return u.failedAttempts
+}
+
+func (u *User) LastFailedLogin() time.Time {
+	return u.lastFailure
+}
+
+// LockedUntil returns the time until which the account is locked, if it is.
+func (u *User) LockedUntil() time.Time {
+	return u.lockedUntil
+}
+
+// TOTPEnabled reports whether the user logs in with a TOTP second factor.
+func (u *User) TOTPEnabled() bool {
+	return u.totpEnabled
+}
+
+// RecoveryCodesLeft returns the number of unused TOTP recovery codes.
+func (u *User) RecoveryCodesLeft() int {
+	return len(u.recoveryCodes)
+}
+
+// MustChangePassword reports whether the user has to change the password at next login.
+func (u *User) MustChangePassword() bool {
+	return u.mustChange
+}
+
 func (u *User) GroupIDs() []uuid.UUID {
 	list := make([]uuid.UUID, len(u.groups))
 	copy(list, u.groups)
@@ -52,94 +91,23 @@ func (u *User) GroupNames() []string {
 	return list
 }
 
-func (u *User) marshalBinary(w io.Writer) {
-	_ = binary.Write(w, binary.BigEndian, u.id[:])
-	_ = binary.Write(w, binary.BigEndian, byte(len(u.username)))
-	_ = binary.Write(w, binary.BigEndian, []byte(u.username))
-	l, _ := u.lastLogin.MarshalBinary()
-	_ = binary.Write(w, binary.BigEndian, l)
-	b, _ := u.passwordChanged.MarshalBinary()
-	_ = binary.Write(w, binary.BigEndian, b)
-	_ = binary.Write(w, binary.BigEndian, u.passwordHash[:])
-	_ = binary.Write(w, binary.BigEndian, u.passwordSalt[:])
-	_ = binary.Write(w, binary.BigEndian, byte(len(u.groups)))
-	for _, g := range u.groups {
-		_ = binary.Write(w, binary.BigEndian, g[:])
-	}
-}
-
-func (u *User) unmarshalBinary(r io.Reader) error {
-	if err := binary.Read(r, binary.BigEndian, &u.id); err != nil {
-		return err
-	}
-	var usernameLen byte
-	if err := binary.Read(r, binary.BigEndian, &usernameLen); err != nil {
-		return err
-	}
-	var usernameBytes = make([]byte, int(usernameLen))
-	if err := binary.Read(r, binary.BigEndian, usernameBytes); err != nil {
-		return err
-	}
-	u.username = string(usernameBytes)
-	b := make([]byte, 15)
-	if err := binary.Read(r, binary.BigEndian, b); err != nil {
-		return err
-	}
-	if err := u.lastLogin.UnmarshalBinary(b); err != nil {
-		return err
-	}
-	x := make([]byte, 15)
-	if err := binary.Read(r, binary.BigEndian, x); err != nil {
-		return err
-	}
-	if err := u.passwordChanged.UnmarshalBinary(x); err != nil {
-		return err
-	}
-	if err := binary.Read(r, binary.BigEndian, &u.passwordHash); err != nil {
-		return err
-	}
-	if err := binary.Read(r, binary.BigEndian, &u.passwordSalt); err != nil {
-		return err
-	}
-	var groupCount byte
-	if err := binary.Read(r, binary.BigEndian, &groupCount); err != nil {
-		return err
-	}
-	for i := 0; i < int(groupCount); i++ {
-		var g uuid.UUID
-		if err := binary.Read(r, binary.BigEndian, &g); err != nil {
-			return err
-		}
-		u.groups = append(u.groups, g)
-	}
-	return nil
-}
-
-func newUser(username, password string) (*User, error) {
-	id, _ := uuid.NewRandom()
-	var salt [16]byte
-	_, err := rand.Read(salt[:])
+func newUser(username, password string, params HashParams) (*User, error) {
+	hash, err := newPasswordHash(password, params)
 	if err != nil {
 		return nil, err
 	}
+	return newUserWithHash(username, hash), nil
+}
 
-	u := &User{
+func newUserWithHash(username string, hash passwordHash) *User {
+	id, _ := uuid.NewRandom()
+	return &User{
 		id:              id,
 		username:        username,
-		passwordSalt:    salt,
+		password:        hash,
 		passwordChanged: time.Now(),
 		groups:          []uuid.UUID{},
 	}
-
-	u.passwordHash = u.hashPassword(password)
-	return u, nil
-}
-
-func (u *User) hashPassword(password string) [32]byte {
-	hashed := argon2.IDKey([]byte(password), u.passwordSalt[:], 1, 64*1024, 4, 32)
-	var pwd [32]byte
-	copy(pwd[:], hashed)
-	return pwd
 }
 
 func (u *User) HasGroup(groupNameOrId string) bool {
@@ -161,20 +129,54 @@ func (u *User) HasGroup(groupNameOrId string) bool {
 }
 
 func (u *User) VerifyPassword(password string) bool {
-	p := u.hashPassword(password)
-	if hmac.Equal(u.passwordHash[:], p[:]) {
+	if u.matchPassword(password) {
 		u.lastLogin = time.Now()
 		return true
 	}
 	return false
 }
 
+func (u *User) matchPassword(password string) bool {
+	return u.password.match(password)
+}
+
+// usedPassword reports whether password is the current one or one of the last n.
+func (u *User) usedPassword(password string, n int) bool {
+	if u.matchPassword(password) {
+		return true
+	}
+	for i := 0; i < n && i < len(u.history); i++ {
+		if u.history[i].match(password) {
+			return true
+		}
+	}
+	return false
+}
+
+// setPassword replaces the password, keeping at most keep previous ones in the history.
+func (u *User) setPassword(hash passwordHash, keep int) {
+	if keep > 0 {
+		u.history = append([]passwordHash{u.password}, u.history...)
+	}
+	if len(u.history) > keep {
+		u.history = u.history[:keep]
+	}
+
+	u.password = hash
+	u.passwordChanged = time.Now()
+	u.resetNonce = nil
+	u.mustChange = false
+}
+
 type Group struct {
 	id   uuid.UUID
 	name string
 
-	userIds   []uuid.UUID
-	userNames []string
+	parents []uuid.UUID // the groups this group is a member of
+
+	userIds     []uuid.UUID
+	userNames   []string
+	parentNames []string
 }
 
 func (g *Group) ID() uuid.UUID {
@@ -198,32 +200,32 @@ func (g *Group) UserNames() []string {
 	return list
 }
 
-func newGroup(name string) *Group {
-	id, _ := uuid.NewRandom()
-	return &Group{
-		id:   id,
-		name: name,
-	}
+// ParentIDs returns the groups this group is directly a member of.
+func (g *Group) ParentIDs() []uuid.UUID {
+	list := make([]uuid.UUID, len(g.parents))
+	copy(list, g.parents)
+	return list
 }
 
-func (g *Group) marshalBinary(w io.Writer) {
-	_ = binary.Write(w, binary.BigEndian, g.id[:])
-	_ = binary.Write(w, binary.BigEndian, byte(len(g.name)))
-	_ = binary.Write(w, binary.BigEndian, []byte(g.name))
+func (g *Group) ParentNames() []string {
+	list := make([]string, len(g.parentNames))
+	copy(list, g.parentNames)
+	return list
 }
 
-func (g *Group) unmarshalBinary(r io.Reader) error {
-	if err := binary.Read(r, binary.BigEndian, &g.id); err != nil {
-		return err
-	}
-	var nameLen byte
-	if err := binary.Read(r, binary.BigEndian, &nameLen); err != nil {
-		return err
+func (g *Group) hasParent(id uuid.UUID) bool {
+	for _, p := range g.parents {
+		if p == id {
+			return true
+		}
 	}
-	var nameBytes = make([]byte, int(nameLen))
-	if err := binary.Read(r, binary.BigEndian, nameBytes); err != nil {
-		return err
+	return false
+}
+
+func newGroup(name string) *Group {
+	id, _ := uuid.NewRandom()
+	return &Group{
+		id:   id,
+		name: name,
 	}
-	g.name = string(nameBytes)
-	return nil
 }
@@ -1,7 +1,29 @@
 package auth
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/another-d-mention/unicomplex/crypt/box"
+	"github.com/another-d-mention/unicomplex/encoding/msgpack"
+	"github.com/another-d-mention/unicomplex/filesystem"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Perms int
@@ -85,7 +107,7 @@ func TestACL(t *testing.T) {
 }
 
 func TestUser(t *testing.T) {
-	u, err := newUser("testuser", "testpassword")
+	u, err := newUser("testuser", "testpassword", DefaultHashParams)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -168,3 +190,2048 @@ func TestGroup(t *testing.T) {
 		t.Error("Auth should have 1 user")
 	}
 }
+
+func TestStore(t *testing.T) {
+	fs := filesystem.NewMemoryFilesystem()
+	store := NewFileStore(fs, "/db/auth.bin")
+
+	a, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddUser("user1", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddUser("user2", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddGroup("group"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddUserToGroup("user1", "group"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddUserToACL(nil, "user2", Permission(CanRead)); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.DeleteUser("user2"); err != nil {
+		t.Fatal(err)
+	}
+	if fs.Exists("/db/auth.bin") {
+		t.Error("snapshot should not exist before Save")
+	}
+
+	check := func(a *Auth) {
+		t.Helper()
+		if len(a.Users()) != 1 {
+			t.Error("expected 1 user, got", len(a.Users()))
+		}
+		u, ok := a.GetUser("user1")
+		if !ok {
+			t.Fatal("user1 not restored")
+		}
+		if !u.VerifyPassword("password") {
+			t.Error("password not restored")
+		}
+		g, ok := a.GetGroup("group")
+		if !ok || len(g.UserNames()) != 1 || !u.HasGroup("group") {
+			t.Error("group membership not restored")
+		}
+	}
+
+	b, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(b)
+
+	if err = b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if fs.Exists("/db/auth.bin.journal") {
+		t.Error("journal should be compacted by Save")
+	}
+	if err = b.AddGroup("other"); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash in the middle of an append
+	f, err := fs.Open("/db/auth.bin.journal", os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Seek(0, 2)
+	_, _ = f.Write([]byte{0, 0, 1, 0, 1, 2})
+	_ = f.Close()
+
+	c, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(c)
+	if _, ok := c.GetGroup("other"); !ok {
+		t.Error("journaled group not restored")
+	}
+
+	// the torn tail is dropped, so what is appended after it is not lost
+	if err = c.AddGroup("after"); err != nil {
+		t.Fatal(err)
+	}
+	d, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.GetGroup("after"); !ok {
+		t.Error("group appended after a torn record not restored")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	a := New()
+	if err := a.AddUser("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddGroup("group"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddUserToGroup("user", "group"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddGroupToACL(nil, "group", Permission(CanWrite)); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := a.MarshalBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if !bytes.HasPrefix(data, magic[:]) {
+		t.Fatal("missing container magic")
+	}
+
+	b := New()
+	if err := b.UnmarshalBinary(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	u, ok := b.GetUser("user")
+	if !ok || !u.VerifyPassword("password") || !u.HasGroup("group") {
+		t.Error("user not restored")
+	}
+	if !hasPermission(b, "group", Permission(CanWrite)) {
+		t.Error("ACL not restored")
+	}
+
+	corrupt := bytes.Clone(data)
+	corrupt[len(corrupt)-6] ^= 0xff
+	if err := New().UnmarshalBinary(bytes.NewReader(corrupt)); !errors.Is(err, ErrChecksum) {
+		t.Error("expected ErrChecksum, got", err)
+	}
+	future := bytes.Clone(data)
+	future[5] = 99
+	if err := New().UnmarshalBinary(bytes.NewReader(future)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Error("expected ErrUnsupportedVersion, got", err)
+	}
+
+	// the original, unversioned format
+	src, _ := a.GetUser("user")
+	group, _ := a.GetGroup("group")
+	var legacy bytes.Buffer
+	w := func(v any) {
+		if err := binary.Write(&legacy, binary.BigEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w(uint64(1))
+	w(src.id)
+	w(byte(len(src.username)))
+	w([]byte(src.username))
+	lastLogin, _ := src.lastLogin.MarshalBinary()
+	changed, _ := src.passwordChanged.MarshalBinary()
+	w(lastLogin)
+	w(changed)
+	w(src.password.hash)
+	w(src.password.salt)
+	w(byte(1))
+	w(group.id)
+	w(uint64(1))
+	w(group.id)
+	w(byte(len(group.name)))
+	w([]byte(group.name))
+	w(uint16(0))
+	w(uint16(1))
+	w(group.id)
+	w(Permission(CanWrite))
+
+	c := New()
+	if err := c.UnmarshalBinary(&legacy); err != nil {
+		t.Fatal(err)
+	}
+	u, ok = c.GetUser("user")
+	if !ok || !u.VerifyPassword("password") || !u.HasGroup("group") {
+		t.Error("legacy user not imported")
+	}
+	if !hasPermission(c, "group", Permission(CanWrite)) {
+		t.Error("legacy ACL not imported")
+	}
+}
+
+func hasPermission(a *Auth, name string, want Permission) bool {
+	p, ok := a.GetPermission(nil, name)
+	return ok && p == want
+}
+
+func TestMsgpack(t *testing.T) {
+	a := New()
+	if err := a.AddUser("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := msgpack.Marshal(map[string]any{"auth": a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Auth *Auth `msgpack:"auth"`
+	}
+	decoded.Auth = New()
+	if err = msgpack.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := decoded.Auth.GetUser("user"); !ok || !u.VerifyPassword("password") {
+		t.Error("auth round trip failed")
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	a := New()
+	if err := a.AddUser("secret-user", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := a.MarshalEncrypted(&buf, []byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("secret-user")) {
+		t.Error("username readable in encrypted snapshot")
+	}
+
+	if err := New().UnmarshalEncrypted(bytes.NewReader(buf.Bytes()), []byte("wrong")); !errors.Is(err, ErrDecryption) {
+		t.Error("expected ErrDecryption, got", err)
+	}
+
+	b := New()
+	if err := b.UnmarshalEncrypted(bytes.NewReader(buf.Bytes()), []byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := b.GetUser("secret-user"); !ok || !u.VerifyPassword("password") {
+		t.Error("user not restored")
+	}
+
+	// headers asking for too much work are rejected before deriving the key
+	for _, forge := range []func([]byte){
+		func(h []byte) { binary.BigEndian.PutUint32(h[4:], math.MaxUint32) },
+		func(h []byte) { binary.BigEndian.PutUint32(h[8:], math.MaxUint32) },
+		func(h []byte) { binary.BigEndian.PutUint32(h[8:], 1024*1024+1) }, // just over 1 GiB
+		func(h []byte) { h[12] = math.MaxUint8 },
+	} {
+		data := bytes.Clone(buf.Bytes())
+		forge(data)
+		if err := New().UnmarshalEncrypted(bytes.NewReader(data), []byte("passphrase")); !errors.Is(err, ErrInvalidFormat) {
+			t.Error("expected ErrInvalidFormat, got", err)
+		}
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 8, Require: ClassLower | ClassDigit, History: 2, MaxAge: time.Hour}
+	if err := policy.LoadDenyList(strings.NewReader("# common\npassword1\n\nletmein99\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	a := New()
+	a.SetPasswordPolicy(policy)
+
+	for pwd, want := range map[string]error{
+		"":          ErrPasswordTooShort,
+		"short1":    ErrPasswordTooShort,
+		"nodigitsx": ErrPasswordTooWeak,
+		"PASSWORD1": ErrPasswordDenied,
+	} {
+		if err := a.AddUser("user", pwd); !errors.Is(err, want) {
+			t.Errorf("%q: expected %v, got %v", pwd, want, err)
+		}
+	}
+	if err := a.AddUser("user", "first-pass1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.ChangePassword("user", "wrong", "second-pass2"); !errors.Is(err, ErrInvalidPassword) {
+		t.Error("expected ErrInvalidPassword, got", err)
+	}
+	if err := a.ChangePassword("user", "first-pass1", "first-pass1"); !errors.Is(err, ErrPasswordReused) {
+		t.Error("expected ErrPasswordReused, got", err)
+	}
+	current := "first-pass1"
+	for _, pwd := range []string{"second-pass2", "third-pass3", "fourth-pass4"} {
+		if err := a.ChangePassword("user", current, pwd); err != nil {
+			t.Fatal(err)
+		}
+		current = pwd
+	}
+	// only the last two previous passwords are remembered
+	if err := a.ChangePassword("user", "fourth-pass4", "second-pass2"); !errors.Is(err, ErrPasswordReused) {
+		t.Error("expected ErrPasswordReused, got", err)
+	}
+	if err := a.ChangePassword("user", "fourth-pass4", "first-pass1"); err != nil {
+		t.Error(err)
+	}
+
+	if expired, err := a.PasswordExpired("user"); err != nil || expired {
+		t.Error("password should not be expired")
+	}
+	u, _ := a.GetUser("user")
+	u.passwordChanged = time.Now().Add(-2 * time.Hour)
+	if expired, _ := a.PasswordExpired("user"); !expired {
+		t.Error("password should be expired")
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	fs := filesystem.NewMemoryFilesystem()
+	store := NewFileStore(fs, "/auth.bin")
+	a, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddUser("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.RequirePasswordChange("user", true); err != nil {
+		t.Fatal(err)
+	}
+	b, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := b.GetUser("user"); !u.MustChangePassword() {
+		t.Error("must-change flag not persisted")
+	}
+
+	expired, err := a.IssueResetToken("user", -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.ResetPassword(expired, "new-password"); !errors.Is(err, ErrTokenExpired) {
+		t.Error("expected ErrTokenExpired, got", err)
+	}
+
+	token, err := a.IssueResetToken("user", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.ResetPassword(expired, "new-password"); !errors.Is(err, ErrInvalidToken) {
+		t.Error("older token should be invalidated, got", err)
+	}
+	forged := []byte(token)
+	forged[len(forged)-1] ^= 1
+	if err = a.ResetPassword(string(forged), "new-password"); !errors.Is(err, ErrInvalidToken) {
+		t.Error("expected ErrInvalidToken for a forged token, got", err)
+	}
+	if err = a.ResetPassword(token, "new-password"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.ResetPassword(token, "other-password"); !errors.Is(err, ErrInvalidToken) {
+		t.Error("token should be single-use, got", err)
+	}
+
+	u, _ := a.GetUser("user")
+	if !u.VerifyPassword("new-password") || u.MustChangePassword() {
+		t.Error("password not reset")
+	}
+	if err = a.ChangePassword("user", "new-password", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if !u.VerifyPassword("changed") {
+		t.Error("password not changed")
+	}
+}
+
+func TestHashParams(t *testing.T) {
+	a := New()
+	if err := a.SetHashParams(HashParams{Time: 1, Memory: 1024, Threads: 1, KeyLen: 8, SaltLen: 16}); !errors.Is(err, ErrInvalidHashParams) {
+		t.Error("expected ErrInvalidHashParams, got", err)
+	}
+	weak := HashParams{Time: 1, Memory: 8 * 1024, Threads: 1, KeyLen: 32, SaltLen: 16}
+	if err := a.SetHashParams(weak); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddUser("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("old-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.ImportUser("bcrypt", string(bcryptHash)); err != nil {
+		t.Fatal(err)
+	}
+	phc, _ := newPasswordHash("phc-password", HashParams{Time: 2, Memory: 4 * 1024, Threads: 2, KeyLen: 24, SaltLen: 12})
+	if err = a.ImportUser("phc", phc.String()); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.ImportUser("bad", "$argon2id$v=19$m=1,t=1$xx$yy"); !errors.Is(err, ErrInvalidHash) {
+		t.Error("expected ErrInvalidHash, got", err)
+	}
+	for _, params := range []string{"m=4294967295,t=1,p=1", "m=65536,t=4294967295,p=1", "m=65536,t=1,p=255"} {
+		costly := strings.Replace(phc.String(), "m=4096,t=2,p=2", params, 1)
+		if err = a.ImportUser("costly", costly); !errors.Is(err, ErrInvalidHash) {
+			t.Error(params, "expected ErrInvalidHash, got", err)
+		}
+	}
+
+	// snapshots keep the parameters of every hash
+	var buf bytes.Buffer
+	if err = a.MarshalBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	b := New()
+	if err = b.UnmarshalBinary(&buf); err != nil {
+		t.Fatal(err)
+	}
+	strong := HashParams{Time: 2, Memory: 16 * 1024, Threads: 2, KeyLen: 32, SaltLen: 16}
+	if err = b.SetHashParams(strong); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, password := range map[string]string{"user": "password", "bcrypt": "old-password", "phc": "phc-password"} {
+		u, _ := b.GetUser(name)
+		if !u.password.needsRehash(strong) {
+			t.Errorf("%s: expected a weaker hash", name)
+		}
+		if ok, err := b.VerifyPassword(name, "wrong"); ok || err != nil {
+			t.Errorf("%s: wrong password accepted", name)
+		}
+		if ok, err := b.VerifyPassword(name, password); !ok || err != nil {
+			t.Errorf("%s: password rejected: %v", name, err)
+		}
+		if u.password.algorithm != argon2id || u.password.params != strong {
+			t.Errorf("%s: not rehashed: %s", name, u.password)
+		}
+		if !u.VerifyPassword(password) {
+			t.Errorf("%s: rehashed password rejected", name)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := New()
+	a.SetLockoutPolicy(LockoutPolicy{FreeAttempts: 1, BaseDelay: time.Hour, MaxDelay: time.Hour, LockAfter: 3, LockDuration: time.Hour})
+	if err := a.AddUser("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Authenticate("user", "password", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate("nobody", "password", nil); !errors.Is(err, ErrInvalidCredentials) {
+		t.Error("expected ErrInvalidCredentials, got", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := a.Authenticate("user", "wrong", nil); !errors.Is(err, ErrInvalidCredentials) {
+			t.Error("expected ErrInvalidCredentials, got", err)
+		}
+	}
+	// a blocked account fails like an unknown username, so that it doesn't tell which ones exist
+	if _, err := a.Authenticate("user", "password", nil); !errors.Is(err, ErrInvalidCredentials) {
+		t.Error("expected ErrInvalidCredentials, got", err)
+	}
+
+	u, _ := a.GetUser("user")
+	if u.FailedAttempts() != 2 {
+		t.Error("expected 2 failed attempts, got", u.FailedAttempts())
+	}
+	u.lastFailure = u.lastFailure.Add(-2 * time.Hour)
+	if _, err := a.Authenticate("user", "wrong", nil); !errors.Is(err, ErrInvalidCredentials) {
+		t.Error("expected ErrInvalidCredentials, got", err)
+	}
+	if _, err := a.Authenticate("user", "password", nil); !errors.Is(err, ErrInvalidCredentials) {
+		t.Error("expected ErrInvalidCredentials, got", err)
+	}
+	if !time.Now().Before(u.LockedUntil()) {
+		t.Error("account not locked")
+	}
+
+	if err := a.Unlock("user"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate("user", "password", nil); err != nil {
+		t.Error(err)
+	}
+
+	// failures from the same client are throttled regardless of the user
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	for i := 0; i < 2; i++ {
+		_, _ = a.Authenticate("nobody", "password", r)
+	}
+	if _, err := a.Authenticate("user", "password", r); !errors.Is(err, ErrThrottled) {
+		t.Error("expected ErrThrottled, got", err)
+	}
+	if _, err := a.Authenticate("user", "password", nil); err != nil {
+		t.Error(err)
+	}
+
+	if err := a.RequirePasswordChange("user", true); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := a.Authenticate("user", "password", nil); u == nil || !errors.Is(err, ErrPasswordChangeRequired) {
+		t.Error("expected ErrPasswordChangeRequired, got", err)
+	}
+	if a.dummy.hash == nil {
+		t.Error("unknown username not checked against a dummy hash")
+	}
+
+	// a disabled account is only revealed to those who know the password
+	if err := a.SetDisabled("user", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate("user", "wrong", nil); !errors.Is(err, ErrInvalidCredentials) {
+		t.Error("expected ErrInvalidCredentials, got", err)
+	}
+	if _, err := a.Authenticate("user", "password", nil); !errors.Is(err, ErrAccountDisabled) {
+		t.Error("expected ErrAccountDisabled, got", err)
+	}
+
+	// concurrent failures are all counted
+	b, err := Open(NewFileStore(filesystem.NewMemoryFilesystem(), "/auth.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetLockoutPolicy(LockoutPolicy{LockAfter: 100, LockDuration: time.Hour})
+	if err = b.AddUser("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Go(func() {
+			if _, err := b.Authenticate("user", "wrong", nil); !errors.Is(err, ErrInvalidCredentials) {
+				t.Error("expected ErrInvalidCredentials, got", err)
+			}
+		})
+	}
+	wg.Wait()
+	if u, _ := b.GetUser("user"); u.FailedAttempts() != 20 {
+		t.Error("expected 20 failed attempts, got", u.FailedAttempts())
+	}
+
+	// concurrent attempts can't get past the lock
+	b.SetLockoutPolicy(LockoutPolicy{LockAfter: 5, LockDuration: time.Hour})
+	if err = b.AddUser("other", "password"); err != nil {
+		t.Fatal(err)
+	}
+	for range 20 {
+		wg.Go(func() {
+			_, _ = b.Authenticate("other", "wrong", nil)
+		})
+	}
+	wg.Wait()
+	if u, _ := b.GetUser("other"); u.FailedAttempts() != 5 || u.LockedUntil().IsZero() {
+		t.Error("expected 5 failed attempts and a lock, got", u.FailedAttempts())
+	}
+}
+
+func TestSessions(t *testing.T) {
+	a := New()
+	NewMemorySessionStore(0).Close() // must not panic
+	store := NewMemorySessionStore(time.Hour)
+	defer store.Close()
+	a.SetSessionStore(store)
+	if err := a.AddUser("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := a.CreateSession("user", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, err := a.ValidateSession(token); err != nil || u.Username() != "user" {
+		t.Fatal("session not valid:", err)
+	}
+	if _, err = a.ValidateSession(strings.Replace(token, ".", "0.", 1)); !errors.Is(err, ErrInvalidToken) {
+		t.Error("expected ErrInvalidToken for a forged token, got", err)
+	}
+
+	// validating slides the expiration
+	id, _, _ := strings.Cut(token, ".")
+	s, _ := store.Get(id)
+	s.Expires = time.Now().Add(time.Minute)
+	_ = store.Put(s)
+	if _, err = a.ValidateSession(token); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ = store.Get(id); time.Until(s.Expires) < 59*time.Minute {
+		t.Error("expiration not extended:", s.Expires)
+	}
+
+	expired, _ := a.CreateSession("user", time.Minute)
+	id, _, _ = strings.Cut(expired, ".")
+	s, _ = store.Get(id)
+	s.Expires = time.Now().Add(-time.Second)
+	_ = store.Put(s)
+	if _, err = a.ValidateSession(expired); !errors.Is(err, ErrSessionExpired) {
+		t.Error("expected ErrSessionExpired, got", err)
+	}
+
+	if err = a.RevokeSession(token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.ValidateSession(token); !errors.Is(err, ErrInvalidToken) {
+		t.Error("revoked session still valid:", err)
+	}
+
+	t1, _ := a.CreateSession("user", time.Hour)
+	t2, _ := a.CreateSession("user", time.Hour)
+	if err = a.RevokeAllForUser("user"); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{t1, t2} {
+		if _, err = a.ValidateSession(token); !errors.Is(err, ErrInvalidToken) {
+			t.Error("session not revoked:", err)
+		}
+	}
+
+	old, _ := a.CreateSession("user", time.Hour)
+	id, _, _ = strings.Cut(old, ".")
+	s, _ = store.Get(id)
+	s.Expires = time.Now().Add(-time.Second)
+	_ = store.Put(s)
+	store.DeleteExpired(time.Now())
+	if _, ok := store.Get(id); ok {
+		t.Error("expired session not swept")
+	}
+
+	// a session revoked while it is being validated stays revoked
+	a.SetSessionStore(revokingStore{store})
+	token, _ = a.CreateSession("user", time.Hour)
+	if _, err = a.ValidateSession(token); !errors.Is(err, ErrInvalidToken) {
+		t.Error("expected ErrInvalidToken, got", err)
+	}
+	id, _, _ = strings.Cut(token, ".")
+	if _, ok := store.Get(id); ok {
+		t.Error("revoked session brought back")
+	}
+
+	// Close stops the store created by default
+	b := New()
+	if err = b.AddUser("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.CreateSession("user", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	own := b.ownSessions
+	if err = b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-own.done:
+	default:
+		t.Error("default session store not closed")
+	}
+}
+
+// revokingStore deletes sessions right after returning them, like a concurrent RevokeSession would.
+type revokingStore struct {
+	*MemorySessionStore
+}
+
+func (s revokingStore) Get(id string) (Session, bool) {
+	session, ok := s.MemorySessionStore.Get(id)
+	_ = s.Delete(id)
+	return session, ok
+}
+
+func TestTOTP(t *testing.T) {
+	// RFC 4226 appendix D
+	for counter, want := range []string{"755224", "287082", "359152"} {
+		if got := hotp([]byte("12345678901234567890"), uint64(counter)); got != want {
+			t.Errorf("hotp(%d) = %s, expected %s", counter, got, want)
+		}
+	}
+
+	key, _ := box.GenerateKey()
+	store := NewFileStore(filesystem.NewMemoryFilesystem(), "/auth.bin")
+	a, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddUser("admin", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = a.EnrollTOTP("admin", ""); !errors.Is(err, ErrSecretKeyNotSet) {
+		t.Error("expected ErrSecretKeyNotSet, got", err)
+	}
+	if err = a.SetSecretKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.VerifyTOTP("admin", "000000"); !errors.Is(err, ErrTOTPNotEnrolled) {
+		t.Error("expected ErrTOTPNotEnrolled, got", err)
+	}
+
+	uri, codes, err := a.EnrollTOTP("admin", "Example Co")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != "otpauth" || parsed.Host != "totp" || parsed.Path != "/Example Co:admin" {
+		t.Fatal("bad URI", uri)
+	}
+	secret, err := base32Encoding.DecodeString(parsed.Query().Get("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodes {
+		t.Error("expected recovery codes, got", codes)
+	}
+	if u, _ := a.GetUser("admin"); bytes.Contains(u.record().TOTPSecret, secret) {
+		t.Error("TOTP secret stored in clear")
+	}
+	if _, err = a.UseRecoveryCode("admin", codes[0]); !errors.Is(err, ErrTOTPNotEnrolled) {
+		t.Error("recovery code accepted before TOTP is enabled:", err)
+	}
+
+	// the secret survives a restart with the same key
+	a, err = Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.SetSecretKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Authenticate("admin", "password", nil); err != nil {
+		t.Error("TOTP should not be required before it is confirmed:", err)
+	}
+
+	step := uint64(time.Now().Unix() / totpPeriod)
+	if ok, _ := a.VerifyTOTP("admin", hotp(secret, step+5)); ok {
+		t.Error("code out of the window accepted")
+	}
+	if ok, err := a.VerifyTOTP("admin", hotp(secret, step-1)); !ok || err != nil {
+		t.Fatal("previous code rejected:", err)
+	}
+	if ok, _ := a.VerifyTOTP("admin", hotp(secret, step-1)); ok {
+		t.Error("code replayed")
+	}
+	if _, err = a.Authenticate("admin", "password", nil); !errors.Is(err, ErrSecondFactorRequired) {
+		t.Error("expected ErrSecondFactorRequired, got", err)
+	}
+
+	if ok, err := a.UseRecoveryCode("admin", strings.ToLower(codes[3])); !ok || err != nil {
+		t.Error("recovery code rejected:", err)
+	}
+	if ok, _ := a.UseRecoveryCode("admin", codes[3]); ok {
+		t.Error("recovery code reused")
+	}
+	if u, _ := a.GetUser("admin"); u.RecoveryCodesLeft() != recoveryCodes-1 {
+		t.Error("expected one recovery code used, got", u.RecoveryCodesLeft())
+	}
+
+	if err = a.DisableTOTP("admin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Authenticate("admin", "password", nil); err != nil {
+		t.Error(err)
+	}
+
+	// wrong codes lock the account, and logging in with the password again doesn't reset the count
+	if uri, codes, err = a.EnrollTOTP("admin", ""); err != nil {
+		t.Fatal(err)
+	}
+	parsed, _ = url.Parse(uri)
+	secret, _ = base32Encoding.DecodeString(parsed.Query().Get("secret"))
+	// concurrent requests can't both use a code
+	var wg sync.WaitGroup
+	var accepted atomic.Int32
+	for range 8 {
+		wg.Go(func() {
+			if ok, _ := a.VerifyTOTP("admin", hotp(secret, step)); ok {
+				accepted.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+	if accepted.Load() != 1 {
+		t.Fatal("expected the code to be accepted once, got", accepted.Load())
+	}
+	if err = a.Unlock("admin"); err != nil {
+		t.Fatal(err)
+	}
+	a.SetLockoutPolicy(LockoutPolicy{LockAfter: 3, LockDuration: time.Minute})
+	for i := range 3 {
+		if ok, err := a.VerifyTOTP("admin", hotp(secret, step+5)); ok || err != nil {
+			t.Fatal("unexpected result of a wrong code", ok, err)
+		}
+		if i == 0 {
+			if _, err = a.Authenticate("admin", "password", nil); !errors.Is(err, ErrSecondFactorRequired) {
+				t.Fatal("expected ErrSecondFactorRequired, got", err)
+			}
+		}
+	}
+	if _, err = a.VerifyTOTP("admin", hotp(secret, step+1)); !errors.Is(err, ErrAccountLocked) {
+		t.Error("expected ErrAccountLocked, got", err)
+	}
+	if _, err = a.UseRecoveryCode("admin", codes[0]); !errors.Is(err, ErrAccountLocked) {
+		t.Error("expected ErrAccountLocked, got", err)
+	}
+	if _, err = a.Authenticate("admin", "password", nil); !errors.Is(err, ErrInvalidCredentials) {
+		t.Error("expected ErrInvalidCredentials, got", err)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	store := NewFileStore(filesystem.NewMemoryFilesystem(), "/auth.bin")
+	a, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddUser("service", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddUserToACL(nil, "service", Permission(CanRead|CanWrite)); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, key, err := a.CreateAPIKey("service", "ci", Permission(CanRead|CanDelete), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(secret, "ucx_"+key.Prefix()+"_") {
+		t.Error("unexpected key format", secret)
+	}
+	if bytes.Contains(key.record().Hash, []byte(secret)) {
+		t.Error("secret stored in clear")
+	}
+
+	k, u, err := a.VerifyAPIKey(secret)
+	if err != nil || k != key || u.Username() != "service" || k.LastUsed().IsZero() {
+		t.Fatal("key not verified:", err)
+	}
+	if _, _, err = a.VerifyAPIKey(secret[:len(secret)-1]); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Error("expected ErrInvalidAPIKey, got", err)
+	}
+
+	// the key gets the intersection of its scope and its owner's permissions
+	for _, id := range []string{key.Prefix(), key.ID().String()} {
+		if p, ok := a.GetPermission(nil, id); !ok || p != Permission(CanRead) {
+			t.Error("expected read permission only, got", p)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			if _, _, err := a.VerifyAPIKey(secret); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+
+	b, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = b.VerifyAPIKey(secret); err != nil {
+		t.Error("key not persisted:", err)
+	}
+	if len(b.APIKeys("service")) != 1 {
+		t.Error("expected 1 key")
+	}
+
+	expiring, _, err := b.CreateAPIKey("service", "tmp", Permission(CanRead), time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if _, _, err = b.VerifyAPIKey(expiring); !errors.Is(err, ErrAPIKeyExpired) {
+		t.Error("expected ErrAPIKeyExpired, got", err)
+	}
+
+	if err = b.RevokeAPIKey(key.ID().String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = b.VerifyAPIKey(secret); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Error("revoked key still valid:", err)
+	}
+	if err = b.DeleteUser("service"); err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := Open(store); len(c.apiKeys) != 0 {
+		t.Error("keys of a deleted user not removed")
+	}
+}
+
+func TestNestedGroups(t *testing.T) {
+	store := NewFileStore(filesystem.NewMemoryFilesystem(), "/auth.bin")
+	a, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range []string{"staff", "engineering", "backend", "other"} {
+		if err = a.AddGroup(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = a.AddUser("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddUserToGroup("user", "backend"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddGroupToGroup("backend", "engineering"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddGroupToGroup("engineering", "staff"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddGroupToGroup("staff", "backend"); !errors.Is(err, ErrGroupCycle) {
+		t.Error("expected ErrGroupCycle, got", err)
+	}
+	if err = a.AddGroupToGroup("staff", "staff"); !errors.Is(err, ErrGroupCycle) {
+		t.Error("expected ErrGroupCycle, got", err)
+	}
+	if err = a.AddGroupToACL(nil, "staff", Permission(CanRead)); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(a *Auth, want ...string) {
+		t.Helper()
+		groups, err := a.EffectiveGroups("user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make(map[string]bool)
+		for _, g := range groups {
+			names[g.Name()] = true
+		}
+		if len(names) != len(want) {
+			t.Error("expected groups", want, "got", names)
+		}
+		for _, name := range want {
+			if !names[name] {
+				t.Error("missing effective group", name)
+			}
+		}
+	}
+	check(a, "backend", "engineering", "staff")
+	if !hasPermission(a, "user", Permission(CanRead)) || !hasPermission(a, "backend", Permission(CanRead)) {
+		t.Error("permission not inherited from staff")
+	}
+
+	b, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(b, "backend", "engineering", "staff")
+	if g, _ := b.GetGroup("backend"); len(g.ParentNames()) != 1 || g.ParentNames()[0] != "engineering" {
+		t.Error("group hierarchy not restored")
+	}
+
+	if err = b.DeleteGroup("engineering"); err != nil {
+		t.Fatal(err)
+	}
+	check(b, "backend")
+	if hasPermission(b, "user", Permission(CanRead)) {
+		t.Error("permission still inherited after the hierarchy was cut")
+	}
+}
+
+func TestPermissionResolution(t *testing.T) {
+	store := NewFileStore(filesystem.NewMemoryFilesystem(), "/auth.bin")
+	a, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range []string{"readers", "admins"} {
+		if err = a.AddGroup(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = a.AddUser("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range []string{"readers", "admins"} {
+		if err = a.AddUserToGroup("user", g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const high = Permission(1 << 63)
+	if err = a.AddGroupToACL(nil, "readers", Permission(CanRead|CanWrite)); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddGroupToACL(nil, "admins", high); err != nil {
+		t.Fatal(err)
+	}
+
+	if !hasPermission(a, "user", high) {
+		t.Error("expected the highest group permission by default")
+	}
+
+	if err = a.SetACLResolution(nil, ResolveUnion); err != nil {
+		t.Fatal(err)
+	}
+	if !hasPermission(a, "user", high|Permission(CanRead|CanWrite)) {
+		t.Error("expected the union of the group permissions")
+	}
+
+	if err = a.DenyGroupInACL(nil, "admins", Permission(CanWrite)); err != nil {
+		t.Fatal(err)
+	}
+	if !hasPermission(a, "user", high|Permission(CanRead)) {
+		t.Error("expected the deny to be subtracted")
+	}
+
+	e, err := a.ExplainPermission(nil, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := make(map[string]bool)
+	for _, entry := range e.Bit(1) {
+		write[entry.String()] = true
+	}
+	if len(write) != 2 || !write["+group:readers"] || !write["-group:admins"] {
+		t.Error("unexpected explanation of the write bit", write)
+	}
+	if entries := e.Bit(63); len(entries) != 1 || entries[0].Name != "admins" {
+		t.Error("unexpected explanation of the high bit", entries)
+	}
+	if !strings.Contains(e.String(), "bit 1 denied:") || !strings.Contains(e.String(), "bit 63 granted: +group:admins") {
+		t.Error("unexpected explanation", e.String())
+	}
+
+	if err = a.AddUserToACL(nil, "user", Permission(CanExecute)); err != nil {
+		t.Fatal(err)
+	}
+	if !hasPermission(a, "user", high|Permission(CanRead|CanExecute)) {
+		t.Error("expected the user grant to be merged with the groups")
+	}
+	if err = a.SetACLResolution(nil, ResolveOverride); err != nil {
+		t.Fatal(err)
+	}
+	if !hasPermission(a, "user", Permission(CanExecute)) {
+		t.Error("expected the user grant to override the groups")
+	}
+
+	b, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.acl.Resolution() != ResolveOverride {
+		t.Error("resolution not restored")
+	}
+	if err = b.RemoveUserFromACL(nil, "user"); err != nil {
+		t.Fatal(err)
+	}
+	if !hasPermission(b, "user", high|Permission(CanRead)) {
+		t.Error("denies not restored")
+	}
+	if err = b.DenyGroupInACL(nil, "admins", 0); err != nil {
+		t.Fatal(err)
+	}
+	if !hasPermission(b, "user", high|Permission(CanRead|CanWrite)) {
+		t.Error("deny not removed")
+	}
+}
+
+func TestPermissionNames(t *testing.T) {
+	r := NewPermissionRegistry()
+	for name, bits := range map[string]Permission{"read": Permission(CanRead), "write": Permission(CanWrite)} {
+		if err := r.Register(name, bits); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Register("read", Permission(CanDelete)); !errors.Is(err, ErrPermissionExists) {
+		t.Error("expected ErrPermissionExists, got", err)
+	}
+	if err := r.Register("a|b", Permission(CanDelete)); !errors.Is(err, ErrInvalidPermissionName) {
+		t.Error("expected ErrInvalidPermissionName, got", err)
+	}
+
+	p, err := r.Parse("read | write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != Permission(CanRead|CanWrite) {
+		t.Error("unexpected permission", uint64(p))
+	}
+	if _, err = r.Parse("read|admin"); !errors.Is(err, ErrUnknownPermission) {
+		t.Error("expected ErrUnknownPermission, got", err)
+	}
+	if s := r.Format(Permission(CanRead | CanExecute)); s != "read|0x8" {
+		t.Error("unexpected format", s)
+	}
+	if p, _ = r.Parse("read|0x8"); p != Permission(CanRead|CanExecute) {
+		t.Error("format not parsed back", uint64(p))
+	}
+
+	// the JSON encoding uses the default registry
+	if err = RegisterPermission("test-delete", Permission(CanDelete)); err != nil && !errors.Is(err, ErrPermissionExists) {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(map[string]Permission{"user": Permission(CanDelete | CanExecute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"user":["test-delete","0x8"]}` {
+		t.Error("unexpected JSON", string(data))
+	}
+	var got map[string]Permission
+	if err = json.Unmarshal(data, &got); err != nil || got["user"] != Permission(CanDelete|CanExecute) {
+		t.Error("JSON not parsed back", got, err)
+	}
+	if err = json.Unmarshal([]byte(`{"user":"test-delete|4"}`), &got); err != nil || got["user"] != Permission(CanDelete) {
+		t.Error("string form not parsed", got, err)
+	}
+	if err = json.Unmarshal([]byte(`{"user":["nope"]}`), &got); !errors.Is(err, ErrUnknownPermission) {
+		t.Error("expected ErrUnknownPermission, got", err)
+	}
+}
+
+func TestResources(t *testing.T) {
+	store := NewFileStore(filesystem.NewMemoryFilesystem(), "/auth.bin")
+	a, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddGroup("staff"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddUser("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddUserToGroup("user", "staff"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddGroupToACL(nil, "staff", Permission(CanRead)); err != nil {
+		t.Fatal(err)
+	}
+
+	projects := NewACL()
+	if err = a.SetResourceACL("/projects", projects); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddUserToACL(projects, "user", Permission(CanWrite)); err != nil {
+		t.Fatal(err)
+	}
+	docs := NewACL()
+	if err = a.SetResourceACL("/projects/x/docs/", docs); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.DenyGroupInACL(docs, "staff", Permission(CanWrite)); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.SetResourceACL("/other", projects); !errors.Is(err, ErrInvalidResource) {
+		t.Error("expected ErrInvalidResource, got", err)
+	}
+	if err = a.SetResourceInheritance("/secret", false); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(a *Auth) {
+		t.Helper()
+		for _, c := range []struct {
+			path string
+			perm Permission
+			want bool
+		}{
+			{"/", Permission(CanRead), true},
+			{"/", Permission(CanWrite), false},
+			{"/projects/x", Permission(CanRead | CanWrite), true},
+			{"/projects/x/docs/readme", Permission(CanRead), true},
+			{"/projects/x/docs/readme", Permission(CanWrite), false},
+			{"/secret/file", Permission(CanRead), false},
+		} {
+			if got := a.Check("user", c.path, c.perm); got != c.want {
+				t.Errorf("Check(%s, %d) = %v, expected %v", c.path, c.perm, got, c.want)
+			}
+		}
+	}
+	check(a)
+
+	b, err := Open(store) // from the journal
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(b)
+	if list := b.Resources(); len(list) != 3 || list[0] != "/projects" || list[1] != "/projects/x/docs" || list[2] != "/secret" {
+		t.Error("unexpected resources", list)
+	}
+
+	if err = b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Open(store) // from the snapshot
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(c)
+
+	if err = c.DeleteResource("/secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.SetResourceACL("/projects", nil); err != nil {
+		t.Fatal(err)
+	}
+	if c.ResourceACL("/projects") != nil || !c.Check("user", "/secret", Permission(CanRead)) || c.Check("user", "/projects", Permission(CanWrite)) {
+		t.Error("resource changes not applied")
+	}
+	if err = c.DeleteResource("/secret"); !errors.Is(err, ErrResourceNotFound) {
+		t.Error("expected ErrResourceNotFound, got", err)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	store := NewFileStore(filesystem.NewMemoryFilesystem(), "/auth.bin")
+	a, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddGroup("staff"); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{"user", "other"} {
+		if err = a.AddUser(u, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = a.AddUserToGroup("user", "staff"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddRole("viewer", Permission(CanRead)); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddRole("editor", Permission(CanWrite)); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddRole("viewer", Permission(CanRead)); !errors.Is(err, ErrRoleAlreadyExists) {
+		t.Error("expected ErrRoleAlreadyExists, got", err)
+	}
+	if err = a.AddRoleToRole("editor", "viewer"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddRoleToRole("viewer", "editor"); !errors.Is(err, ErrRoleCycle) {
+		t.Error("expected ErrRoleCycle, got", err)
+	}
+	if err = a.AssignRole("staff", "viewer", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AssignRole("user", "editor", "/projects/x"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(a *Auth) {
+		t.Helper()
+		if !a.HasRole("user", "viewer", "/") || a.HasRole("user", "editor", "/") {
+			t.Error("unexpected roles on /")
+		}
+		if !a.HasRole("user", "editor", "/projects/x/docs") || a.HasRole("other", "viewer", "/projects/x") {
+			t.Error("unexpected roles on /projects/x/docs")
+		}
+		if !a.Check("user", "/projects/x/docs", Permission(CanRead|CanWrite)) || a.Check("user", "/projects/y", Permission(CanWrite)) {
+			t.Error("role permissions not applied by Check")
+		}
+	}
+	check(a)
+
+	// an API key only gets the roles of its owner within its scope, with or without ACLs on the way
+	_, key, err := a.CreateAPIKey("user", "reader", Permission(CanRead), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.SetResourceInheritance("/isolated", false); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AssignRole("user", "editor", "/isolated"); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/projects/x", "/isolated"} {
+		if !a.Check(key.Prefix(), path, Permission(CanRead)) || a.Check(key.Prefix(), path, Permission(CanWrite)) {
+			t.Error("API key scope not applied to roles on", path)
+		}
+	}
+
+	b, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(b)
+	if err = b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(c)
+
+	// migrate an ACL, reusing a role with the same permissions
+	if err = c.AddRole("writer", Permission(CanWrite)); err != nil {
+		t.Fatal(err)
+	}
+	acl := NewACL()
+	if err = c.SetResourceACL("/reports", acl); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.AddUserToACL(acl, "other", Permission(CanWrite)); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.AddUserToACL(acl, "user", Permission(CanWrite|CanDelete)); err != nil {
+		t.Fatal(err)
+	}
+	stale := uuid.New() // the grant of a user deleted since
+	acl.users[stale] = Permission(CanRead)
+	list, err := c.MigrateACL(acl, "/reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || len(acl.users) != 1 || acl.users[stale] != Permission(CanRead) {
+		t.Error("unexpected migration", list, acl.users)
+	}
+	if !c.HasRole("other", "writer", "/reports") {
+		t.Error("existing role not reused")
+	}
+	if len(c.Roles()) != 4 || !c.Check("user", "/reports", Permission(CanWrite|CanDelete)) {
+		t.Error("permissions changed by the migration")
+	}
+
+	if err = c.DeleteRole("viewer"); err != nil {
+		t.Fatal(err)
+	}
+	d, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.HasRole("user", "viewer", "/") || d.Check("user", "/", Permission(CanRead)) || !d.HasRole("other", "writer", "/reports") {
+		t.Error("role deletion not persisted")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	for name, bits := range map[string]Permission{"p-read": Permission(CanRead), "p-write": Permission(CanWrite)} {
+		if err := RegisterPermission(name, bits); err != nil && !errors.Is(err, ErrPermissionExists) {
+			t.Fatal(err)
+		}
+	}
+
+	a := New()
+	if err := a.AddGroup("staff"); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{"user", "intern"} {
+		if err := a.AddUser(u, "password"); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.AddUserToGroup(u, "staff"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.AddGroupToACL(nil, "staff", Permission(CanRead|CanWrite)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParsePolicy("allow p-read when ip in nowhere"); !errors.Is(err, ErrInvalidPolicy) {
+		t.Error("expected ErrInvalidPolicy, got", err)
+	}
+	policy, err := ParsePolicy(`
+# writes only during business hours from the office
+require p-write when time in 09:00-17:00 and weekday in mon-fri and ip in 10.1.0.0/16, 192.168.1.10-20
+deny * on /hr when not (group hr or attr department = hr)
+deny p-write when user intern
+allow p-read on /public/*
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetPolicy(policy)
+
+	office := WithClientIP(context.Background(), "10.1.2.3")
+	monday := WithRequestTime(office, time.Date(2026, 10, 12, 10, 30, 0, 0, time.UTC))
+	for _, c := range []struct {
+		ctx      context.Context
+		subject  string
+		resource string
+		action   string
+		want     bool
+	}{
+		{monday, "user", "/projects", "p-write", true},
+		{WithClientIP(monday, "192.168.1.15"), "user", "/projects", "p-write", true},
+		{WithClientIP(monday, "8.8.8.8"), "user", "/projects", "p-write", false},
+		{WithClientIP(monday, "172.16.1.15"), "user", "/projects", "p-write", false}, // same last octet, other network
+		{WithRequestTime(office, time.Date(2026, 10, 12, 18, 0, 0, 0, time.UTC)), "user", "/projects", "p-write", false},
+		{WithRequestTime(office, time.Date(2026, 10, 11, 10, 0, 0, 0, time.UTC)), "user", "/projects", "p-write", false},
+		{WithClientIP(monday, "8.8.8.8"), "user", "/projects", "p-read", true},
+		{monday, "intern", "/projects", "p-write", false},
+		{monday, "user", "/hr/files", "p-read", false},
+		{WithAttributes(monday, map[string]string{"department": "hr"}), "user", "/hr/files", "p-read", true},
+		{monday, "user", "/hrx", "p-read", true},
+		{monday, "user", "/projects", "unknown", false},
+	} {
+		err := a.Authorize(c.ctx, c.subject, c.resource, c.action)
+		if (err == nil) != c.want {
+			t.Errorf("Authorize(%s, %s, %s) = %v, expected allowed %v", c.subject, c.resource, c.action, err, c.want)
+		}
+		if err != nil && !errors.Is(err, ErrAccessDenied) {
+			t.Error("expected ErrAccessDenied, got", err)
+		}
+	}
+
+	if err = a.AddUser("outsider", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Authorize(monday, "outsider", "/public/index", "p-read"); err != nil {
+		t.Error("expected the allow rule to grant access, got", err)
+	}
+	if err = a.Authorize(monday, "outsider", "/projects", "p-read"); !errors.Is(err, ErrAccessDenied) {
+		t.Error("expected ErrAccessDenied, got", err)
+	}
+	if err = a.Authorize(monday, "nobody", "/", "p-read"); !errors.Is(err, ErrUserNotFound) {
+		t.Error("expected ErrUserNotFound, got", err)
+	}
+
+	// ranges spanning networks compare whole addresses
+	if policy, err = ParsePolicy("require p-read when ip in 10.0.0.200-10.0.1.10"); err != nil {
+		t.Fatal(err)
+	}
+	a.SetPolicy(policy)
+	for ip, want := range map[string]bool{"10.0.0.250": true, "10.0.1.5": true, "10.0.1.50": false, "10.0.2.5": false} {
+		if err = a.Authorize(WithClientIP(monday, ip), "user", "/", "p-read"); (err == nil) != want {
+			t.Errorf("Authorize from %s = %v, expected allowed %v", ip, err, want)
+		}
+	}
+	if _, err = ParsePolicy("allow * when ip in 10.0.0.9-1"); !errors.Is(err, ErrInvalidPolicy) {
+		t.Error("expected ErrInvalidPolicy for a reversed range, got", err)
+	}
+
+	// allow rules don't widen the scope of API keys
+	if policy, err = ParsePolicy("allow * on /open/*"); err != nil {
+		t.Fatal(err)
+	}
+	a.SetPolicy(policy)
+	_, key, err := a.CreateAPIKey("outsider", "reader", Permission(CanRead), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Authorize(monday, key.ID().String(), "/open/file", "p-read"); err != nil {
+		t.Error("expected the allow rule to grant access in scope, got", err)
+	}
+	if err = a.Authorize(monday, key.ID().String(), "/open/file", "p-write"); !errors.Is(err, ErrAccessDenied) {
+		t.Error("expected ErrAccessDenied out of scope, got", err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	fs := filesystem.NewMemoryFilesystem()
+	sink, err := NewFileAuditSink(fs, "/audit.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := New()
+	a.SetAuditSink(sink)
+	if err = a.AddUser("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddGroup("staff"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.AddUserToACL(nil, "user", Permission(CanRead)); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.RemoveGroupFromACL(nil, "staff"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Authenticate("user", "wrong", nil); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatal("expected ErrInvalidCredentials, got", err)
+	}
+	a.SetLockoutPolicy(LockoutPolicy{})
+	if _, err = a.Authenticate("user", "password", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Authorize(context.Background(), "user", "/", "unknown"); !errors.Is(err, ErrAccessDenied) {
+		t.Fatal("expected ErrAccessDenied, got", err)
+	}
+	root := a.WithActor("root")
+	if err = root.AddUserToGroup("user", "staff"); err != nil {
+		t.Fatal(err)
+	}
+	if err = root.SetDisabled("user", true); err != nil {
+		t.Fatal(err)
+	}
+	if err = root.SetDisabled("user", false); err != nil {
+		t.Fatal(err)
+	}
+	_, key, err := root.CreateAPIKey("user", "ci", Permission(CanRead), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = root.RevokeAPIKey(key.Prefix()); err != nil {
+		t.Fatal(err)
+	}
+	secretKey, _ := box.GenerateKey()
+	if err = a.SetSecretKey(secretKey); err != nil {
+		t.Fatal(err)
+	}
+	uri, _, err := a.EnrollTOTP("user", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _ := url.Parse(uri)
+	secret, _ := base32Encoding.DecodeString(parsed.Query().Get("secret"))
+	step := uint64(time.Now().Unix() / totpPeriod)
+	if ok, _ := a.VerifyTOTP("user", hotp(secret, step+5)); ok {
+		t.Fatal("code out of the window accepted")
+	}
+	if ok, err := a.VerifyTOTP("user", hotp(secret, step)); !ok || err != nil {
+		t.Fatal("valid code rejected", err)
+	}
+	if _, err = a.Authenticate("user", "password", nil); !errors.Is(err, ErrSecondFactorRequired) {
+		t.Fatal("expected ErrSecondFactorRequired, got", err)
+	}
+	if err = a.DeleteGroup("staff"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new sink resumes the chain
+	sink, err = NewFileAuditSink(fs, "/audit.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetAuditSink(sink)
+	if err = a.DeleteUser("user"); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := VerifyAuditLog(fs, "/audit.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []AuditAction{AuditAddUser, AuditAddGroup, AuditACLGrantUser, AuditACLRevokeGroup, AuditLoginFailure,
+		AuditLoginSuccess, AuditPermissionDenied, AuditJoinGroup, AuditDisableUser, AuditEnableUser, AuditCreateAPIKey,
+		AuditRevokeAPIKey, AuditTOTPFailure, AuditTOTPSuccess, AuditLoginPassword, AuditLeaveGroup, AuditDeleteGroup, AuditDeleteUser}
+	if len(events) != len(want) {
+		t.Fatal("expected", len(want), "events, got", len(events))
+	}
+	for i, e := range events {
+		if e.Action != want[i] || e.Seq != uint64(i+1) {
+			t.Error("unexpected event", i, e.Seq, e.Action)
+		}
+	}
+	if events[2].Subject != "user" || events[2].Resource != "/" || events[2].Permission != Permission(CanRead) {
+		t.Error("unexpected ACL event", events[2])
+	}
+	if events[2].Actor != "" || events[7].Actor != "root" || events[7].Subject != "user" || events[7].Detail != "staff" {
+		t.Error("unexpected actor or membership event", events[2], events[7])
+	}
+
+	data, err := fs.ReadFile("/audit.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(data, []byte(`"permission":1`), []byte(`"permission":7`), 1)
+	if bytes.Equal(tampered, data) {
+		t.Fatal("nothing to tamper with")
+	}
+	if err = fs.WriteFile("/audit.log", tampered); err != nil {
+		t.Fatal(err)
+	}
+	events, err = VerifyAuditLog(fs, "/audit.log")
+	if !errors.Is(err, ErrAuditTampered) || len(events) != 2 {
+		t.Error("expected ErrAuditTampered after 2 events, got", len(events), err)
+	}
+	if _, err = NewFileAuditSink(fs, "/audit.log"); !errors.Is(err, ErrAuditTampered) {
+		t.Error("expected ErrAuditTampered, got", err)
+	}
+}
+
+func TestChangeEvents(t *testing.T) {
+	a := New()
+	ch := a.Subscribe()
+	defer a.Unsubscribe(ch)
+
+	next := func(want ChangeKind) ChangeEvent {
+		t.Helper()
+		select {
+		case e := <-ch:
+			if e.Kind != want {
+				t.Errorf("expected %s, got %s", want, e.Kind)
+			}
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("no event for", want)
+		}
+		return ChangeEvent{}
+	}
+
+	if err := a.AddUser("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := a.GetUser("user")
+	if e := next(UserAdded); e.User != u.ID() {
+		t.Error("unexpected user", e.User)
+	}
+	if err := a.AddGroup("staff"); err != nil {
+		t.Fatal(err)
+	}
+	g, _ := a.GetGroup("staff")
+	next(GroupAdded)
+	if err := a.AddUserToGroup("user", "staff"); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(MembershipChanged); e.User != u.ID() || e.Group != g.ID() {
+		t.Error("unexpected membership event", e)
+	}
+	if err := a.AddUserToGroup("user", "staff"); err != nil { // no change
+		t.Fatal(err)
+	}
+
+	acl := NewACL()
+	if err := a.SetResourceACL("/docs", acl); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(ResourceChanged); e.Resource != "/docs" {
+		t.Error("unexpected resource", e.Resource)
+	}
+	if err := a.AddGroupToACL(acl, "staff", Permission(CanRead)); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(ACLChanged); e.ACL != acl.ID() || e.Group != g.ID() || e.Resource != "/docs" {
+		t.Error("unexpected ACL event", e)
+	}
+
+	_, key, err := a.CreateAPIKey("user", "ci", Permission(CanRead), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := next(APIKeyAdded); e.APIKey != key.ID() || e.User != u.ID() {
+		t.Error("unexpected API key event", e)
+	}
+	if err = a.RevokeAPIKey(key.ID().String()); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(APIKeyRevoked); e.APIKey != key.ID() || e.User != u.ID() {
+		t.Error("unexpected API key event", e)
+	}
+
+	// a subscriber falling behind gets StateReplaced in place of the events it missed
+	for i := range 20 {
+		if err = a.SetAttribute("user", "n", strconv.Itoa(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range cap(ch) - 1 {
+		next(UserChanged)
+	}
+	next(StateReplaced)
+	if err = a.SetAttribute("user", "n", ""); err != nil {
+		t.Fatal(err)
+	}
+	next(UserChanged)
+
+	if err := a.DeleteUser("user"); err != nil {
+		t.Fatal(err)
+	}
+	next(MembershipChanged)
+	next(UserDeleted)
+
+	a.Unsubscribe(ch)
+	if _, ok := <-ch; ok {
+		t.Error("channel not closed")
+	}
+}
+
+func TestUserProfile(t *testing.T) {
+	store := NewFileStore(filesystem.NewMemoryFilesystem(), "/auth.bin")
+	a, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{"user", "other"} {
+		if err = a.AddUser(u, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = a.SetDisplayName("user", "Some User"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.SetEmail("user", "not an email"); !errors.Is(err, ErrInvalidEmail) {
+		t.Error("expected ErrInvalidEmail, got", err)
+	}
+	if err = a.SetEmail("user", "User@Example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.SetEmail("other", "user@example.com"); !errors.Is(err, ErrEmailInUse) {
+		t.Error("expected ErrEmailInUse, got", err)
+	}
+	if u, ok := a.GetUserByEmail("user@EXAMPLE.com"); !ok || u.Username() != "user" {
+		t.Error("user not found by email")
+	}
+	if err = a.SetAttribute("user", "department", "hr"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.SetAttribute("user", "office", "paris"); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.SetAttribute("user", "office", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := Open(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = Open(store); err != nil {
+		t.Fatal(err)
+	}
+	u, ok := b.GetUserByEmail("user@example.com")
+	if !ok {
+		t.Fatal("email index not restored")
+	}
+	if u.DisplayName() != "Some User" || u.Email() != "User@Example.com" {
+		t.Error("unexpected profile", u.DisplayName(), u.Email())
+	}
+	if attrs := u.Attributes(); len(attrs) != 1 || attrs["department"] != "hr" {
+		t.Error("unexpected attributes", attrs)
+	}
+
+	// attributes can be read while they are set
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for i := range 100 {
+			_ = b.SetAttribute("user", "counter", strconv.Itoa(i))
+		}
+	})
+	for range 100 {
+		_, _ = u.Attribute("counter")
+		_ = u.Attributes()
+	}
+	wg.Wait()
+	if v, _ := u.Attribute("counter"); v != "99" {
+		t.Error("unexpected attribute", v)
+	}
+
+	// stored attributes are available to the policy, the request ones take precedence
+	if err = RegisterPermission("p-read", Permission(CanRead)); err != nil && !errors.Is(err, ErrPermissionExists) {
+		t.Fatal(err)
+	}
+	policy, err := ParsePolicy("deny * on /hr when not attr department = hr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetPolicy(policy)
+	if err = b.AddUserToACL(nil, "user", Permission(CanRead)); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = b.Authorize(ctx, "user", "/hr", "p-read"); err != nil {
+		t.Error("expected the stored attribute to grant access, got", err)
+	}
+	if err = b.Authorize(WithAttributes(ctx, map[string]string{"department": "it"}), "user", "/hr", "p-read"); !errors.Is(err, ErrAccessDenied) {
+		t.Error("expected ErrAccessDenied, got", err)
+	}
+
+	token, err := b.CreateSession("user", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _, err := b.CreateAPIKey("user", "ci", Permission(CanRead), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.SetDisabled("user", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Authenticate("user", "password", nil); !errors.Is(err, ErrAccountDisabled) {
+		t.Error("expected ErrAccountDisabled, got", err)
+	}
+	if _, err = b.ValidateSession(token); !errors.Is(err, ErrAccountDisabled) {
+		t.Error("expected ErrAccountDisabled, got", err)
+	}
+	if _, _, err = b.VerifyAPIKey(secret); !errors.Is(err, ErrAccountDisabled) {
+		t.Error("expected ErrAccountDisabled, got", err)
+	}
+	if _, ok = b.GetPermission(nil, "user"); ok || b.Check("user", "/", Permission(CanRead)) {
+		t.Error("disabled user still has permissions")
+	}
+	if err = b.Authorize(ctx, "user", "/hr", "p-read"); !errors.Is(err, ErrAccessDenied) || !errors.Is(err, ErrAccountDisabled) {
+		t.Error("expected ErrAccessDenied for a disabled user, got", err)
+	}
+	if err = b.SetDisabled("user", false); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.SetExpiry("user", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Authenticate("user", "password", nil); !errors.Is(err, ErrAccountExpired) {
+		t.Error("expected ErrAccountExpired, got", err)
+	}
+	if b.Check("user", "/", Permission(CanRead)) {
+		t.Error("expired user still has permissions")
+	}
+	if err = b.Authorize(ctx, "user", "/hr", "p-read"); !errors.Is(err, ErrAccessDenied) {
+		t.Error("expected ErrAccessDenied for an expired user, got", err)
+	}
+	if err = b.SetExpiry("user", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Authenticate("user", "password", nil); err != nil {
+		t.Error(err)
+	}
+
+	if err = b.DeleteUser("user"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = b.GetUserByEmail("user@example.com"); ok {
+		t.Error("deleted user still found by email")
+	}
+	if err = b.SetEmail("other", "user@example.com"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDirectory(t *testing.T) {
+	src := New()
+	for _, g := range []string{"staff", "dev"} {
+		if err := src.AddGroup(g); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.AddGroupToGroup("dev", "staff"); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{"alice", "bob"} {
+		if err := src.AddUser(u, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, err := range []error{
+		src.AddUserToGroup("alice", "dev"),
+		src.AddUserToGroup("bob", "staff"),
+		src.SetDisplayName("alice", "Alice Ünïcode"),
+		src.SetEmail("alice", "alice@example.com"),
+		src.SetAttribute("alice", "department", "r&d"),
+		src.SetDisabled("bob", true),
+		src.SetExpiry("bob", time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	exported := src.ExportDirectory()
+
+	formats := map[string]func() (*Directory, error){
+		"ldif": func() (*Directory, error) {
+			var buf bytes.Buffer
+			if err := exported.WriteLDIF(&buf, "dc=example,dc=org"); err != nil {
+				return nil, err
+			}
+			return ReadLDIF(&buf)
+		},
+		"csv": func() (*Directory, error) {
+			var buf bytes.Buffer
+			if err := exported.WriteCSV(&buf); err != nil {
+				return nil, err
+			}
+			return ReadCSV(&buf)
+		},
+		"passwd": func() (*Directory, error) {
+			var passwd, group bytes.Buffer
+			d := *exported
+			d.Users = slices.Clone(d.Users)
+			d.Users[0].DisplayName = "Alice" // no commas or colons, but non-ASCII is fine either way
+			if err := d.WritePasswd(&passwd, &group); err != nil {
+				return nil, err
+			}
+			return ReadPasswd(&passwd, &group)
+		},
+	}
+	for name, read := range formats {
+		t.Run(name, func(t *testing.T) {
+			d, err := read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst := New()
+			changes, err := dst.ImportDirectory(d, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(changes) == 0 || len(dst.Users()) != 0 || len(dst.Groups()) != 0 {
+				t.Fatal("dry run changed something, or found nothing to do", changes)
+			}
+			if _, err = dst.ImportDirectory(d, false); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, u := range []string{"alice", "bob"} {
+				if ok, err := dst.VerifyPassword(u, "password"); !ok || err != nil {
+					t.Error("password not imported for", u, err)
+				}
+			}
+			alice, _ := dst.GetUser("alice")
+			bob, _ := dst.GetUser("bob")
+			if alice.Email() != "alice@example.com" || !alice.HasGroup("dev") || alice.HasGroup("staff") {
+				t.Error("unexpected alice", alice.Email(), alice.GroupNames())
+			}
+			if !bob.Disabled() || !bob.HasGroup("staff") {
+				t.Error("unexpected bob", bob.Disabled(), bob.GroupNames())
+			}
+			dev, _ := dst.GetGroup("dev")
+			if name != "csv" && !slices.Equal(dev.ParentNames(), []string{"staff"}) {
+				t.Error("nesting not imported", dev.ParentNames())
+			}
+			if name != "passwd" {
+				if v, _ := alice.Attribute("department"); v != "r&d" {
+					t.Error("attribute not imported", alice.Attributes())
+				}
+				if !bob.Expires().Equal(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)) {
+					t.Error("expiry not imported", bob.Expires())
+				}
+			}
+			if name == "ldif" && alice.DisplayName() != "Alice Ünïcode" {
+				t.Error("display name not imported", alice.DisplayName())
+			}
+
+			if changes, err = dst.ImportDirectory(d, true); err != nil || len(changes) != 0 {
+				t.Error("expected no more changes, got", changes, err)
+			}
+		})
+	}
+
+	// changes to existing users and groups
+	dst := New()
+	if _, err := dst.ImportDirectory(exported, false); err != nil {
+		t.Fatal(err)
+	}
+	d := &Directory{
+		Users:  []DirectoryUser{{Username: "alice", Email: "alice@example.org", Groups: []string{"staff", "ops"}}},
+		Groups: []DirectoryGroup{{Name: "dev", Parents: []string{"ops"}}},
+	}
+	changes, err := dst.ImportDirectory(d, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+	want := []string{
+		"+ group ops",
+		"+ group dev in ops",
+		"- group dev in staff",
+		"~ user alice: display_name, email",
+		"+ alice in staff",
+		"+ alice in ops",
+		"- alice in dev",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("unexpected changes\n%s\nexpected\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if u, _ := dst.GetUserByEmail("alice@example.org"); u == nil || u.Username() != "alice" {
+		t.Error("email not updated")
+	}
+	if ok, _ := dst.VerifyPassword("alice", "password"); !ok {
+		t.Error("password changed without a hash")
+	}
+	if v, _ := dst.GetUser("alice"); v.Attributes()["department"] != "r&d" {
+		t.Error("nil attributes should be left alone")
+	}
+
+	// the fields a source doesn't carry are left alone
+	partial, err := ReadCSV(strings.NewReader("username,groups\nalice,staff;ops\nbob,staff\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes, err = dst.ImportDirectory(partial, true); err != nil || len(changes) != 0 {
+		t.Error("expected no changes from a partial CSV, got", changes, err)
+	}
+	partial, err = ReadCSV(strings.NewReader("username,disabled\nbob,false\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes, err = dst.ImportDirectory(partial, true); err != nil || len(changes) != 1 || changes[0].String() != "~ user bob: disabled" {
+		t.Error("expected only bob to be enabled, got", changes, err)
+	}
+	foreign := "dn: uid=alice,ou=people,dc=example,dc=org\nobjectClass: inetOrgPerson\nuid: alice\nmail: alice@example.org\n" +
+		"userPassword: {SSHA}c2FsdGVkaGFzaA==\n"
+	if d, err = ReadLDIF(strings.NewReader(foreign)); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err = dst.ImportDirectory(d, true); err != nil || len(changes) != 2 || changes[0].Kind != DirectoryLeaveGroup {
+		t.Error("expected the attributes and password to be kept, got", changes, err)
+	}
+
+	for _, bad := range []*Directory{
+		{Users: []DirectoryUser{{Username: "x"}, {Username: "x"}}},
+		{Users: []DirectoryUser{{Username: "x", PasswordHash: "$6$salt$hash"}}},
+		{Users: []DirectoryUser{{Username: "x", Email: "bob@example.com"}, {Username: "y", Email: "BOB@example.com"}}},
+	} {
+		if _, err = dst.ImportDirectory(bad, true); err == nil {
+			t.Error("expected an error for", bad.Users)
+		}
+	}
+	if _, err = ReadCSV(strings.NewReader("name,password\n")); !errors.Is(err, ErrInvalidDirectory) {
+		t.Error("expected ErrInvalidDirectory, got", err)
+	}
+
+	// users can swap their addresses
+	if err = dst.SetEmail("bob", "bob@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	swap := &Directory{Users: []DirectoryUser{
+		{Username: "alice", Email: "bob@example.org", Missing: ^FieldEmail},
+		{Username: "bob", Email: "alice@example.org", Missing: ^FieldEmail},
+	}}
+	if _, err = dst.ImportDirectory(swap, false); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := dst.GetUserByEmail("alice@example.org"); u == nil || u.Username() != "bob" {
+		t.Error("emails not swapped")
+	}
+
+	// a hash that is Missing isn't used
+	hash, _ := newPasswordHash("password", legacyHashParams)
+	carol := &Directory{Users: []DirectoryUser{{Username: "carol", PasswordHash: hash.String(), Missing: FieldPassword}}}
+	if _, err = dst.ImportDirectory(carol, false); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := dst.VerifyPassword("carol", "password"); ok {
+		t.Error("missing password hash imported")
+	}
+
+	// an imported password is set like any other
+	token, err := dst.CreateSession("alice", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if _, err = dst.Authenticate("alice", "wrong", nil); !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatal("expected ErrInvalidCredentials, got", err)
+	}
+	reset := &Directory{Users: []DirectoryUser{{Username: "alice", PasswordHash: hash.String(), Missing: ^FieldPassword}}}
+	if _, err = dst.ImportDirectory(reset, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dst.ValidateSession(token); !errors.Is(err, ErrInvalidToken) {
+		t.Error("session kept after the password was imported:", err)
+	}
+	if u, _ := dst.GetUser("alice"); u.FailedAttempts() != 0 {
+		t.Error("failed logins kept after the password was imported")
+	}
+}
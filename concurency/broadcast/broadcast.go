@@ -7,6 +7,7 @@ import (
 type Broadcaster[T any] struct {
 	mu          sync.Mutex
 	subscribers map[chan T]struct{}
+	overflow    *T
 }
 
 func New[T any]() *Broadcaster[T] {
@@ -24,12 +25,23 @@ func (b *Broadcaster[T]) Subscribe() <-chan T {
 	return ch
 }
 
+// SetOverflow makes subscribers that fall behind receive v in place of the data they miss.
+// The last slot of their channel is kept for it, so a full channel always ends with v.
+func (b *Broadcaster[T]) SetOverflow(v T) {
+	b.mu.Lock()
+	b.overflow = &v
+	b.mu.Unlock()
+}
+
 // Unsubscribe removes a subscriber and closes its channel
-func (b *Broadcaster[T]) Unsubscribe(ch chan T) {
+func (b *Broadcaster[T]) Unsubscribe(ch <-chan T) {
 	b.mu.Lock()
-	if _, ok := b.subscribers[ch]; ok {
-		delete(b.subscribers, ch)
-		close(ch)
+	for sub := range b.subscribers {
+		if (<-chan T)(sub) == ch {
+			delete(b.subscribers, sub)
+			close(sub)
+			break
+		}
 	}
 	b.mu.Unlock()
 }
@@ -48,6 +60,13 @@ func (b *Broadcaster[T]) Publish(data T) {
 				}
 			}()
 
+			if b.overflow != nil && len(ch) >= cap(ch)-1 {
+				if len(ch) < cap(ch) {
+					ch <- *b.overflow
+				}
+				return // the overflow value stands for the data dropped
+			}
+
 			select {
 			case ch <- data:
 				// sent
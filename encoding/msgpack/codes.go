@@ -0,0 +1,98 @@
+package msgpack
+
+// MessagePack format codes as defined by https://github.com/msgpack/msgpack/blob/master/spec.md
+const (
+	posFixintMax byte = 0x7f
+	negFixintMin byte = 0xe0
+
+	fixmapMin   byte = 0x80
+	fixmapMax   byte = 0x8f
+	fixarrayMin byte = 0x90
+	fixarrayMax byte = 0x9f
+	fixstrMin   byte = 0xa0
+	fixstrMax   byte = 0xbf
+
+	codeNil   byte = 0xc0
+	codeFalse byte = 0xc2
+	codeTrue  byte = 0xc3
+
+	codeBin8  byte = 0xc4
+	codeBin16 byte = 0xc5
+	codeBin32 byte = 0xc6
+
+	codeExt8  byte = 0xc7
+	codeExt16 byte = 0xc8
+	codeExt32 byte = 0xc9
+
+	codeFloat32 byte = 0xca
+	codeFloat64 byte = 0xcb
+
+	codeUint8  byte = 0xcc
+	codeUint16 byte = 0xcd
+	codeUint32 byte = 0xce
+	codeUint64 byte = 0xcf
+
+	codeInt8  byte = 0xd0
+	codeInt16 byte = 0xd1
+	codeInt32 byte = 0xd2
+	codeInt64 byte = 0xd3
+
+	codeFixExt1  byte = 0xd4
+	codeFixExt2  byte = 0xd5
+	codeFixExt4  byte = 0xd6
+	codeFixExt8  byte = 0xd7
+	codeFixExt16 byte = 0xd8
+
+	codeStr8  byte = 0xd9
+	codeStr16 byte = 0xda
+	codeStr32 byte = 0xdb
+
+	codeArray16 byte = 0xdc
+	codeArray32 byte = 0xdd
+
+	codeMap16 byte = 0xde
+	codeMap32 byte = 0xdf
+)
+
+// Type is the family a MessagePack value belongs to, regardless of the exact wire format used.
+type Type uint8
+
+const (
+	InvalidType Type = iota
+	NilType
+	BoolType
+	IntType
+	UintType
+	FloatType
+	StrType
+	BinType
+	ArrayType
+	MapType
+	ExtType
+)
+
+func (t Type) String() string {
+	switch t {
+	case NilType:
+		return "nil"
+	case BoolType:
+		return "bool"
+	case IntType:
+		return "int"
+	case UintType:
+		return "uint"
+	case FloatType:
+		return "float"
+	case StrType:
+		return "str"
+	case BinType:
+		return "bin"
+	case ArrayType:
+		return "array"
+	case MapType:
+		return "map"
+	case ExtType:
+		return "ext"
+	}
+	return "invalid"
+}
@@ -0,0 +1,785 @@
+package msgpack
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+// maxPrealloc caps the memory reserved up front for a container based on its (untrusted) declared length.
+const maxPrealloc = 64 * 1024
+
+// maxDepth caps the nesting of containers, which are decoded recursively, so that hostile input can't
+// exhaust the stack.
+const maxDepth = 10000
+
+// Ext is an extension value with no registered Go type.
+type Ext struct {
+	Type int8
+	Data []byte
+}
+
+// MarshalMsgpack implements Marshaler.
+func (e Ext) MarshalMsgpack() ([]byte, error) {
+	return append(appendExtHeader(nil, e.Type, len(e.Data)), e.Data...), nil
+}
+
+// UnmarshalMsgpack implements Unmarshaler.
+func (e *Ext) UnmarshalMsgpack(data []byte) error {
+	d := newBytesDecoder(data)
+	h, err := d.readHeader()
+	if err != nil {
+		return err
+	}
+	if h.typ != ExtType {
+		return d.mismatch(h, reflect.TypeFor[Ext]())
+	}
+	e.Type = h.ext
+	e.Data, err = d.readBytes(h.length)
+	return err
+}
+
+// Decoder reads MessagePack values from an input stream.
+type Decoder struct {
+	r   source
+	buf [8]byte
+
+	capturing int    // nesting level of readRaw calls in progress
+	raw       []byte // bytes consumed while capturing
+	depth     int    // nesting level of the containers being read
+}
+
+// NewDecoder returns a new decoder that reads from r. The decoder introduces its own buffering
+// and may read data from r beyond the values requested.
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br}
+}
+
+func newBytesDecoder(data []byte) *Decoder {
+	return &Decoder{r: &sliceReader{data: data}}
+}
+
+// Decode reads the next MessagePack value from its input and stores it in the value pointed to by v.
+func (d *Decoder) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return ErrInvalidTarget
+	}
+	return d.decodeValue(rv.Elem())
+}
+
+// header describes a value whose leading code (and for scalars, payload) has been consumed.
+// For str, bin and ext values the payload of length bytes is still pending.
+type header struct {
+	typ    Type
+	length int
+	ext    int8
+	b      bool
+	i      int64
+	u      uint64
+	f      float64
+	single bool // the float was encoded as float32
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if d.capturing > 0 {
+		d.raw = append(d.raw, c)
+	}
+	return c, nil
+}
+
+func (d *Decoder) peekByte() (byte, error) {
+	p, err := d.r.Peek(1)
+	if len(p) == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	return p[0], nil
+}
+
+func (d *Decoder) readFull(p []byte) error {
+	if _, err := io.ReadFull(d.r, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if d.capturing > 0 {
+		d.raw = append(d.raw, p...)
+	}
+	return nil
+}
+
+// readBytes returns the next n bytes in a new slice. Large lengths are read incrementally so a
+// corrupt header cannot force a huge allocation.
+func (d *Decoder) readBytes(n int) ([]byte, error) {
+	if n <= maxPrealloc {
+		p := make([]byte, n)
+		return p, d.readFull(p)
+	}
+	p := make([]byte, 0, maxPrealloc)
+	for len(p) < n {
+		chunk := min(n-len(p), maxPrealloc)
+		p = append(p, make([]byte, chunk)...)
+		if err := d.readFull(p[len(p)-chunk:]); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (d *Decoder) discard(n int) error {
+	if d.capturing > 0 {
+		_, err := d.readBytes(n)
+		return err
+	}
+	if m, err := d.r.Discard(n); m < n {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+func (d *Decoder) readUint(n int) (uint64, error) {
+	p := d.buf[:n]
+	if err := d.readFull(p); err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return uint64(p[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(p)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(p)), nil
+	}
+	return binary.BigEndian.Uint64(p), nil
+}
+
+func (d *Decoder) readLength(n int) (int, error) {
+	l, err := d.readUint(n)
+	return int(l), err
+}
+
+func (d *Decoder) readExtHeader(length int) (header, error) {
+	t, err := d.readByte()
+	return header{typ: ExtType, length: length, ext: int8(t)}, err
+}
+
+func (d *Decoder) readHeader() (header, error) {
+	c, err := d.readByte()
+	if err != nil {
+		return header{}, err
+	}
+
+	switch {
+	case c <= posFixintMax:
+		return header{typ: IntType, i: int64(c)}, nil
+	case c >= negFixintMin:
+		return header{typ: IntType, i: int64(int8(c))}, nil
+	case c >= fixmapMin && c <= fixmapMax:
+		return header{typ: MapType, length: int(c & 0x0f)}, nil
+	case c >= fixarrayMin && c <= fixarrayMax:
+		return header{typ: ArrayType, length: int(c & 0x0f)}, nil
+	case c >= fixstrMin && c <= fixstrMax:
+		return header{typ: StrType, length: int(c & 0x1f)}, nil
+	}
+
+	var h header
+	switch c {
+	case codeNil:
+		h.typ = NilType
+	case codeFalse, codeTrue:
+		h.typ, h.b = BoolType, c == codeTrue
+	case codeBin8, codeBin16, codeBin32:
+		h.typ = BinType
+		h.length, err = d.readLength(1 << (c - codeBin8))
+	case codeStr8, codeStr16, codeStr32:
+		h.typ = StrType
+		h.length, err = d.readLength(1 << (c - codeStr8))
+	case codeArray16, codeArray32:
+		h.typ = ArrayType
+		h.length, err = d.readLength(2 << (c - codeArray16))
+	case codeMap16, codeMap32:
+		h.typ = MapType
+		h.length, err = d.readLength(2 << (c - codeMap16))
+	case codeExt8, codeExt16, codeExt32:
+		var l int
+		if l, err = d.readLength(1 << (c - codeExt8)); err != nil {
+			return h, err
+		}
+		return d.readExtHeader(l)
+	case codeFixExt1, codeFixExt2, codeFixExt4, codeFixExt8, codeFixExt16:
+		return d.readExtHeader(1 << (c - codeFixExt1))
+	case codeFloat32:
+		var u uint64
+		u, err = d.readUint(4)
+		h.typ, h.f, h.single = FloatType, float64(math.Float32frombits(uint32(u))), true
+	case codeFloat64:
+		h.typ = FloatType
+		h.u, err = d.readUint(8)
+		h.f = math.Float64frombits(h.u)
+	case codeUint8, codeUint16, codeUint32, codeUint64:
+		h.typ = UintType
+		h.u, err = d.readUint(1 << (c - codeUint8))
+	case codeInt8:
+		h.typ = IntType
+		h.u, err = d.readUint(1)
+		h.i = int64(int8(h.u))
+	case codeInt16:
+		h.typ = IntType
+		h.u, err = d.readUint(2)
+		h.i = int64(int16(h.u))
+	case codeInt32:
+		h.typ = IntType
+		h.u, err = d.readUint(4)
+		h.i = int64(int32(h.u))
+	case codeInt64:
+		h.typ = IntType
+		h.u, err = d.readUint(8)
+		h.i = int64(h.u)
+	default:
+		return h, fmt.Errorf("%w: 0x%02x", ErrInvalidCode, c)
+	}
+	return h, err
+}
+
+// enter is called before reading the content of a container, and leave after.
+func (d *Decoder) enter() error {
+	if d.depth >= maxDepth {
+		return ErrMaxDepth
+	}
+	d.depth++
+	return nil
+}
+
+func (d *Decoder) leave() {
+	d.depth--
+}
+
+// skip consumes the next value without decoding it.
+func (d *Decoder) skip() error {
+	h, err := d.readHeader()
+	if err != nil {
+		return err
+	}
+	return d.skipPayload(h)
+}
+
+func (d *Decoder) skipPayload(h header) error {
+	switch h.typ {
+	case StrType, BinType, ExtType:
+		return d.discard(h.length)
+	case ArrayType, MapType:
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+		n := h.length
+		if h.typ == MapType {
+			n *= 2
+		}
+		for i := 0; i < n; i++ {
+			if err := d.skip(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Skip consumes the next value without decoding it. Skipping never allocates, which makes it the
+// cheap way to step over the parts of a message that are not needed.
+func (d *Decoder) Skip() error {
+	return d.skip()
+}
+
+// readRaw returns the encoding of the next value. When decoding from memory the result aliases
+// the input, otherwise it is a copy.
+func (d *Decoder) readRaw() ([]byte, error) {
+	if s, ok := d.r.(*sliceReader); ok && d.capturing == 0 {
+		start := s.off
+		err := d.skip()
+		return s.data[start:s.off:s.off], err
+	}
+
+	start := len(d.raw)
+	d.capturing++
+	err := d.skip()
+	d.capturing--
+
+	raw := bytes.Clone(d.raw[start:])
+	if d.capturing == 0 {
+		d.raw = d.raw[:0]
+	}
+	return raw, err
+}
+
+func (d *Decoder) decodeValue(v reflect.Value) error {
+	if c := extByType(v.Type()); c != nil {
+		return d.decodeExt(c, v)
+	}
+
+	if v.Kind() == reflect.Pointer {
+		c, err := d.peekByte()
+		if err != nil {
+			return err
+		}
+		if c == codeNil {
+			_, _ = d.readByte()
+			v.SetZero()
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decodeValue(v.Elem())
+	}
+
+	if handled, err := d.decodeCustom(v); handled {
+		return err
+	}
+
+	h, err := d.readHeader()
+	if err != nil {
+		return err
+	}
+	return d.decodeInto(h, v)
+}
+
+// decodeCustom handles the types that know how to decode themselves, reporting whether it did.
+func (d *Decoder) decodeCustom(v reflect.Value) (bool, error) {
+	if !v.CanAddr() {
+		return false, nil
+	}
+	t := v.Type()
+	pt := reflect.PointerTo(t)
+
+	if c := extByType(pt); c != nil {
+		return true, d.decodeExt(c, v)
+	}
+
+	switch {
+	case t == rawMessageType:
+		raw, err := d.readRaw()
+		if err != nil {
+			return true, err
+		}
+		v.SetBytes(raw)
+		return true, nil
+	case pt.Implements(unmarshalerType):
+		raw, err := d.readRaw()
+		if err != nil {
+			return true, err
+		}
+		return true, v.Addr().Interface().(Unmarshaler).UnmarshalMsgpack(raw)
+	case t == timeType:
+		h, err := d.readHeader()
+		if err != nil {
+			return true, err
+		}
+		if h.typ == NilType {
+			v.SetZero()
+			return true, nil
+		}
+		if h.typ != ExtType || h.ext != TimestampExt {
+			return true, d.mismatch(h, t)
+		}
+		data, err := d.readBytes(h.length)
+		if err != nil {
+			return true, err
+		}
+		tm, err := parseTime(data)
+		if err != nil {
+			return true, err
+		}
+		v.Set(reflect.ValueOf(tm))
+		return true, nil
+	case pt.Implements(binaryUnmarshalerType), pt.Implements(streamUnmarshalerType):
+		h, err := d.readHeader()
+		if err != nil {
+			return true, err
+		}
+		if h.typ == NilType {
+			return true, nil
+		}
+		if h.typ != BinType && h.typ != StrType {
+			return true, d.mismatch(h, t)
+		}
+		data, err := d.readBytes(h.length)
+		if err != nil {
+			return true, err
+		}
+		if u, ok := v.Addr().Interface().(encoding.BinaryUnmarshaler); ok {
+			return true, u.UnmarshalBinary(data)
+		}
+		return true, v.Addr().Interface().(StreamUnmarshaler).UnmarshalBinary(bytes.NewReader(data))
+	}
+	return false, nil
+}
+
+// mismatch consumes the rest of the value described by h and reports it can't be stored in t.
+func (d *Decoder) mismatch(h header, t reflect.Type) error {
+	if err := d.skipPayload(h); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: cannot decode %s into %s", ErrTypeMismatch, h.typ, t)
+}
+
+func (d *Decoder) decodeInto(h header, v reflect.Value) error {
+	if h.typ == NilType {
+		v.SetZero()
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if h.typ != BoolType {
+			return d.mismatch(h, v.Type())
+		}
+		v.SetBool(h.b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch h.typ {
+		case IntType:
+			i = h.i
+		case UintType:
+			if h.u > math.MaxInt64 {
+				return fmt.Errorf("%w: %d into %s", ErrOverflow, h.u, v.Type())
+			}
+			i = int64(h.u)
+		default:
+			return d.mismatch(h, v.Type())
+		}
+		if v.OverflowInt(i) {
+			return fmt.Errorf("%w: %d into %s", ErrOverflow, i, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		switch h.typ {
+		case IntType:
+			if h.i < 0 {
+				return fmt.Errorf("%w: %d into %s", ErrOverflow, h.i, v.Type())
+			}
+			u = uint64(h.i)
+		case UintType:
+			u = h.u
+		default:
+			return d.mismatch(h, v.Type())
+		}
+		if v.OverflowUint(u) {
+			return fmt.Errorf("%w: %d into %s", ErrOverflow, u, v.Type())
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		switch h.typ {
+		case IntType:
+			v.SetFloat(float64(h.i))
+		case UintType:
+			v.SetFloat(float64(h.u))
+		case FloatType:
+			v.SetFloat(h.f)
+		default:
+			return d.mismatch(h, v.Type())
+		}
+	case reflect.String:
+		if h.typ != StrType && h.typ != BinType {
+			return d.mismatch(h, v.Type())
+		}
+		data, err := d.readBytes(h.length)
+		if err != nil {
+			return err
+		}
+		v.SetString(string(data))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 && (h.typ == StrType || h.typ == BinType) {
+			data, err := d.readBytes(h.length)
+			if err != nil {
+				return err
+			}
+			v.SetBytes(data)
+			return nil
+		}
+		if h.typ != ArrayType {
+			return d.mismatch(h, v.Type())
+		}
+		return d.decodeSlice(h, v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 && (h.typ == StrType || h.typ == BinType) {
+			data, err := d.readBytes(h.length)
+			if err != nil {
+				return err
+			}
+			reflect.Copy(v, reflect.ValueOf(data))
+			return nil
+		}
+		if h.typ != ArrayType {
+			return d.mismatch(h, v.Type())
+		}
+		return d.decodeArray(h, v)
+	case reflect.Map:
+		if h.typ != MapType {
+			return d.mismatch(h, v.Type())
+		}
+		return d.decodeMap(h, v)
+	case reflect.Struct:
+		if h.typ != MapType {
+			return d.mismatch(h, v.Type())
+		}
+		return d.decodeStruct(h, v)
+	case reflect.Interface:
+		if !v.IsNil() && v.Elem().Kind() == reflect.Pointer && !v.Elem().IsNil() {
+			return d.decodeInto(h, v.Elem().Elem())
+		}
+		if v.NumMethod() != 0 {
+			return d.mismatch(h, v.Type())
+		}
+		val, err := d.decodeInterface(h)
+		if err != nil {
+			return err
+		}
+		if val == nil {
+			v.SetZero()
+		} else {
+			v.Set(reflect.ValueOf(val))
+		}
+	default:
+		if err := d.skipPayload(h); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %s", ErrUnsupportedType, v.Type())
+	}
+	return nil
+}
+
+func (d *Decoder) decodeSlice(h header, v reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	s := reflect.MakeSlice(v.Type(), 0, min(h.length, maxPrealloc))
+	zero := reflect.Zero(v.Type().Elem())
+	for i := 0; i < h.length; i++ {
+		s = reflect.Append(s, zero)
+		if err := d.decodeValue(s.Index(i)); err != nil {
+			return err
+		}
+	}
+	v.Set(s)
+	return nil
+}
+
+func (d *Decoder) decodeArray(h header, v reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	for i := 0; i < h.length; i++ {
+		if i >= v.Len() {
+			if err := d.skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.decodeValue(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	for i := h.length; i < v.Len(); i++ {
+		v.Index(i).SetZero()
+	}
+	return nil
+}
+
+func (d *Decoder) decodeMap(h header, v reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	t := v.Type()
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(t, min(h.length, maxPrealloc)))
+	}
+	for i := 0; i < h.length; i++ {
+		key := reflect.New(t.Key()).Elem()
+		if err := d.decodeValue(key); err != nil {
+			return err
+		}
+		val := reflect.New(t.Elem()).Elem()
+		if err := d.decodeValue(val); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, val)
+	}
+	return nil
+}
+
+func (d *Decoder) decodeStruct(h header, v reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	fields := cachedFields(v.Type())
+	for i := 0; i < h.length; i++ {
+		kh, err := d.readHeader()
+		if err != nil {
+			return err
+		}
+		if kh.typ != StrType && kh.typ != BinType {
+			if err = d.skipPayload(kh); err != nil {
+				return err
+			}
+			if err = d.skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		name, err := d.readBytes(kh.length)
+		if err != nil {
+			return err
+		}
+		f, ok := fields.lookup(string(name))
+		var fv reflect.Value
+		if ok {
+			fv, ok = fieldByIndexAlloc(v, f.index)
+		}
+		if !ok {
+			if err = d.skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = d.decodeValue(fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeInterface builds the natural Go representation of a value: int64 (or uint64 when it
+// doesn't fit), float32/float64, string, []byte, []any, map[string]any (map[any]any when a key
+// isn't a string), time.Time or *Ext.
+func (d *Decoder) decodeInterface(h header) (any, error) {
+	switch h.typ {
+	case NilType:
+		return nil, nil
+	case BoolType:
+		return h.b, nil
+	case IntType:
+		return h.i, nil
+	case UintType:
+		if h.u <= math.MaxInt64 {
+			return int64(h.u), nil
+		}
+		return h.u, nil
+	case FloatType:
+		if h.single {
+			return float32(h.f), nil
+		}
+		return h.f, nil
+	case StrType:
+		data, err := d.readBytes(h.length)
+		return string(data), err
+	case BinType:
+		return d.readBytes(h.length)
+	case ArrayType:
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+		defer d.leave()
+		list := make([]any, 0, min(h.length, maxPrealloc))
+		for i := 0; i < h.length; i++ {
+			val, err := d.decodeNext()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, val)
+		}
+		return list, nil
+	case MapType:
+		return d.decodeInterfaceMap(h)
+	case ExtType:
+		data, err := d.readBytes(h.length)
+		if err != nil {
+			return nil, err
+		}
+		if h.ext == TimestampExt {
+			return parseTime(data)
+		}
+		if c := extByCode(h.ext); c != nil {
+			val, err := c.decode(data)
+			if err != nil {
+				return nil, err
+			}
+			return val.Interface(), nil
+		}
+		return &Ext{Type: h.ext, Data: data}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrInvalidCode, h.typ)
+}
+
+func (d *Decoder) decodeNext() (any, error) {
+	h, err := d.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeInterface(h)
+}
+
+func (d *Decoder) decodeInterfaceMap(h header) (any, error) {
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	defer d.leave()
+	m := make(map[string]any, min(h.length, maxPrealloc))
+	var generic map[any]any
+	for i := 0; i < h.length; i++ {
+		key, err := d.decodeNext()
+		if err != nil {
+			return nil, err
+		}
+		val, err := d.decodeNext()
+		if err != nil {
+			return nil, err
+		}
+		if b, ok := key.([]byte); ok {
+			key = string(b)
+		}
+		if s, ok := key.(string); ok && generic == nil {
+			m[s] = val
+			continue
+		}
+		if key != nil && !reflect.TypeOf(key).Comparable() {
+			return nil, fmt.Errorf("%w: map key of type %T", ErrUnsupportedType, key)
+		}
+		if generic == nil {
+			generic = make(map[any]any, len(m)+1)
+			for k, v := range m {
+				generic[k] = v
+			}
+		}
+		generic[key] = val
+	}
+	if generic != nil {
+		return generic, nil
+	}
+	return m, nil
+}
@@ -0,0 +1,402 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"time"
+)
+
+var (
+	marshalerType         = reflect.TypeFor[Marshaler]()
+	streamMarshalerType   = reflect.TypeFor[StreamMarshaler]()
+	binaryMarshalerType   = reflect.TypeFor[encoding.BinaryMarshaler]()
+	timeType              = reflect.TypeFor[time.Time]()
+	unmarshalerType       = reflect.TypeFor[Unmarshaler]()
+	streamUnmarshalerType = reflect.TypeFor[StreamUnmarshaler]()
+	binaryUnmarshalerType = reflect.TypeFor[encoding.BinaryUnmarshaler]()
+)
+
+// cycleCheckDepth is the nesting of pointers, maps and slices after which the encoder remembers those
+// it is inside of, so that encoding a cyclic value fails with ErrCycle instead of overflowing the stack.
+const cycleCheckDepth = 1000
+
+// Encoder writes MessagePack values to an output stream.
+type Encoder struct {
+	w   io.Writer
+	buf []byte
+
+	depth int
+	seen  map[visit]struct{}
+}
+
+// visit identifies a pointer, map or slice being encoded. Slices sharing an array may differ in length.
+type visit struct {
+	ptr uintptr
+	len int
+}
+
+// NewEncoder returns a new encoder that writes to w. Each call to Encode results in a single write.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the MessagePack encoding of v to the stream.
+func (e *Encoder) Encode(v any) error {
+	b, err := e.appendAny(e.buf[:0], v)
+	if err != nil {
+		return err
+	}
+	e.buf = b
+	_, err = e.w.Write(b)
+	return err
+}
+
+func (e *Encoder) appendAny(b []byte, v any) ([]byte, error) {
+	switch val := v.(type) {
+	case nil:
+		return appendNil(b), nil
+	case bool:
+		return appendBool(b, val), nil
+	case int:
+		return appendInt(b, int64(val)), nil
+	case int64:
+		return appendInt(b, val), nil
+	case uint64:
+		return appendUint(b, val), nil
+	case float64:
+		return appendFloat64(b, val), nil
+	case string:
+		return appendString(b, val), nil
+	case []byte:
+		return appendBytes(b, val), nil
+	}
+	return e.appendValue(b, reflect.ValueOf(v))
+}
+
+func (e *Encoder) appendValue(b []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return appendNil(b), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice:
+		if v.IsNil() {
+			return appendNil(b), nil
+		}
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice:
+		if err := e.enter(v); err != nil {
+			return b, err
+		}
+		defer e.leave(v)
+	}
+
+	if b, handled, err := e.appendCustom(b, v); handled {
+		return b, err
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return e.appendValue(b, v.Elem())
+	case reflect.Bool:
+		return appendBool(b, v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendInt(b, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendUint(b, v.Uint()), nil
+	case reflect.Float32:
+		return appendFloat32(b, float32(v.Float())), nil
+	case reflect.Float64:
+		return appendFloat64(b, v.Float()), nil
+	case reflect.String:
+		return appendString(b, v.String()), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return appendBytes(b, v.Bytes()), nil
+		}
+		return e.appendArray(b, v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(buf), v)
+			return appendBytes(b, buf), nil
+		}
+		return e.appendArray(b, v)
+	case reflect.Map:
+		return e.appendMap(b, v)
+	case reflect.Struct:
+		return e.appendStruct(b, v)
+	}
+
+	return b, fmt.Errorf("%w: %s", ErrUnsupportedType, v.Type())
+}
+
+// enter is called before encoding what a pointer, map or slice refers to, and leave after.
+func (e *Encoder) enter(v reflect.Value) error {
+	e.depth++
+	if e.depth <= cycleCheckDepth {
+		return nil
+	}
+	key := visitOf(v)
+	if _, ok := e.seen[key]; ok {
+		e.depth--
+		return fmt.Errorf("%w: %s", ErrCycle, v.Type())
+	}
+	if e.seen == nil {
+		e.seen = make(map[visit]struct{})
+	}
+	e.seen[key] = struct{}{}
+	return nil
+}
+
+func (e *Encoder) leave(v reflect.Value) {
+	if e.depth > cycleCheckDepth {
+		delete(e.seen, visitOf(v))
+	}
+	e.depth--
+}
+
+func visitOf(v reflect.Value) visit {
+	key := visit{ptr: v.Pointer()}
+	if v.Kind() == reflect.Slice {
+		key.len = v.Len()
+	}
+	return key
+}
+
+// appendCustom handles the types that know how to encode themselves, reporting whether it did.
+func (e *Encoder) appendCustom(b []byte, v reflect.Value) ([]byte, bool, error) {
+	t := v.Type()
+	if t == timeType {
+		return appendTime(b, v.Interface().(time.Time)), true, nil
+	}
+	if t.Kind() == reflect.Pointer && t.Elem() == timeType {
+		return appendTime(b, v.Elem().Interface().(time.Time)), true, nil
+	}
+	if c, ev := extFor(v); c != nil {
+		b, err := appendExt(b, c, ev)
+		return b, true, err
+	}
+
+	if t.Kind() != reflect.Pointer && v.CanAddr() && reflect.PointerTo(t).Implements(marshalerType) {
+		v, t = v.Addr(), v.Addr().Type()
+	}
+
+	if t.Implements(marshalerType) {
+		data, err := v.Interface().(Marshaler).MarshalMsgpack()
+		if err != nil {
+			return b, true, err
+		}
+		return append(b, data...), true, nil
+	}
+
+	if t.Kind() != reflect.Pointer && v.CanAddr() {
+		pt := reflect.PointerTo(t)
+		if pt.Implements(binaryMarshalerType) || pt.Implements(streamMarshalerType) {
+			v, t = v.Addr(), pt
+		}
+	}
+
+	switch {
+	case t.Implements(binaryMarshalerType):
+		data, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return b, true, err
+		}
+		return appendBytes(b, data), true, nil
+	case t.Implements(streamMarshalerType):
+		var buf bytes.Buffer
+		if err := v.Interface().(StreamMarshaler).MarshalBinary(&buf); err != nil {
+			return b, true, err
+		}
+		return appendBytes(b, buf.Bytes()), true, nil
+	}
+
+	return b, false, nil
+}
+
+func (e *Encoder) appendArray(b []byte, v reflect.Value) ([]byte, error) {
+	var err error
+	b = appendArrayHeader(b, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		if b, err = e.appendValue(b, v.Index(i)); err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+func (e *Encoder) appendMap(b []byte, v reflect.Value) ([]byte, error) {
+	var err error
+	b = appendMapHeader(b, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		if b, err = e.appendValue(b, iter.Key()); err != nil {
+			return b, err
+		}
+		if b, err = e.appendValue(b, iter.Value()); err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+func (e *Encoder) appendStruct(b []byte, v reflect.Value) ([]byte, error) {
+	fields := cachedFields(v.Type())
+
+	values := make([]reflect.Value, len(fields.list))
+	count := 0
+	for i, f := range fields.list {
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok || (f.omitEmpty && isEmptyValue(fv)) {
+			continue
+		}
+		values[i] = fv
+		count++
+	}
+
+	var err error
+	b = appendMapHeader(b, count)
+	for i, f := range fields.list {
+		if !values[i].IsValid() {
+			continue
+		}
+		b = appendString(b, f.name)
+		if b, err = e.appendValue(b, values[i]); err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+func appendNil(b []byte) []byte {
+	return append(b, codeNil)
+}
+
+func appendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, codeTrue)
+	}
+	return append(b, codeFalse)
+}
+
+// appendInt writes v in the most compact format able to hold it.
+func appendInt(b []byte, v int64) []byte {
+	switch {
+	case v >= 0:
+		return appendUint(b, uint64(v))
+	case v >= -32:
+		return append(b, byte(v))
+	case v >= math.MinInt8:
+		return append(b, codeInt8, byte(v))
+	case v >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, codeInt16), uint16(v))
+	case v >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, codeInt32), uint32(v))
+	}
+	return binary.BigEndian.AppendUint64(append(b, codeInt64), uint64(v))
+}
+
+// appendUint writes v in the most compact format able to hold it.
+func appendUint(b []byte, v uint64) []byte {
+	switch {
+	case v <= uint64(posFixintMax):
+		return append(b, byte(v))
+	case v <= math.MaxUint8:
+		return append(b, codeUint8, byte(v))
+	case v <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, codeUint16), uint16(v))
+	case v <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, codeUint32), uint32(v))
+	}
+	return binary.BigEndian.AppendUint64(append(b, codeUint64), v)
+}
+
+func appendFloat32(b []byte, v float32) []byte {
+	return binary.BigEndian.AppendUint32(append(b, codeFloat32), math.Float32bits(v))
+}
+
+func appendFloat64(b []byte, v float64) []byte {
+	return binary.BigEndian.AppendUint64(append(b, codeFloat64), math.Float64bits(v))
+}
+
+func appendStringHeader(b []byte, n int) []byte {
+	switch {
+	case n <= int(fixstrMax-fixstrMin):
+		return append(b, fixstrMin|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, codeStr8, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, codeStr16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, codeStr32), uint32(n))
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendStringHeader(b, len(s)), s...)
+}
+
+func appendBinHeader(b []byte, n int) []byte {
+	switch {
+	case n <= math.MaxUint8:
+		return append(b, codeBin8, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, codeBin16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, codeBin32), uint32(n))
+}
+
+func appendBytes(b []byte, data []byte) []byte {
+	return append(appendBinHeader(b, len(data)), data...)
+}
+
+func appendArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n <= int(fixarrayMax-fixarrayMin):
+		return append(b, fixarrayMin|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, codeArray16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, codeArray32), uint32(n))
+}
+
+func appendMapHeader(b []byte, n int) []byte {
+	switch {
+	case n <= int(fixmapMax-fixmapMin):
+		return append(b, fixmapMin|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, codeMap16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, codeMap32), uint32(n))
+}
+
+// appendExtHeader writes the header of an extension value of n bytes, using the fixext formats when possible.
+func appendExtHeader(b []byte, typ int8, n int) []byte {
+	switch n {
+	case 1:
+		return append(b, codeFixExt1, byte(typ))
+	case 2:
+		return append(b, codeFixExt2, byte(typ))
+	case 4:
+		return append(b, codeFixExt4, byte(typ))
+	case 8:
+		return append(b, codeFixExt8, byte(typ))
+	case 16:
+		return append(b, codeFixExt16, byte(typ))
+	}
+	switch {
+	case n <= math.MaxUint8:
+		b = append(b, codeExt8, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, codeExt16), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, codeExt32), uint32(n))
+	}
+	return append(b, byte(typ))
+}
@@ -0,0 +1,146 @@
+package msgpack
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	ErrExtReserved   = errors.New("msgpack: negative extension types are reserved")
+	ErrExtRegistered = errors.New("msgpack: extension already registered")
+)
+
+type extCodec struct {
+	code   int8
+	typ    reflect.Type
+	encode func(v reflect.Value) ([]byte, error)
+	decode func(data []byte) (reflect.Value, error)
+}
+
+var extRegistry = struct {
+	lock   sync.RWMutex
+	byType map[reflect.Type]*extCodec
+	byCode map[int8]*extCodec
+}{
+	byType: make(map[reflect.Type]*extCodec),
+	byCode: make(map[int8]*extCodec),
+}
+
+// RegisterExt maps the Go type T to the application extension type code. Values of type T are then
+// encoded as ext values with the payload returned by encode, and ext values carrying code are
+// decoded with decode, both into T typed targets and into interfaces.
+// T may be a pointer type, e.g. RegisterExt[*bitset.BitSet].
+func RegisterExt[T any](code int8, encode func(T) ([]byte, error), decode func(data []byte) (T, error)) error {
+	if code < 0 {
+		return ErrExtReserved
+	}
+	c := &extCodec{
+		code: code,
+		typ:  reflect.TypeFor[T](),
+		encode: func(v reflect.Value) ([]byte, error) {
+			return encode(v.Interface().(T))
+		},
+		decode: func(data []byte) (reflect.Value, error) {
+			val, err := decode(data)
+			return reflect.ValueOf(&val).Elem(), err
+		},
+	}
+
+	extRegistry.lock.Lock()
+	defer extRegistry.lock.Unlock()
+
+	if _, ok := extRegistry.byCode[code]; ok {
+		return fmt.Errorf("%w: code %d", ErrExtRegistered, code)
+	}
+	if _, ok := extRegistry.byType[c.typ]; ok {
+		return fmt.Errorf("%w: type %s", ErrExtRegistered, c.typ)
+	}
+	extRegistry.byCode[code] = c
+	extRegistry.byType[c.typ] = c
+	return nil
+}
+
+// UnregisterExt removes the type registered for the extension code, if any.
+func UnregisterExt(code int8) {
+	extRegistry.lock.Lock()
+	defer extRegistry.lock.Unlock()
+
+	if c, ok := extRegistry.byCode[code]; ok {
+		delete(extRegistry.byCode, code)
+		delete(extRegistry.byType, c.typ)
+	}
+}
+
+func extByType(t reflect.Type) *extCodec {
+	extRegistry.lock.RLock()
+	defer extRegistry.lock.RUnlock()
+	return extRegistry.byType[t]
+}
+
+func extByCode(code int8) *extCodec {
+	extRegistry.lock.RLock()
+	defer extRegistry.lock.RUnlock()
+	return extRegistry.byCode[code]
+}
+
+// extFor finds the codec to encode v with, looking through pointers in both directions.
+// It returns the value to be passed to the codec.
+func extFor(v reflect.Value) (*extCodec, reflect.Value) {
+	t := v.Type()
+	if c := extByType(t); c != nil {
+		return c, v
+	}
+	if t.Kind() == reflect.Pointer {
+		if c := extByType(t.Elem()); c != nil {
+			return c, v.Elem()
+		}
+	} else if v.CanAddr() {
+		if c := extByType(reflect.PointerTo(t)); c != nil {
+			return c, v.Addr()
+		}
+	}
+	return nil, v
+}
+
+func appendExt(b []byte, c *extCodec, v reflect.Value) ([]byte, error) {
+	data, err := c.encode(v)
+	if err != nil {
+		return b, err
+	}
+	b = appendExtHeader(b, c.code, len(data))
+	return append(b, data...), nil
+}
+
+// decodeExt decodes the next value into v, whose type (or pointer type) is registered with c.
+func (d *Decoder) decodeExt(c *extCodec, v reflect.Value) error {
+	h, err := d.readHeader()
+	if err != nil {
+		return err
+	}
+	if h.typ == NilType {
+		v.SetZero()
+		return nil
+	}
+	if h.typ != ExtType || h.ext != c.code {
+		return d.mismatch(h, v.Type())
+	}
+	data, err := d.readBytes(h.length)
+	if err != nil {
+		return err
+	}
+	val, err := c.decode(data)
+	if err != nil {
+		return err
+	}
+	if val.Type() != v.Type() { // registered as *T, decoding into T
+		if val.IsNil() {
+			v.SetZero()
+			return nil
+		}
+		val = val.Elem()
+	}
+	v.Set(val)
+	return nil
+}
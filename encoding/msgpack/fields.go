@@ -0,0 +1,147 @@
+package msgpack
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+type structFields struct {
+	list   []field
+	byName map[string]int
+}
+
+var fieldCache sync.Map // map[reflect.Type]*structFields
+
+func cachedFields(t reflect.Type) *structFields {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.(*structFields)
+	}
+	f, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return f.(*structFields)
+}
+
+// typeFields collects the encodable fields of a struct type. Untagged embedded structs are flattened
+// and, as in encoding/json, shallower fields shadow deeper ones with the same name.
+func typeFields(t reflect.Type) *structFields {
+	sf := &structFields{byName: make(map[string]int)}
+	depth := make(map[string]int)
+
+	var walk func(t reflect.Type, index []int)
+	walk = func(t reflect.Type, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("msgpack")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+
+			idx := make([]int, len(index)+1)
+			copy(idx, index)
+			idx[len(index)] = i
+
+			if f.Anonymous && name == "" {
+				ft := f.Type
+				if ft.Kind() == reflect.Pointer {
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct {
+					walk(ft, idx)
+					continue
+				}
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+
+			if pos, ok := sf.byName[name]; ok {
+				if depth[name] <= len(idx) {
+					continue
+				}
+				sf.list[pos] = field{name: name, index: idx, omitEmpty: opts == "omitempty"}
+				depth[name] = len(idx)
+				continue
+			}
+			sf.byName[name] = len(sf.list)
+			depth[name] = len(idx)
+			sf.list = append(sf.list, field{name: name, index: idx, omitEmpty: opts == "omitempty"})
+		}
+	}
+	walk(t, nil)
+	return sf
+}
+
+// lookup finds a field by its encoded name, falling back to a case-insensitive match.
+func (sf *structFields) lookup(name string) (*field, bool) {
+	if i, ok := sf.byName[name]; ok {
+		return &sf.list[i], true
+	}
+	for i := range sf.list {
+		if strings.EqualFold(sf.list[i].name, name) {
+			return &sf.list[i], true
+		}
+	}
+	return nil, false
+}
+
+// fieldByIndex returns the field for reading, reporting false if it sits behind a nil embedded pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// fieldByIndexAlloc returns the field for writing, allocating nil embedded pointers on the way. It reports
+// false if one of them can't be set, being a pointer to an unexported type.
+func fieldByIndexAlloc(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	case reflect.Struct:
+		return v.IsZero()
+	}
+	return false
+}
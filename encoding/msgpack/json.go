@@ -0,0 +1,565 @@
+package msgpack
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var ErrInvalidJSON = errors.New("msgpack: invalid JSON")
+
+// JSONMode selects how ToJSON writes values that have no JSON equivalent.
+type JSONMode uint8
+
+const (
+	// JSONTagged wraps such values in single key objects ({"$bin": "..."}, {"$ext": [1, "..."]},
+	// {"$time": "..."}, {"$map": [[key, value], ...]}, {"$f32": 1.5}) that FromJSON turns back into
+	// the exact same MessagePack values. Map keys that start with "$" are escaped as "$$".
+	JSONTagged JSONMode = iota
+	// JSONPlain writes the closest plain JSON value instead: bin and ext payloads become base64
+	// strings, timestamps RFC 3339 strings and non-string map keys are stringified.
+	JSONPlain
+)
+
+// JSONOptions configures the MessagePack to JSON transcoding.
+type JSONOptions struct {
+	Binary  JSONMode
+	Ext     JSONMode
+	MapKeys JSONMode
+	Float   JSONMode // float32 and non-finite floats
+}
+
+// DefaultJSONOptions produces lossless output.
+var DefaultJSONOptions = JSONOptions{}
+
+// ToJSON transcodes the MessagePack values read from r into JSON written to w, one line per value,
+// using DefaultJSONOptions.
+func ToJSON(w io.Writer, r io.Reader) error {
+	return DefaultJSONOptions.ToJSON(w, r)
+}
+
+// ToJSON transcodes the MessagePack values read from r into JSON written to w, one line per value.
+func (o JSONOptions) ToJSON(w io.Writer, r io.Reader) error {
+	d := NewDecoder(r)
+	bw := bufio.NewWriter(w)
+	var out []byte
+	for {
+		raw, err := d.readRaw()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if out, err = o.appendJSON(out[:0], newBytesDecoder(raw)); err != nil {
+			return err
+		}
+		if _, err = bw.Write(append(out, '\n')); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func (o JSONOptions) appendJSON(b []byte, d *Decoder) ([]byte, error) {
+	h, err := d.readHeader()
+	if err != nil {
+		return b, err
+	}
+
+	switch h.typ {
+	case NilType:
+		return append(b, "null"...), nil
+	case BoolType:
+		return strconv.AppendBool(b, h.b), nil
+	case IntType:
+		return strconv.AppendInt(b, h.i, 10), nil
+	case UintType:
+		return strconv.AppendUint(b, h.u, 10), nil
+	case FloatType:
+		return o.appendJSONFloat(b, h), nil
+	case StrType:
+		data, err := d.readBytes(h.length)
+		if err != nil {
+			return b, err
+		}
+		if !utf8.Valid(data) && o.Binary == JSONTagged {
+			return appendJSONTag(b, "$str", appendJSONBase64(nil, data)), nil
+		}
+		return appendJSONString(b, string(data)), nil
+	case BinType:
+		data, err := d.readBytes(h.length)
+		if err != nil {
+			return b, err
+		}
+		if o.Binary == JSONTagged {
+			return appendJSONTag(b, "$bin", appendJSONBase64(nil, data)), nil
+		}
+		return appendJSONBase64(b, data), nil
+	case ExtType:
+		data, err := d.readBytes(h.length)
+		if err != nil {
+			return b, err
+		}
+		return o.appendJSONExt(b, h.ext, data)
+	case ArrayType:
+		if err = d.enter(); err != nil {
+			return b, err
+		}
+		defer d.leave()
+		b = append(b, '[')
+		for i := 0; i < h.length; i++ {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			if b, err = o.appendJSON(b, d); err != nil {
+				return b, err
+			}
+		}
+		return append(b, ']'), nil
+	case MapType:
+		return o.appendJSONMap(b, d, h)
+	}
+	return b, fmt.Errorf("%w: %s", ErrInvalidCode, h.typ)
+}
+
+func (o JSONOptions) appendJSONFloat(b []byte, h header) []byte {
+	bits, tag := 64, "$f64"
+	if h.single {
+		bits, tag = 32, "$f32"
+	}
+
+	var num []byte
+	switch {
+	case math.IsNaN(h.f):
+		num = appendJSONString(nil, "NaN")
+	case math.IsInf(h.f, 1):
+		num = appendJSONString(nil, "+Inf")
+	case math.IsInf(h.f, -1):
+		num = appendJSONString(nil, "-Inf")
+	default:
+		num = strconv.AppendFloat(nil, h.f, 'g', -1, bits)
+		if !strings.ContainsAny(string(num), ".eE") {
+			num = append(num, ".0"...)
+		}
+		if !h.single {
+			return append(b, num...)
+		}
+	}
+
+	if o.Float == JSONTagged {
+		return appendJSONTag(b, tag, num)
+	}
+	if num[0] == '"' { // non-finite values don't exist in JSON
+		return append(b, "null"...)
+	}
+	return append(b, num...)
+}
+
+func (o JSONOptions) appendJSONExt(b []byte, typ int8, data []byte) ([]byte, error) {
+	if typ == TimestampExt {
+		t, err := parseTime(data)
+		if err != nil {
+			return b, err
+		}
+		s := appendJSONString(nil, t.Format(time.RFC3339Nano))
+		if o.Ext == JSONTagged {
+			return appendJSONTag(b, "$time", s), nil
+		}
+		return append(b, s...), nil
+	}
+
+	if o.Ext == JSONTagged {
+		v := strconv.AppendInt([]byte{'['}, int64(typ), 10)
+		v = append(appendJSONBase64(append(v, ','), data), ']')
+		return appendJSONTag(b, "$ext", v), nil
+	}
+	return appendJSONBase64(b, data), nil
+}
+
+func (o JSONOptions) appendJSONMap(b []byte, d *Decoder, h header) ([]byte, error) {
+	if err := d.enter(); err != nil {
+		return b, err
+	}
+	defer d.leave()
+	s := d.r.(*sliceReader)
+
+	// the map is written as an object until a key needs the $map form, which is only known once it is
+	// read: the entries written so far are then rewritten, so that none is decoded twice
+	start := len(b)
+	var keys []string
+	var values [][2]int // where the value of each of the keys is in b
+	b = append(b, '{')
+	for i := 0; i < h.length; i++ {
+		off := s.off
+		kh, err := d.readHeader()
+		if err != nil {
+			return b, err
+		}
+		var data []byte
+		if kh.typ == StrType {
+			if data, err = d.readBytes(kh.length); err != nil {
+				return b, err
+			}
+		}
+		plain := kh.typ == StrType && (o.MapKeys != JSONTagged || utf8.Valid(data))
+		if !plain && o.MapKeys == JSONTagged {
+			s.off = off
+			return o.appendJSONPairs(b, d, start, keys, values, h.length-i)
+		}
+
+		var key string
+		if plain {
+			key = string(data)
+			if strings.HasPrefix(key, "$") {
+				key = "$" + key
+			}
+		} else {
+			s.off = off
+			if key, err = o.plainKey(d); err != nil {
+				return b, err
+			}
+		}
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(appendJSONString(b, key), ':')
+		valueStart := len(b)
+		if b, err = o.appendJSON(b, d); err != nil {
+			return b, err
+		}
+		if o.MapKeys == JSONTagged {
+			keys = append(keys, string(data))
+			values = append(values, [2]int{valueStart - start, len(b) - start})
+		}
+	}
+	return append(b, '}'), nil
+}
+
+// appendJSONPairs rewrites the entries of a map written as an object from start, given their keys and
+// where their values are, in the $map form, then adds the n entries left to read.
+func (o JSONOptions) appendJSONPairs(b []byte, d *Decoder, start int, keys []string, values [][2]int, n int) ([]byte, error) {
+	written := append([]byte(nil), b[start:]...)
+	b = append(b[:start], `{"$map":[`...)
+	for i, key := range keys {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(appendJSONString(append(b, '['), key), ',')
+		b = append(append(b, written[values[i][0]:values[i][1]]...), ']')
+	}
+
+	var err error
+	for i := 0; i < n; i++ {
+		if len(keys) > 0 || i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, '[')
+		if b, err = o.appendJSON(b, d); err != nil {
+			return b, err
+		}
+		b = append(b, ',')
+		if b, err = o.appendJSON(b, d); err != nil {
+			return b, err
+		}
+		b = append(b, ']')
+	}
+	return append(b, "]}"...), nil
+}
+
+// plainKey renders the next value, a non-string map key, as JSON text.
+func (o JSONOptions) plainKey(d *Decoder) (string, error) {
+	text, err := o.appendJSON(nil, d)
+	if err != nil {
+		return "", err
+	}
+	if text[0] == '"' {
+		var str string
+		if err = json.Unmarshal(text, &str); err == nil {
+			return str, nil
+		}
+	}
+	return string(text), nil
+}
+
+func appendJSONTag(b []byte, tag string, value []byte) []byte {
+	b = append(appendJSONString(append(b, '{'), tag), ':')
+	return append(append(b, value...), '}')
+}
+
+func appendJSONBase64(b []byte, data []byte) []byte {
+	b = append(b, '"')
+	b = base64.StdEncoding.AppendEncode(b, data)
+	return append(b, '"')
+}
+
+func appendJSONString(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b = append(b, '\\', byte(r))
+		case r == '\n':
+			b = append(b, '\\', 'n')
+		case r == '\r':
+			b = append(b, '\\', 'r')
+		case r == '\t':
+			b = append(b, '\\', 't')
+		case r < 0x20:
+			b = append(b, '\\', 'u', '0', '0', hex[r>>4], hex[r&0xf])
+		default:
+			b = utf8.AppendRune(b, r)
+		}
+	}
+	return append(b, '"')
+}
+
+// FromJSON transcodes the JSON values read from r into MessagePack values written to w. It understands
+// the tagged objects written by ToJSON, so output produced with DefaultJSONOptions converts back to
+// the original values. Numbers without a fraction or exponent become integers.
+func FromJSON(w io.Writer, r io.Reader) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+
+	var out []byte
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if out, err = appendFromJSON(out[:0], dec, tok); err != nil {
+			return err
+		}
+		if _, err = w.Write(out); err != nil {
+			return err
+		}
+	}
+}
+
+func appendFromJSON(b []byte, dec *json.Decoder, tok json.Token) ([]byte, error) {
+	switch v := tok.(type) {
+	case nil:
+		return appendNil(b), nil
+	case bool:
+		return appendBool(b, v), nil
+	case string:
+		return appendString(b, v), nil
+	case json.Number:
+		return appendJSONNumber(b, v)
+	case json.Delim:
+		switch v {
+		case '[':
+			body, n, err := appendJSONElements(nil, dec)
+			if err != nil {
+				return b, err
+			}
+			return append(appendArrayHeader(b, n), body...), nil
+		case '{':
+			return appendJSONObject(b, dec)
+		}
+	}
+	return b, fmt.Errorf("%w: unexpected %v", ErrInvalidJSON, tok)
+}
+
+// appendJSONElements encodes the remaining elements of a JSON array, including its closing bracket.
+func appendJSONElements(b []byte, dec *json.Decoder) ([]byte, int, error) {
+	n := 0
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return b, n, err
+		}
+		if b, err = appendFromJSON(b, dec, tok); err != nil {
+			return b, n, err
+		}
+		n++
+	}
+	_, err := dec.Token()
+	return b, n, err
+}
+
+func appendJSONObject(b []byte, dec *json.Decoder) ([]byte, error) {
+	var body []byte
+	n := 0
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return b, err
+		}
+		key := tok.(string)
+
+		if n == 0 {
+			if tagged, ok, err := appendJSONTagged(b, dec, key); ok || err != nil {
+				if err != nil {
+					return b, err
+				}
+				if dec.More() {
+					return b, fmt.Errorf("%w: %s object with extra keys", ErrInvalidJSON, key)
+				}
+				_, err = dec.Token()
+				return tagged, err
+			}
+		}
+
+		if strings.HasPrefix(key, "$$") {
+			key = key[1:]
+		}
+		body = appendString(body, key)
+		if tok, err = dec.Token(); err != nil {
+			return b, err
+		}
+		if body, err = appendFromJSON(body, dec, tok); err != nil {
+			return b, err
+		}
+		n++
+	}
+	if _, err := dec.Token(); err != nil {
+		return b, err
+	}
+	return append(appendMapHeader(b, n), body...), nil
+}
+
+// appendJSONTagged decodes the value of a tagged object, reporting false if key is not a known tag.
+func appendJSONTagged(b []byte, dec *json.Decoder, key string) ([]byte, bool, error) {
+	switch key {
+	case "$bin", "$str", "$time", "$ext", "$f32", "$f64", "$map":
+	default:
+		return b, false, nil
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return b, true, err
+	}
+	invalid := fmt.Errorf("%w: bad %s value %v", ErrInvalidJSON, key, tok)
+
+	switch key {
+	case "$bin", "$str":
+		s, ok := tok.(string)
+		if !ok {
+			return b, true, invalid
+		}
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return b, true, err
+		}
+		if key == "$str" {
+			return append(appendStringHeader(b, len(data)), data...), true, nil
+		}
+		return appendBytes(b, data), true, nil
+	case "$time":
+		s, ok := tok.(string)
+		if !ok {
+			return b, true, invalid
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return b, true, err
+		}
+		return appendTime(b, t), true, nil
+	case "$f32", "$f64":
+		var f float64
+		switch v := tok.(type) {
+		case json.Number:
+			f, err = strconv.ParseFloat(string(v), 64)
+		case string:
+			f, err = strconv.ParseFloat(v, 64)
+		default:
+			return b, true, invalid
+		}
+		if err != nil {
+			return b, true, err
+		}
+		if key == "$f32" {
+			return appendFloat32(b, float32(f)), true, nil
+		}
+		return appendFloat64(b, f), true, nil
+	case "$ext":
+		if tok != json.Delim('[') {
+			return b, true, invalid
+		}
+		var parts []any
+		for dec.More() {
+			if tok, err = dec.Token(); err != nil {
+				return b, true, err
+			}
+			parts = append(parts, tok)
+		}
+		if _, err = dec.Token(); err != nil {
+			return b, true, err
+		}
+		if len(parts) != 2 {
+			return b, true, invalid
+		}
+		num, ok1 := parts[0].(json.Number)
+		str, ok2 := parts[1].(string)
+		if !ok1 || !ok2 {
+			return b, true, invalid
+		}
+		typ, err := strconv.ParseInt(string(num), 10, 8)
+		if err != nil {
+			return b, true, err
+		}
+		data, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return b, true, err
+		}
+		return append(appendExtHeader(b, int8(typ), len(data)), data...), true, nil
+	case "$map":
+		if tok != json.Delim('[') {
+			return b, true, invalid
+		}
+		var body []byte
+		n := 0
+		for dec.More() {
+			if tok, err = dec.Token(); err != nil {
+				return b, true, err
+			}
+			if tok != json.Delim('[') {
+				return b, true, invalid
+			}
+			var count int
+			if body, count, err = appendJSONElements(body, dec); err != nil {
+				return b, true, err
+			}
+			if count != 2 {
+				return b, true, fmt.Errorf("%w: $map entries must be [key, value] pairs", ErrInvalidJSON)
+			}
+			n++
+		}
+		if _, err = dec.Token(); err != nil {
+			return b, true, err
+		}
+		return append(appendMapHeader(b, n), body...), true, nil
+	}
+	return b, true, invalid
+}
+
+func appendJSONNumber(b []byte, n json.Number) ([]byte, error) {
+	s := string(n)
+	if !strings.ContainsAny(s, ".eE") {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return appendInt(b, i), nil
+		}
+		if u, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return appendUint(b, u), nil
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return b, err
+	}
+	return appendFloat64(b, f), nil
+}
@@ -1 +1,58 @@
+// Package msgpack implements encoding and decoding of MessagePack (https://msgpack.org) values.
+//
+// The mapping between Go values and MessagePack follows encoding/json: structs are encoded as maps
+// keyed by field name (overridable with the `msgpack:"name,omitempty"` tag), slices and arrays as
+// arrays, []byte as bin and time.Time as the timestamp extension type (-1).
 package msgpack
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	ErrInvalidCode     = errors.New("msgpack: invalid code")
+	ErrUnsupportedType = errors.New("msgpack: unsupported type")
+	ErrTypeMismatch    = errors.New("msgpack: type mismatch")
+	ErrOverflow        = errors.New("msgpack: value overflows target type")
+	ErrInvalidTarget   = errors.New("msgpack: decode target must be a non-nil pointer")
+	ErrMaxDepth        = errors.New("msgpack: maximum nesting depth exceeded")
+	ErrCycle           = errors.New("msgpack: cyclic value")
+)
+
+// Marshaler is implemented by types that encode themselves into a valid MessagePack value.
+type Marshaler interface {
+	MarshalMsgpack() ([]byte, error)
+}
+
+// Unmarshaler is implemented by types that decode themselves from a MessagePack value.
+// The data passed in is a single, complete value and must be copied if retained.
+type Unmarshaler interface {
+	UnmarshalMsgpack(data []byte) error
+}
+
+// StreamMarshaler is implemented by types that serialize themselves to a stream, like auth.Auth.
+// Such values are encoded as bin.
+type StreamMarshaler interface {
+	MarshalBinary(w io.Writer) error
+}
+
+// StreamUnmarshaler is the counterpart of StreamMarshaler.
+type StreamUnmarshaler interface {
+	UnmarshalBinary(r io.Reader) error
+}
+
+// Marshal returns the MessagePack encoding of v.
+func Marshal(v any) ([]byte, error) {
+	e := &Encoder{}
+	b, err := e.appendAny(nil, v)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Unmarshal decodes the MessagePack encoded data and stores the result in the value pointed to by v.
+func Unmarshal(data []byte, v any) error {
+	return newBytesDecoder(data).Decode(v)
+}
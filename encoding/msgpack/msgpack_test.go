@@ -0,0 +1,530 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/another-d-mention/unicomplex/datastruct/bitset"
+	"github.com/another-d-mention/unicomplex/datastruct/bloomfilter"
+	"github.com/google/uuid"
+)
+
+type Base struct {
+	ID      int64
+	Created time.Time `msgpack:"created"`
+}
+
+type Item struct {
+	Base
+	Name    string            `msgpack:"name"`
+	Tags    []string          `msgpack:"tags,omitempty"`
+	Labels  map[string]string `msgpack:"labels"`
+	Score   float64           `msgpack:"score"`
+	Ratio   float32           `msgpack:"ratio"`
+	Data    []byte            `msgpack:"data"`
+	Parent  *Item             `msgpack:"parent,omitempty"`
+	Ignored string            `msgpack:"-"`
+	hidden  string
+}
+
+type upper string
+
+func (u upper) MarshalMsgpack() ([]byte, error) {
+	return Marshal("U:" + string(u))
+}
+
+func (u *upper) UnmarshalMsgpack(data []byte) error {
+	var s string
+	if err := Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*u = upper(s[2:])
+	return nil
+}
+
+// counter marshals itself to a stream, like auth.Auth does
+type counter struct{ n uint32 }
+
+func (c *counter) MarshalBinary(w io.Writer) error {
+	return binary.Write(w, binary.BigEndian, c.n)
+}
+
+func (c *counter) UnmarshalBinary(r io.Reader) error {
+	return binary.Read(r, binary.BigEndian, &c.n)
+}
+
+func TestEncodeFormats(t *testing.T) {
+	cases := []struct {
+		in  any
+		out []byte
+	}{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{5, []byte{0x05}},
+		{-5, []byte{0xfb}},
+		{200, []byte{0xcc, 0xc8}},
+		{-200, []byte{0xd1, 0xff, 0x38}},
+		{uint64(math.MaxUint64), []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"hi", []byte{0xa2, 'h', 'i'}},
+		{[]byte{1, 2}, []byte{0xc4, 0x02, 0x01, 0x02}},
+		{[]int{1, 2}, []byte{0x92, 0x01, 0x02}},
+		{map[string]int{"a": 1}, []byte{0x81, 0xa1, 'a', 0x01}},
+		{time.Unix(1, 0), []byte{0xd6, 0xff, 0x00, 0x00, 0x00, 0x01}},
+	}
+	for _, c := range cases {
+		b, err := Marshal(c.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, c.out) {
+			t.Errorf("Marshal(%v) = %x, expected %x", c.in, b, c.out)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := Item{
+		Base:    Base{ID: -42, Created: time.Date(2024, 5, 1, 10, 20, 30, 123, time.UTC)},
+		Name:    "item",
+		Labels:  map[string]string{"k": "v"},
+		Score:   3.25,
+		Ratio:   0.5,
+		Data:    []byte("payload"),
+		Parent:  &Item{Name: "parent"},
+		Ignored: "nope",
+		hidden:  "nope",
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out Item
+	if err = Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	in.Ignored, in.hidden = "", ""
+	if !out.Created.Equal(in.Created) {
+		t.Error("time mismatch", out.Created, in.Created)
+	}
+	out.Created = in.Created
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\n%+v\n%+v", in, out)
+	}
+
+	var generic map[string]any
+	if err = Unmarshal(data, &generic); err != nil {
+		t.Fatal(err)
+	}
+	if generic["ID"] != int64(-42) || generic["name"] != "item" {
+		t.Error("bad generic decoding", generic)
+	}
+	if _, ok := generic["tags"]; ok {
+		t.Error("omitempty field was encoded")
+	}
+
+	var small struct {
+		ID int8
+	}
+	if err = Unmarshal([]byte{0x81, 0xa2, 'I', 'D', 0xcd, 0x01, 0x00}, &small); err == nil {
+		t.Error("expected overflow error")
+	}
+
+	// the fields behind a nil pointer to an unexported type can't be set, so they are skipped
+	type inner struct{ ID int64 }
+	var embedded struct {
+		*inner
+		Name string
+	}
+	if data, err = Marshal(map[string]any{"ID": 1, "Name": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = Unmarshal(data, &embedded); err != nil || embedded.Name != "x" || embedded.inner != nil {
+		t.Error("unexpected embedded decoding", embedded, err)
+	}
+}
+
+func TestCustomMarshalers(t *testing.T) {
+	data, err := Marshal(struct{ V upper }{V: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct{ V upper }
+	if err = Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.V != "x" {
+		t.Error("custom marshaler round trip failed:", out.V)
+	}
+
+	bs := bitset.New(100)
+	bs.Set(3).Set(70)
+	bf := bloomfilter.New(1000, 4)
+	bf.Add([]byte("Jane"))
+
+	data, err = Marshal(map[string]any{"bitset": bs, "bloom": bf, "counter": &counter{n: 42}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		BitSet *bitset.BitSet           `msgpack:"bitset"`
+		Bloom  *bloomfilter.BloomFilter `msgpack:"bloom"`
+		Count  *counter                 `msgpack:"counter"`
+	}
+	if err = Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.BitSet.Test(70) || decoded.BitSet.Count() != 2 {
+		t.Error("bitset round trip failed:", decoded.BitSet)
+	}
+	if !decoded.Bloom.Test([]byte("Jane")) {
+		t.Error("bloom filter round trip failed")
+	}
+	if decoded.Count == nil || decoded.Count.n != 42 {
+		t.Error("stream marshaler round trip failed:", decoded.Count)
+	}
+}
+
+func TestStream(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for i := 0; i < 3; i++ {
+		if err := enc.Encode([]any{i, "x"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dec := NewDecoder(&buf)
+	for i := 0; ; i++ {
+		var v []any
+		err := dec.Decode(&v)
+		if err == io.EOF {
+			if i != 3 {
+				t.Error("expected 3 values, got", i)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v[0] != int64(i) || v[1] != "x" {
+			t.Error("bad stream value", v)
+		}
+	}
+}
+
+func TestExtRegistry(t *testing.T) {
+	err := RegisterExt(1, func(id uuid.UUID) ([]byte, error) {
+		return id[:], nil
+	}, uuid.FromBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer UnregisterExt(1)
+
+	err = RegisterExt(2, (*bitset.BitSet).MarshalBinary, func(data []byte) (*bitset.BitSet, error) {
+		b := &bitset.BitSet{}
+		return b, b.UnmarshalBinary(data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer UnregisterExt(2)
+
+	if err = RegisterExt(2, func(string) ([]byte, error) { return nil, nil }, nil); err == nil {
+		t.Error("duplicate code should be rejected")
+	}
+	if err = RegisterExt(-5, func(string) ([]byte, error) { return nil, nil }, nil); err == nil {
+		t.Error("reserved code should be rejected")
+	}
+
+	type record struct {
+		ID   uuid.UUID
+		Bits bitset.BitSet
+	}
+	in := record{ID: uuid.New()}
+	in.Bits.Set(9)
+
+	data, err := Marshal(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, append([]byte{0xd8, 0x01}, in.ID[:]...)) {
+		t.Errorf("uuid not encoded as fixext16: %x", data)
+	}
+
+	var out record
+	if err = Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.ID != in.ID || !out.Bits.Test(9) {
+		t.Error("ext round trip failed", out)
+	}
+
+	var generic map[string]any
+	if err = Unmarshal(data, &generic); err != nil {
+		t.Fatal(err)
+	}
+	if generic["ID"] != in.ID {
+		t.Error("ext not decoded into interface", generic["ID"])
+	}
+	if _, ok := generic["Bits"].(*bitset.BitSet); !ok {
+		t.Errorf("ext not decoded into interface: %T", generic["Bits"])
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	type envelope struct {
+		Kind    string     `msgpack:"kind"`
+		Payload RawMessage `msgpack:"payload"`
+	}
+	data, err := Marshal(map[string]any{"kind": "item", "payload": Item{Name: "lazy"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var env envelope
+	if err = Unmarshal(data, &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.Kind != "item" || env.Payload.Type() != MapType {
+		t.Fatal("bad envelope", env)
+	}
+	var item Item
+	if err = env.Payload.Unmarshal(&item); err != nil {
+		t.Fatal(err)
+	}
+	if item.Name != "lazy" {
+		t.Error("bad payload", item)
+	}
+
+	again, err := Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back map[string]any
+	if err = Unmarshal(again, &back); err != nil {
+		t.Fatal(err)
+	}
+	if back["payload"].(map[string]any)["name"] != "lazy" {
+		t.Error("raw message not embedded verbatim", back)
+	}
+
+	dec := NewDecoder(bytes.NewReader(append(data, 0x2a)))
+	if err = dec.Skip(); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err = dec.Decode(&n); err != nil || n != 42 {
+		t.Error("skip did not consume exactly one value", n, err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	doc := map[string]any{
+		"users": []any{
+			map[string]any{"name": "ann", "age": 31},
+			map[string]any{"name": "bob", "tags": []string{"a", "b"}},
+		},
+		"count": 2,
+	}
+	data, err := Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := Get(data, "users", 1, "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	if err = raw.Unmarshal(&name); err != nil || name != "bob" {
+		t.Error("bad value at path", name, err)
+	}
+	if _, err = Get(data, "users", 5); !errors.Is(err, ErrNotFound) {
+		t.Error("expected ErrNotFound, got", err)
+	}
+	if _, err = Get(data, "count", "x"); !errors.Is(err, ErrNotFound) {
+		t.Error("expected ErrNotFound, got", err)
+	}
+
+	paths := map[string]Type{}
+	err = Walk(data, func(path []any, typ Type, value RawMessage) error {
+		paths[fmt.Sprint(path)] = typ
+		if len(path) == 3 && path[2] == "tags" {
+			return SkipChildren
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]Type{
+		"[]":             MapType,
+		"[count]":        IntType,
+		"[users]":        ArrayType,
+		"[users 0]":      MapType,
+		"[users 0 name]": StrType,
+		"[users 0 age]":  IntType,
+		"[users 1]":      MapType,
+		"[users 1 name]": StrType,
+		"[users 1 tags]": ArrayType,
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Error("unexpected walk", paths)
+	}
+}
+
+type nested []nested
+
+func TestMaxDepth(t *testing.T) {
+	// arrays of one element nested maxDepth times are fine, one more level is not
+	data := append(bytes.Repeat([]byte{0x91}, maxDepth), 0xc0)
+	var v any
+	if err := Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	visited := 0
+	err := Walk(data, func(path []any, typ Type, value RawMessage) error {
+		visited++
+		return nil
+	})
+	if err != nil || visited != maxDepth+1 {
+		t.Error("unexpected walk", visited, err)
+	}
+
+	data = append([]byte{0x91}, data...)
+	var n nested
+	for name, err := range map[string]error{
+		"any":    Unmarshal(data, &v),
+		"nested": Unmarshal(data, &n),
+		"skip":   NewDecoder(bytes.NewReader(data)).Skip(),
+		"walk":   Walk(data, func([]any, Type, RawMessage) error { return nil }),
+		"json":   ToJSON(io.Discard, bytes.NewReader(data)),
+	} {
+		if !errors.Is(err, ErrMaxDepth) {
+			t.Errorf("%s: expected ErrMaxDepth, got %v", name, err)
+		}
+	}
+	if _, err = Get(data); !errors.Is(err, ErrMaxDepth) {
+		t.Error("expected ErrMaxDepth, got", err)
+	}
+}
+
+type node struct {
+	Next *node
+}
+
+func TestCycle(t *testing.T) {
+	// a long chain is fine, a loop is not
+	var head *node
+	for range 2 * cycleCheckDepth {
+		head = &node{Next: head}
+	}
+	if _, err := Marshal(head); err != nil {
+		t.Fatal(err)
+	}
+
+	loop := &node{}
+	loop.Next = &node{Next: loop}
+	s := []any{nil}
+	s[0] = s
+	m := map[string]any{}
+	m["m"] = m
+	for name, v := range map[string]any{"pointer": loop, "slice": s, "map": m} {
+		if _, err := Marshal(v); !errors.Is(err, ErrCycle) {
+			t.Errorf("%s: expected ErrCycle, got %v", name, err)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	doc := map[string]any{
+		"name":   "transcode",
+		"$ref":   "escaped",
+		"bin":    []byte{0, 1, 2},
+		"when":   time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC),
+		"ext":    Ext{Type: 7, Data: []byte("xyz")},
+		"f32":    float32(1.5),
+		"f64":    2.0,
+		"nan":    math.NaN(),
+		"big":    uint64(math.MaxUint64),
+		"neg":    -12,
+		"ints":   map[int]string{1: "one"},
+		"nested": []any{nil, true, "a\n\"b\""},
+	}
+	data, err := Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var js bytes.Buffer
+	if err = ToJSON(&js, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	var check map[string]any
+	if err = json.Unmarshal(js.Bytes(), &check); err != nil {
+		t.Fatal("invalid JSON output:", err, js.String())
+	}
+	if _, ok := check["$$ref"]; !ok {
+		t.Error("$ prefixed key not escaped", js.String())
+	}
+
+	var back bytes.Buffer
+	if err = FromJSON(&back, bytes.NewReader(js.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(back.Bytes(), data) {
+		t.Errorf("round trip changed the data:\n%x\n%x\n%s", data, back.Bytes(), js.String())
+	}
+
+	data, err = Marshal([]any{[]byte("hi"), map[int]int{1: 2}, float32(0.5)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	js.Reset()
+	plain := JSONOptions{Binary: JSONPlain, Ext: JSONPlain, MapKeys: JSONPlain, Float: JSONPlain}
+	if err = plain.ToJSON(&js, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if js.String() != `["aGk=",{"1":2},0.5]`+"\n" {
+		t.Error("unexpected plain JSON", js.String())
+	}
+
+	// a map turns out to need the $map form after some string keys: {"$a": {1: 2}, 3: 4}
+	data = []byte{0x82, 0xa2, '$', 'a', 0x81, 0x01, 0x02, 0x03, 0x04}
+	js.Reset()
+	if err = ToJSON(&js, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if js.String() != `{"$map":[["$a",{"$map":[[1,2]]}],[3,4]]}`+"\n" {
+		t.Error("unexpected $map JSON", js.String())
+	}
+	back.Reset()
+	if err = FromJSON(&back, bytes.NewReader(js.Bytes())); err != nil || !bytes.Equal(back.Bytes(), data) {
+		t.Errorf("round trip changed the data: %x %v", back.Bytes(), err)
+	}
+
+	for _, bad := range []string{
+		`{"$bin":1}`, `{"$bin":"%%"}`, `{"$bin":[]}`,
+		`{"$str":null}`, `{"$str":"!"}`,
+		`{"$time":5}`, `{"$time":"yesterday"}`,
+		`{"$f32":true}`, `{"$f32":"x"}`, `{"$f64":[]}`,
+		`{"$ext":[]}`, `{"$ext":[1]}`, `{"$ext":["aGk="]}`, `{"$ext":[1,"aGk=",2]}`, `{"$ext":[300,"aGk="]}`,
+		`{"$ext":[1,"%%"]}`, `{"$ext":"x"}`, `{"$ext":[1,`,
+		`{"$map":{}}`, `{"$map":[1]}`, `{"$map":[[1]]}`, `{"$map":[[1,2,3]]}`, `{"$map":[[1,2]`,
+	} {
+		if err = FromJSON(io.Discard, strings.NewReader(bad)); err == nil {
+			t.Errorf("FromJSON(%s) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package msgpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNotFound = errors.New("msgpack: path not found")
+
+	// SkipChildren can be returned by a WalkFunc visiting a map or array to skip its content.
+	SkipChildren = errors.New("msgpack: skip children")
+	// SkipAll can be returned by a WalkFunc to stop the walk without reporting an error.
+	SkipAll = errors.New("msgpack: skip all")
+)
+
+// Get returns the raw encoding of the value found by following path into data, without decoding
+// anything else. Path elements are map keys (string or int) and array indexes (int), e.g.
+//
+//	name, err := msgpack.Get(data, "users", 3, "name")
+//
+// The result shares memory with data.
+func Get(data []byte, path ...any) (RawMessage, error) {
+	d := newBytesDecoder(data)
+	for _, p := range path {
+		h, err := d.readHeader()
+		if err != nil {
+			return nil, err
+		}
+		switch h.typ {
+		case ArrayType:
+			idx, ok := p.(int)
+			if !ok || idx < 0 || idx >= h.length {
+				return nil, fmt.Errorf("%w: %v", ErrNotFound, p)
+			}
+			for i := 0; i < idx; i++ {
+				if err = d.skip(); err != nil {
+					return nil, err
+				}
+			}
+		case MapType:
+			found := false
+			for i := 0; i < h.length && !found; i++ {
+				if found, err = d.matchKey(p); err != nil {
+					return nil, err
+				}
+				if !found {
+					if err = d.skip(); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("%w: %v", ErrNotFound, p)
+			}
+		default:
+			return nil, fmt.Errorf("%w: %v in %s", ErrNotFound, p, h.typ)
+		}
+	}
+	return d.readRaw()
+}
+
+// matchKey consumes the next map key and reports whether it equals p.
+func (d *Decoder) matchKey(p any) (bool, error) {
+	h, err := d.readHeader()
+	if err != nil {
+		return false, err
+	}
+	switch k := p.(type) {
+	case string:
+		if (h.typ == StrType || h.typ == BinType) && h.length == len(k) {
+			b, err := d.r.Peek(h.length)
+			if err != nil {
+				return false, err
+			}
+			match := string(b) == k
+			return match, d.discard(h.length)
+		}
+	case int:
+		switch h.typ {
+		case IntType:
+			return h.i == int64(k), nil
+		case UintType:
+			return k >= 0 && h.u == uint64(k), nil
+		}
+	default:
+		return false, fmt.Errorf("%w: path element of type %T", ErrUnsupportedType, p)
+	}
+	return false, d.skipPayload(h)
+}
+
+// WalkFunc is called by Walk for every value of a document, containers before their content.
+// The path lists the map keys and array indexes leading to the value; both path and value are only
+// valid for the duration of the call.
+type WalkFunc func(path []any, typ Type, value RawMessage) error
+
+// Walk visits every value in data in depth-first order. Map keys are reported as part of the path
+// of their value, not visited themselves.
+func Walk(data []byte, fn WalkFunc) error {
+	s := &sliceReader{data: data}
+	d := &Decoder{r: s}
+	// containers are reported whole before their content, so find where each one ends first
+	ends := make(map[int]int)
+	if err := d.containerEnds(s, ends); err != nil {
+		return err
+	}
+	s.off = 0
+	err := d.walk(s, ends, nil, fn)
+	if err == SkipAll || err == SkipChildren {
+		return nil
+	}
+	return err
+}
+
+// containerEnds consumes the next value, recording where every container in it ends by where it starts.
+func (d *Decoder) containerEnds(s *sliceReader, ends map[int]int) error {
+	start := s.off
+	h, err := d.readHeader()
+	if err != nil {
+		return err
+	}
+	if h.typ != ArrayType && h.typ != MapType {
+		return d.skipPayload(h)
+	}
+
+	if err = d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	n := h.length
+	if h.typ == MapType {
+		n *= 2
+	}
+	for i := 0; i < n; i++ {
+		if err = d.containerEnds(s, ends); err != nil {
+			return err
+		}
+	}
+	ends[start] = s.off
+	return nil
+}
+
+func (d *Decoder) walk(s *sliceReader, ends map[int]int, path []any, fn WalkFunc) error {
+	start := s.off
+	h, err := d.readHeader()
+	if err != nil {
+		return err
+	}
+
+	if h.typ != ArrayType && h.typ != MapType {
+		if err = d.skipPayload(h); err != nil {
+			return err
+		}
+		if err = fn(path, h.typ, s.data[start:s.off:s.off]); err != SkipChildren {
+			return err
+		}
+		return nil
+	}
+
+	end := ends[start]
+	err = fn(path, h.typ, s.data[start:end:end])
+	if err == SkipChildren {
+		s.off = end
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < h.length; i++ {
+		var key any = i
+		if h.typ == MapType {
+			if key, err = d.decodeNext(); err != nil {
+				return err
+			}
+		}
+		if err = d.walk(s, ends, append(path, key), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
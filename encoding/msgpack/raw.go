@@ -0,0 +1,44 @@
+package msgpack
+
+import (
+	"bytes"
+	"reflect"
+)
+
+var rawMessageType = reflect.TypeFor[RawMessage]()
+
+// RawMessage is a raw encoded MessagePack value. It can be used to delay decoding part of a message,
+// or to embed an already encoded value. When produced by Unmarshal, a RawMessage shares memory with
+// the input data instead of copying it.
+type RawMessage []byte
+
+// MarshalMsgpack returns m as the encoding of m.
+func (m RawMessage) MarshalMsgpack() ([]byte, error) {
+	if m == nil {
+		return []byte{codeNil}, nil
+	}
+	return m, nil
+}
+
+// UnmarshalMsgpack sets *m to a copy of data.
+func (m *RawMessage) UnmarshalMsgpack(data []byte) error {
+	*m = bytes.Clone(data)
+	return nil
+}
+
+// Type reports the family of the encoded value.
+func (m RawMessage) Type() Type {
+	if len(m) == 0 {
+		return InvalidType
+	}
+	h, err := newBytesDecoder(m).readHeader()
+	if err != nil {
+		return InvalidType
+	}
+	return h.typ
+}
+
+// Unmarshal decodes the raw value into v.
+func (m RawMessage) Unmarshal(v any) error {
+	return Unmarshal(m, v)
+}
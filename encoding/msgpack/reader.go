@@ -0,0 +1,57 @@
+package msgpack
+
+import (
+	"io"
+)
+
+// source is what the Decoder reads from. *bufio.Reader satisfies it for streams and
+// sliceReader for in-memory data.
+type source interface {
+	io.Reader
+	io.ByteReader
+	Peek(n int) ([]byte, error)
+	Discard(n int) (int, error)
+}
+
+type sliceReader struct {
+	data []byte
+	off  int
+}
+
+func (s *sliceReader) Read(p []byte) (int, error) {
+	if s.off >= len(s.data) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[s.off:])
+	s.off += n
+	return n, nil
+}
+
+func (s *sliceReader) ReadByte() (byte, error) {
+	if s.off >= len(s.data) {
+		return 0, io.EOF
+	}
+	c := s.data[s.off]
+	s.off++
+	return c, nil
+}
+
+func (s *sliceReader) Peek(n int) ([]byte, error) {
+	if s.off+n > len(s.data) {
+		return s.data[s.off:], io.EOF
+	}
+	return s.data[s.off : s.off+n], nil
+}
+
+func (s *sliceReader) Discard(n int) (int, error) {
+	if s.off+n > len(s.data) {
+		n = len(s.data) - s.off
+		s.off = len(s.data)
+		return n, io.EOF
+	}
+	s.off += n
+	return n, nil
+}
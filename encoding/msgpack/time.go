@@ -0,0 +1,42 @@
+package msgpack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// TimestampExt is the extension type reserved by the spec for timestamps.
+const TimestampExt int8 = -1
+
+// appendTime writes t using the smallest of the timestamp 32, 64 and 96 formats able to hold it.
+func appendTime(b []byte, t time.Time) []byte {
+	sec, nsec := t.Unix(), int64(t.Nanosecond())
+	switch {
+	case sec>>34 == 0 && nsec == 0 && sec <= 0xffffffff:
+		b = appendExtHeader(b, TimestampExt, 4)
+		return binary.BigEndian.AppendUint32(b, uint32(sec))
+	case sec>>34 == 0:
+		b = appendExtHeader(b, TimestampExt, 8)
+		return binary.BigEndian.AppendUint64(b, uint64(nsec)<<34|uint64(sec))
+	}
+	b = appendExtHeader(b, TimestampExt, 12)
+	b = binary.BigEndian.AppendUint32(b, uint32(nsec))
+	return binary.BigEndian.AppendUint64(b, uint64(sec))
+}
+
+// parseTime decodes the payload of a timestamp extension value.
+func parseTime(data []byte) (time.Time, error) {
+	switch len(data) {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0).UTC(), nil
+	case 8:
+		v := binary.BigEndian.Uint64(data)
+		return time.Unix(int64(v&0x3ffffffff), int64(v>>34)).UTC(), nil
+	case 12:
+		nsec := binary.BigEndian.Uint32(data)
+		sec := binary.BigEndian.Uint64(data[4:])
+		return time.Unix(int64(sec), int64(nsec)).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("%w: timestamp of %d bytes", ErrInvalidCode, len(data))
+}